@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log/slog"
 	"regexp"
+	"sort"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -62,20 +63,50 @@ const (
 	modeDeny  = "deny"
 )
 
+const (
+	RuleHosts         = "hosts"          // RuleHosts is reported when a request is denied because its host is not one of the client hosts
+	RuleDefaultPolicy = "default-policy" // RuleDefaultPolicy is reported when no client configuration is loaded
+	RuleRateLimit     = "rate-limit"     // RuleRateLimit is reported when a request is denied because the client exceeded its rate limit
+)
+
 // Authorization is the internal representation of a client configuration
 type Authorization struct {
-	ClientID  string
-	Hosts     []string
-	Allow     bool
-	Endpoints map[HTTPMethod][]*regexp.Regexp
+	ClientID       string
+	Hosts          []string
+	Allow          bool
+	Endpoints      map[HTTPMethod][]*regexp.Regexp
+	MaxBodySize    int              // MaxBodySize is the maximum size of the inspected request bodies, DefaultMaxBodySize if unset
+	GraphQL        *BodyInspection  // GraphQL configures GraphQL operations inspection, nil if disabled
+	JSONRPC        *BodyInspection  // JSONRPC configures JSON-RPC methods inspection, nil if disabled
+	GRPC           []*GRPCRule      // GRPC lists the gRPC services and methods rules, path rules are used for gRPC calls if empty
+	RateLimit      *RateLimit       // RateLimit is the client wide rate limit, nil if unlimited
+	PathRateLimits []*RateLimitRule // PathRateLimits lists the rate limits applying to specific paths
+	Source         *Source          // Source describes where the configuration was loaded from, nil if built programmatically
+	Warnings       []string         // Warnings lists the configuration issues ignored while loading the configuration
+	usage          *ruleUsage
 }
 
 // NewAuthorization creates a new authorization
 func NewAuthorization() *Authorization {
 	return &Authorization{
-		Endpoints: make(map[HTTPMethod][]*regexp.Regexp),
-		Hosts:     make([]string, 0),
+		Endpoints:      make(map[HTTPMethod][]*regexp.Regexp),
+		Hosts:          make([]string, 0),
+		GRPC:           make([]*GRPCRule, 0),
+		PathRateLimits: make([]*RateLimitRule, 0),
+		Warnings:       make([]string, 0),
+		usage:          newRuleUsage(),
+	}
+}
+
+// warn logs a configuration issue and records it in the authorization warnings
+func (auth *Authorization) warn(msg string, err error) {
+	if err != nil {
+		slog.Warn(msg, slog.Any("error", err))
+		msg = fmt.Sprintf("%s: %s", msg, err)
+	} else {
+		slog.Warn(msg)
 	}
+	auth.Warnings = append(auth.Warnings, msg)
 }
 
 var (
@@ -83,8 +114,15 @@ var (
 	ErrMissingClientID = errors.New("clientID cannot be empty")
 	// ErrInvalidMode is an unknown mode is specified
 	ErrInvalidMode = errors.New("mode is mandatory and should either be 'allow' or 'reject'")
+	// ErrInvalidType is returned when a configuration value does not have the expected type
+	ErrInvalidType = errors.New("invalid configuration value type")
 )
 
+// invalidType returns an ErrInvalidType error detailing the key and the expected type
+func invalidType(key string, expected string, value interface{}) error {
+	return fmt.Errorf("%w: '%s' should be %s, got %v", ErrInvalidType, key, expected, value)
+}
+
 // NewAuthorizationFromYaml Geneates a new authorization configration from the provided yaml content
 //
 // Expected yaml format
@@ -107,68 +145,105 @@ func NewAuthorizationFromYaml(contents []byte) (*Authorization, error) {
 	if !ok {
 		return nil, ErrMissingClientID
 	}
-	auth.ClientID = cid.(string)
+	if auth.ClientID, ok = cid.(string); !ok {
+		return nil, invalidType("clientID", "a string", cid)
+	}
 
 	m, ok := yamlMap["mode"]
 	if !ok {
 		return nil, ErrInvalidMode
 	}
 
-	aliases, ok := yamlMap["hosts"]
-	if ok {
-		for _, a := range aliases.([]interface{}) {
-			auth.Hosts = append(auth.Hosts, a.(string))
+	if aliases, ok := yamlMap["hosts"]; ok {
+		hosts, ok := aliases.([]interface{})
+		if !ok {
+			return nil, invalidType("hosts", "a list", aliases)
+		}
+		for _, a := range hosts {
+			host, ok := a.(string)
+			if !ok {
+				return nil, invalidType("hosts", "a list of strings", a)
+			}
+			auth.Hosts = append(auth.Hosts, host)
 		}
 	}
 
-	mode := strings.ToLower(m.(string))
+	mode, ok := m.(string)
+	if !ok {
+		return nil, ErrInvalidMode
+	}
+	mode = strings.ToLower(mode)
 	if len(mode) == 0 || (mode != modeAllow && mode != modeDeny) {
 		return nil, ErrInvalidMode
 	}
 	auth.Allow = mode == modeAllow
 
-	paths, ok := yamlMap["paths"]
-	if ok {
-		for _, v := range paths.([]interface{}) {
-			switch v.(type) {
+	if p, ok := yamlMap["paths"]; ok {
+		paths, ok := p.([]interface{})
+		if !ok {
+			return nil, invalidType("paths", "a list", p)
+		}
+		for _, v := range paths {
+			switch construct := v.(type) {
 			case string:
-				if err := auth.ConfigurePath(v.(string), ""); err != nil {
-					slog.Warn("incompatible path detected", slog.Any("error", err))
+				if err := auth.ConfigurePath(construct, ""); err != nil {
+					auth.warn("incompatible path detected", err)
 					continue
 				}
 				continue
 			case map[string]interface{}:
-				construct := v.(map[string]interface{})
 				p, ok := construct["path"]
 				if !ok {
 					continue
 				}
-				path := p.(string)
+				path, ok := p.(string)
+				if !ok {
+					return nil, invalidType("path", "a string", p)
+				}
 
 				methods := ""
-				m, ok := construct["methods"]
-				if ok {
-					methods = m.(string)
+				if m, ok := construct["methods"]; ok {
+					if methods, ok = m.(string); !ok {
+						return nil, invalidType("methods", "a string", m)
+					}
 				}
 
 				if err := auth.ConfigurePath(path, methods); err != nil {
-					slog.Warn("incompatible path detected", slog.Any("error", err))
+					auth.warn("incompatible path detected", err)
 					continue
 				}
+
+				if rl, ok := construct["rateLimit"]; ok {
+					if err := auth.ConfigurePathRateLimit(path, methods, rl); err != nil {
+						return nil, err
+					}
+				}
 				continue
 			default:
-				slog.Error(fmt.Sprintf("unsupported path construct detected for clientID '%s': %v", auth.ClientID, v))
+				auth.warn(fmt.Sprintf("unsupported path construct detected for clientID '%s': %v", auth.ClientID, v), nil)
 				continue
 			}
 		}
 	}
 
-	if len(auth.Endpoints) == 0 {
+	if err := auth.configureBodyInspection(yamlMap); err != nil {
+		return nil, err
+	}
+
+	if err := auth.configureGRPCRules(yamlMap); err != nil {
+		return nil, err
+	}
+
+	if err := auth.configureRateLimit(yamlMap); err != nil {
+		return nil, err
+	}
+
+	if len(auth.Endpoints) == 0 && len(auth.GRPC) == 0 {
 		outcome := "refused"
 		if !auth.Allow {
 			outcome = "allowed"
 		}
-		slog.Warn(fmt.Sprintf("no paths defined for clientID '%s' - authorization will always be %s in mode '%s'", auth.ClientID, outcome, mode))
+		auth.warn(fmt.Sprintf("no paths defined for clientID '%s' - authorization will always be %s in mode '%s'", auth.ClientID, outcome, mode), nil)
 	}
 
 	return auth, nil
@@ -176,38 +251,108 @@ func NewAuthorizationFromYaml(contents []byte) (*Authorization, error) {
 
 // IsAllowed returns true if the provided path access should be granted
 func (auth *Authorization) IsAllowed(host string, path string, method HTTPMethod) bool {
+	allowed, _ := auth.matchPath(host, path, method)
+	return allowed
+}
 
-	endpoints, ok := auth.Endpoints[method]
-	if ok {
+// matchPath returns true if the provided path access should be granted and the rule which decided the outcome, empty if no path matched
+func (auth *Authorization) matchPath(host string, path string, method HTTPMethod) (bool, string) {
+	if !auth.hostAllowed(host) {
+		return false, RuleHosts
+	}
 
-		if len(auth.Hosts) > 0 {
-			hostFound := false
-			for _, h := range auth.Hosts {
-				hostFound = h == host
-			}
-			if !hostFound {
-				return false
+	for _, m := range []HTTPMethod{method, HTTPMethodAll} {
+		for _, p := range auth.Endpoints[m] {
+			if p.MatchString(path) {
+				return auth.Allow, fmt.Sprintf("paths %s %s", m, p)
 			}
 		}
+	}
+	return !auth.Allow, ""
+}
 
-		for _, p := range endpoints {
-			if p.MatchString(path) {
-				return auth.Allow
-			}
+// IsRequestAllowed returns nil if the provided request should be granted, inspecting the request body
+// for GraphQL operations and JSON-RPC methods when configured. The returned error details the deny reason.
+func (auth *Authorization) IsRequestAllowed(req *Request) error {
+	_, _, err := auth.evaluate(req)
+	return err
+}
+
+// evaluate returns nil if the provided request should be granted and the rule which decided the outcome, empty if no rule matched.
+// The returned code classifies the deny reason.
+func (auth *Authorization) evaluate(req *Request) (string, ReasonCode, error) {
+	if service, method, ok := req.GRPCMethod(); ok && len(auth.GRPC) > 0 {
+		allowed, rule := auth.matchGRPC(req.Host, service, method)
+		if !allowed {
+			return rule, deniedCode(rule), fmt.Errorf("%s is not authorized to call %s/%s", auth.ClientID, service, method)
 		}
+		return rule, "", nil
 	}
 
-	endpoints, ok = auth.Endpoints[HTTPMethodAll]
-	if !ok {
-		return !auth.Allow
+	allowed, rule := auth.matchPath(req.Host, req.Path, req.Method)
+	if !allowed {
+		return rule, deniedCode(rule), fmt.Errorf("%s is not authorized to access %s %s", auth.ClientID, req.Method, req.Path)
+	}
+	if bodyRule, err := auth.inspectBody(req); err != nil {
+		return bodyRule, ReasonOperationDenied, err
+	} else if len(bodyRule) > 0 {
+		return bodyRule, "", nil
+	}
+	return rule, "", nil
+}
+
+// deniedCode returns the code of a request denied by the provided path or gRPC rule
+func deniedCode(rule string) ReasonCode {
+	if rule == RuleHosts {
+		return ReasonHostMismatch
+	}
+	return ReasonPathDenied
+}
+
+// Rules lists the client rules as reported by the decisions Rule, gRPC rules first followed by the path rules sorted by method
+// and the body operation rules
+func (auth *Authorization) Rules() []string {
+	rules := make([]string, 0)
+	for _, r := range auth.GRPC {
+		rules = append(rules, fmt.Sprintf("grpc %s", r))
 	}
 
-	for _, p := range endpoints {
-		if p.MatchString(path) {
-			return auth.Allow
+	methods := make([]string, 0, len(auth.Endpoints))
+	for m := range auth.Endpoints {
+		methods = append(methods, string(m))
+	}
+	sort.Strings(methods)
+	for _, m := range methods {
+		for _, p := range auth.Endpoints[HTTPMethod(m)] {
+			rules = append(rules, fmt.Sprintf("paths %s %s", m, p))
+		}
+	}
+
+	for _, i := range []struct {
+		kind       OperationKind
+		inspection *BodyInspection
+	}{{OperationGraphQL, auth.GraphQL}, {OperationJSONRPC, auth.JSONRPC}} {
+		if i.inspection == nil {
+			continue
+		}
+		for _, r := range i.inspection.Rules {
+			rules = append(rules, fmt.Sprintf("%s operation %s", i.kind, r))
+		}
+	}
+	return rules
+}
+
+// hostAllowed returns true if the provided host is one of the client hosts or if no hosts are configured
+func (auth *Authorization) hostAllowed(host string) bool {
+	if len(auth.Hosts) == 0 {
+		return true
+	}
+	for _, h := range auth.Hosts {
+		if h == host {
+			return true
 		}
 	}
-	return !auth.Allow
+	return false
 }
 
 // ConfigurePath configures the provided path for the given methods
@@ -222,7 +367,7 @@ func (auth *Authorization) ConfigurePath(path string, methods string) error {
 		for _, m := range strings.Split(lowercased, ",") {
 			method := ParseHTTPMethod(m)
 			if method == HTTPMethodUnknown {
-				slog.Warn(fmt.Sprintf("http method '%s' is not a supported method and will be ignored for clientID '%s'", method, auth.ClientID))
+				auth.warn(fmt.Sprintf("http method '%s' is not a supported method and will be ignored for clientID '%s'", m, auth.ClientID), nil)
 				continue
 			}
 			supportedMethods = append(supportedMethods, method)
@@ -1,8 +1,32 @@
 package authz
 
 import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -150,6 +174,37 @@ paths:
 	assert.ErrorIs(t, err, ErrInvalidMode)
 }
 
+func TestLoadInvalidTypesYaml(t *testing.T) {
+	for _, yml := range []string{
+		"clientID: [client]\nmode: allow",
+		"clientID: client\nmode: [allow]",
+		"clientID: client\nmode: allow\nhosts: foo",
+		"clientID: client\nmode: allow\nhosts:\n  - [foo]",
+		"clientID: client\nmode: allow\npaths: /pokemon",
+		"clientID: client\nmode: allow\npaths:\n  - path: [/pokemon]",
+		"clientID: client\nmode: allow\npaths:\n  - path: /pokemon\n    methods: [GET]",
+		"clientID: client\nmode: allow\ngrpc: pokemon.v1.PokemonService",
+		"clientID: client\nmode: allow\ngrpc:\n  - service: [pokemon.v1.PokemonService]",
+		"clientID: client\nmode: allow\ngrpc:\n  - service: pokemon.v1.PokemonService\n    methods: [GetPokemon]",
+		"clientID: client\nmode: allow\ngraphql:\n  operations: pokemon",
+		"clientID: client\nmode: allow\ngraphql:\n  path: [/graphql]",
+		"clientID: client\nmode: allow\ngraphql:\n  operations:\n    - name: [pokemon]",
+		"clientID: client\nmode: allow\njsonrpc:\n  methods:\n    - name: pokemon.get\n      type: [query]",
+	} {
+		assert.NotPanics(t, func() {
+			_, err := NewAuthorizationFromYaml([]byte(yml))
+			assert.Error(t, err, yml)
+		})
+	}
+
+	_, err := NewAuthorizationFromYaml([]byte("clientID: client\nmode: allow\nhosts: foo"))
+	assert.ErrorIs(t, err, ErrInvalidType)
+	_, err = NewAuthorizationFromYaml([]byte("clientID: client\nmode: allow\ngrpc: pokemon.v1.PokemonService"))
+	assert.ErrorIs(t, err, ErrInvalidType)
+	_, err = NewAuthorizationFromYaml([]byte("clientID: client\nmode: allow\njsonrpc:\n  methods: pokemon.get"))
+	assert.ErrorIs(t, err, ErrInvalidType)
+}
+
 func TestLoadMissingPathYaml(t *testing.T) {
 	yml := `
 clientID: client
@@ -309,3 +364,1155 @@ paths:
 	assert.False(t, auth.IsAllowed("jarl.com", "/api/encounter", HTTPMethodPut))
 	assert.False(t, auth.IsAllowed("jarl.com", "/api/pokemon/pikachu", HTTPMethodPut))
 }
+
+func TestHostsAlwaysEnforced(t *testing.T) {
+	yml := `
+clientID: client
+mode: allow
+hosts:
+  - localhost
+paths:
+  - path: /api/pokemon/.*?
+    methods: get
+  - /api/berries
+`
+
+	// Hosts apply to the rules matching all the methods and to the methods without rules
+	auth, err := NewAuthorizationFromYaml([]byte(yml))
+	assert.NoError(t, err)
+	assert.True(t, auth.IsAllowed("localhost", "/api/berries", HTTPMethodDelete))
+	assert.False(t, auth.IsAllowed("jarl.com", "/api/berries", HTTPMethodDelete))
+	assert.False(t, auth.IsAllowed("jarl.com", "/api/berries", HTTPMethodGet))
+
+	// Clients in deny mode are denied on the other hosts
+	auth, err = NewAuthorizationFromYaml([]byte(strings.Replace(yml, "mode: allow", "mode: deny", 1)))
+	assert.NoError(t, err)
+	assert.True(t, auth.IsAllowed("localhost", "/api/encounter", HTTPMethodPost))
+	assert.False(t, auth.IsAllowed("localhost", "/api/berries", HTTPMethodPost))
+	assert.False(t, auth.IsAllowed("jarl.com", "/api/encounter", HTTPMethodPost))
+	assert.False(t, auth.IsAllowed("jarl.com", "/api/encounter", HTTPMethodGet))
+}
+
+func TestGraphQLOperationsAllowed(t *testing.T) {
+	yml := `
+clientID: client
+mode: allow
+paths:
+  - path: /graphql
+    methods: GET, POST
+graphql:
+  path: /graphql
+  operations:
+    - GetPokemon
+    - name: List.*
+      type: query
+`
+
+	auth, err := NewAuthorizationFromYaml([]byte(yml))
+	assert.NoError(t, err)
+	assert.NotNil(t, auth.GraphQL)
+	assert.Len(t, auth.GraphQL.Rules, 2)
+
+	request := func(body string) *Request {
+		return &Request{Host: "localhost", Path: "/graphql", Method: HTTPMethodPost, Body: []byte(body)}
+	}
+
+	assert.NoError(t, auth.IsRequestAllowed(request(`{"query":"query GetPokemon { pokemon(name: \"pikachu\") { id } }"}`)))
+	assert.NoError(t, auth.IsRequestAllowed(request(`{"query":"query ListPokemons { pokemons { id } }"}`)))
+	assert.NoError(t, auth.IsRequestAllowed(request(`[{"query":"query GetPokemon { a }"},{"query":"query ListBerries { b }"}]`)))
+	assert.NoError(t, auth.IsRequestAllowed(request(`query GetPokemon { pokemon { id } }`)))
+	assert.NoError(t, auth.IsRequestAllowed(&Request{Host: "localhost", Path: "/graphql?query=query%20ListBerries%20%7B%20a%20%7D", Method: HTTPMethodGet}))
+	assert.NoError(t, auth.IsRequestAllowed(request(`{"query":"query ListPokemons { a } mutation DeletePokemon { b }","operationName":"ListPokemons"}`)))
+
+	assert.Error(t, auth.IsRequestAllowed(request(`{"query":"mutation ListPokemons { a }"}`)))
+	assert.Error(t, auth.IsRequestAllowed(request(`{"query":"{ pokemons { id } }"}`)))
+	assert.Error(t, auth.IsRequestAllowed(request(`{"query":"query ListPokemons { a } mutation DeletePokemon { b }","operationName":"DeletePokemon"}`)))
+	assert.Error(t, auth.IsRequestAllowed(request(`{"query":"query ListPokemons { a } mutation DeletePokemon { b }"}`)))
+	assert.Error(t, auth.IsRequestAllowed(request(`[{"query":"query GetPokemon { a }"},{"query":"mutation DeletePokemon { b }"}]`)))
+	assert.Error(t, auth.IsRequestAllowed(request(`{"query":"query GetPokemon { a "}`)))
+	assert.ErrorIs(t, auth.IsRequestAllowed(request(``)), ErrNoOperation)
+}
+
+func TestGraphQLOperationsDenied(t *testing.T) {
+	yml := `
+clientID: client
+mode: deny
+graphql:
+  operations:
+    - name: .*
+      type: mutation
+`
+
+	auth, err := NewAuthorizationFromYaml([]byte(yml))
+	assert.NoError(t, err)
+
+	request := func(body string) *Request {
+		return &Request{Host: "localhost", Path: "/graphql", Method: HTTPMethodPost, Body: []byte(body)}
+	}
+
+	assert.NoError(t, auth.IsRequestAllowed(request(`{"query":"# mutation Comment\nquery GetPokemon($name: String = \"mutation\") { pokemon(name: $name) { ...Fields } } fragment Fields on Pokemon { id }"}`)))
+	assert.NoError(t, auth.IsRequestAllowed(request(`{"query":"{ pokemons { id } }"}`)))
+	assert.Error(t, auth.IsRequestAllowed(request(`{"query":"mutation DeletePokemon { delete }"}`)))
+	assert.Error(t, auth.IsRequestAllowed(request(`{"query":"mutation { delete }"}`)))
+	assert.NoError(t, auth.IsRequestAllowed(&Request{Host: "localhost", Path: "/pokemon", Method: HTTPMethodPost, Body: []byte(`mutation { delete }`)}))
+}
+
+func TestJSONRPCMethods(t *testing.T) {
+	yml := `
+clientID: client
+mode: allow
+paths:
+  - path: /rpc
+    methods: POST
+jsonrpc:
+  methods:
+    - pokemon\.get
+    - berries\..*
+`
+
+	auth, err := NewAuthorizationFromYaml([]byte(yml))
+	assert.NoError(t, err)
+
+	request := func(body string) *Request {
+		return &Request{Host: "localhost", Path: "/rpc", Method: HTTPMethodPost, Body: []byte(body)}
+	}
+
+	assert.NoError(t, auth.IsRequestAllowed(request(`{"jsonrpc":"2.0","method":"pokemon.get","id":1}`)))
+	assert.NoError(t, auth.IsRequestAllowed(request(`[{"jsonrpc":"2.0","method":"pokemon.get","id":1},{"jsonrpc":"2.0","method":"berries.list"}]`)))
+	assert.Error(t, auth.IsRequestAllowed(request(`{"jsonrpc":"2.0","method":"pokemon.getAll","id":1}`)))
+	assert.Error(t, auth.IsRequestAllowed(request(`[{"jsonrpc":"2.0","method":"pokemon.get","id":1},{"jsonrpc":"2.0","method":"pokemon.delete"}]`)))
+	assert.Error(t, auth.IsRequestAllowed(request(`{"jsonrpc":"2.0","id":1}`)))
+	assert.Error(t, auth.IsRequestAllowed(request(`not json`)))
+}
+
+func TestBodyInspectionLimits(t *testing.T) {
+	yml := `
+clientID: client
+mode: deny
+maxBodySize: 64
+jsonrpc:
+  path: /rpc
+  methods:
+    - admin\..*
+`
+
+	auth, err := NewAuthorizationFromYaml([]byte(yml))
+	assert.NoError(t, err)
+	assert.Equal(t, 64, auth.MaxBodySize)
+
+	body := []byte(`{"jsonrpc":"2.0","method":"pokemon.get","id":1}`)
+	assert.NoError(t, auth.IsRequestAllowed(&Request{Path: "/rpc", Method: HTTPMethodPost, Body: body}))
+	assert.ErrorIs(t, auth.IsRequestAllowed(&Request{Path: "/rpc", Method: HTTPMethodPost, Body: body, BodyTruncated: true}), ErrBodyTruncated)
+
+	body = []byte(`{"jsonrpc":"2.0","method":"pokemon.get","params":{"name":"pikachu","level":100},"id":1}`)
+	assert.ErrorIs(t, auth.IsRequestAllowed(&Request{Path: "/rpc", Method: HTTPMethodPost, Body: body}), ErrBodyTooLarge)
+
+	_, err = NewAuthorizationFromYaml([]byte("clientID: client\nmode: deny\nmaxBodySize: -1\n"))
+	assert.Error(t, err)
+}
+
+func TestGRPCRules(t *testing.T) {
+	yml := `
+clientID: client
+mode: allow
+paths:
+  - /pokemon
+grpc:
+  - pokemon.v1.PokemonService/GetPokemon
+  - pokemon.v1.BerryService
+  - service: trainer.*
+    methods: List*, Get*
+  - service: pokemon.v1.EncounterService/Get
+    methods: List
+  - ""
+`
+
+	auth, err := NewAuthorizationFromYaml([]byte(yml))
+	assert.NoError(t, err)
+	assert.Len(t, auth.GRPC, 4)
+
+	request := func(path string) *Request {
+		return &Request{Host: "localhost", Path: path, Method: HTTPMethodPost, Headers: map[string]string{"content-type": "application/grpc"}}
+	}
+
+	assert.NoError(t, auth.IsRequestAllowed(request("/pokemon.v1.PokemonService/GetPokemon")))
+	assert.NoError(t, auth.IsRequestAllowed(request("/pokemon.v1.BerryService/DeleteBerry")))
+	assert.NoError(t, auth.IsRequestAllowed(request("/trainer.v2.TrainerService/ListTrainers")))
+	assert.Error(t, auth.IsRequestAllowed(request("/pokemon.v1.PokemonService/DeletePokemon")))
+	assert.Error(t, auth.IsRequestAllowed(request("/pokemon.v1.PokemonServiceV2/GetPokemon")))
+	assert.Error(t, auth.IsRequestAllowed(request("/trainer.v2.TrainerService/DeleteTrainer")))
+
+	// Non gRPC requests are still evaluated against the paths
+	assert.NoError(t, auth.IsRequestAllowed(&Request{Host: "localhost", Path: "/pokemon", Method: HTTPMethodGet}))
+}
+
+func TestGRPCMethod(t *testing.T) {
+	req := &Request{Path: "/pokemon.v1.PokemonService/GetPokemon", Headers: map[string]string{"content-type": "application/grpc+proto"}}
+	service, method, ok := req.GRPCMethod()
+	assert.True(t, ok)
+	assert.Equal(t, "pokemon.v1.PokemonService", service)
+	assert.Equal(t, "GetPokemon", method)
+
+	req.Headers["content-type"] = "application/json"
+	_, _, ok = req.GRPCMethod()
+	assert.False(t, ok)
+
+	req = &Request{Path: "/pokemon", Headers: map[string]string{"content-type": "application/grpc"}}
+	_, _, ok = req.GRPCMethod()
+	assert.False(t, ok)
+
+	for contentType, grpc := range map[string]bool{
+		"application/grpc":                true,
+		"application/grpc+proto":          true,
+		"Application/gRPC; charset=utf-8": true,
+		"application/grpc-web":            false,
+		"application/grpc-web+proto":      false,
+		"application/grpc-web-text":       false,
+		"application/grpcfoo":             false,
+		"":                                false,
+	} {
+		req := &Request{Headers: map[string]string{"content-type": contentType}}
+		assert.Equal(t, grpc, req.IsGRPC(), contentType)
+	}
+}
+
+func TestMultipleHostsAllowed(t *testing.T) {
+	yml := `
+clientID: client
+mode: allow
+hosts:
+  - localhost
+  - 127.0.0.1
+paths:
+  - /api/encounter
+`
+
+	auth, err := NewAuthorizationFromYaml([]byte(yml))
+	assert.NoError(t, err)
+	assert.True(t, auth.IsAllowed("localhost", "/api/encounter", HTTPMethodGet))
+	assert.True(t, auth.IsAllowed("127.0.0.1", "/api/encounter", HTTPMethodGet))
+	assert.False(t, auth.IsAllowed("jarl.com", "/api/encounter", HTTPMethodGet))
+}
+
+func TestDecisionCache(t *testing.T) {
+	cache := NewDecisionCache(2, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.Put("a", Decision{Allowed: true})
+	cache.Put("b", Decision{Allowed: false, Reason: "denied"})
+
+	d, ok := cache.Get("a")
+	assert.True(t, ok)
+	assert.True(t, d.Allowed)
+
+	// b is the least recently used entry
+	cache.Put("c", Decision{Allowed: true})
+	_, ok = cache.Get("b")
+	assert.False(t, ok)
+	assert.Equal(t, 2, cache.Len())
+
+	now = now.Add(2 * time.Minute)
+	_, ok = cache.Get("a")
+	assert.False(t, ok)
+
+	cache.Purge()
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestCachedAuthorizations(t *testing.T) {
+	a := NewAuthorizations()
+	a.EnableCache(10, time.Minute)
+
+	auth, err := NewAuthorizationFromYaml([]byte("clientID: client\nmode: allow\npaths:\n  - /pokemon\ngraphql:\n  operations:\n    - GetPokemon\n"))
+	assert.NoError(t, err)
+	a.Add(auth)
+
+	allowed, err := a.IsAllowed("localhost", "client", "/pokemon", HTTPMethodGet)
+	assert.True(t, allowed)
+	assert.NoError(t, err)
+	allowed, err = a.IsAllowed("localhost", "client", "/berries", HTTPMethodGet)
+	assert.False(t, allowed)
+	assert.Error(t, err)
+	assert.Equal(t, 2, a.cache.Len())
+
+	// Cached decisions are served with the same outcome
+	allowed, err = a.IsAllowed("localhost", "client", "/berries", HTTPMethodGet)
+	assert.False(t, allowed)
+	assert.EqualError(t, err, "client is not authorized to access GET /berries")
+
+	// Body dependent decisions are never cached
+	a.IsRequestAllowed(&Request{ClientID: "client", Path: "/graphql", Method: HTTPMethodPost, Body: []byte(`{"query":"query GetPokemon { a }"}`)})
+	assert.Equal(t, 2, a.cache.Len())
+
+	// Reloading the authorizations invalidates the cache
+	other := NewAuthorizations()
+	auth, err = NewAuthorizationFromYaml([]byte("clientID: client\nmode: allow\npaths:\n  - /berries\n"))
+	assert.NoError(t, err)
+	other.Add(auth)
+	a.Replace(other)
+	assert.Equal(t, 0, a.cache.Len())
+
+	allowed, _ = a.IsAllowed("localhost", "client", "/berries", HTTPMethodGet)
+	assert.True(t, allowed)
+}
+
+func TestCachedHostCase(t *testing.T) {
+	a := NewAuthorizations()
+	a.EnableCache(10, time.Minute)
+	auth, err := NewAuthorizationFromYaml([]byte("clientID: client\nmode: allow\nhosts:\n  - api.local\npaths:\n  - /pokemon\n"))
+	assert.NoError(t, err)
+	a.Add(auth)
+
+	allowed, _ := a.IsAllowed("API.LOCAL", "client", "/pokemon", HTTPMethodGet)
+	assert.False(t, allowed)
+	allowed, _ = a.IsAllowed("api.local", "client", "/pokemon", HTTPMethodGet)
+	assert.True(t, allowed)
+
+	// The decision cached for a host never applies to the same host with another case
+	allowed, _ = a.IsAllowed("API.LOCAL", "client", "/pokemon", HTTPMethodGet)
+	assert.False(t, allowed)
+	allowed, _ = a.IsAllowed("Api.Local", "client", "/pokemon", HTTPMethodGet)
+	assert.False(t, allowed)
+}
+
+func TestRateLimitConfiguration(t *testing.T) {
+	yml := `
+clientID: client
+mode: allow
+rateLimit:
+  requestsPerSecond: 10
+  burst: 20
+paths:
+  - path: /pokemon
+    methods: GET, POST
+    rateLimit:
+      requestsPerMinute: 60
+`
+
+	auth, err := NewAuthorizationFromYaml([]byte(yml))
+	assert.NoError(t, err)
+	assert.Equal(t, &RateLimit{Rate: 10, Burst: 20}, auth.RateLimit)
+	assert.Len(t, auth.PathRateLimits, 1)
+	assert.Equal(t, &RateLimit{Rate: 1, Burst: 60}, auth.PathRateLimits[0].Limit)
+	assert.True(t, auth.PathRateLimits[0].Matches("/pokemon", HTTPMethodPost))
+	assert.False(t, auth.PathRateLimits[0].Matches("/pokemon", HTTPMethodDelete))
+
+	_, err = NewAuthorizationFromYaml([]byte("clientID: client\nmode: allow\nrateLimit:\n  requestsPerSecond: 10\n  requestsPerMinute: 10\n"))
+	assert.Error(t, err)
+	_, err = NewAuthorizationFromYaml([]byte("clientID: client\nmode: allow\nrateLimit:\n  requestsPerSecond: 0\n"))
+	assert.Error(t, err)
+}
+
+func TestLimiter(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	limiter := NewLimiter(store)
+	limit := &RateLimit{Rate: 1, Burst: 2}
+
+	q := limiter.Take("client", limit)
+	assert.False(t, q.Exceeded)
+	assert.Equal(t, 1, q.Remaining)
+	q = limiter.Take("client", limit)
+	assert.False(t, q.Exceeded)
+	assert.Equal(t, 0, q.Remaining)
+	assert.Equal(t, 2*time.Second, q.Reset)
+
+	q = limiter.Take("client", limit)
+	assert.True(t, q.Exceeded)
+	assert.Equal(t, time.Second, q.RetryAfter)
+
+	now = now.Add(time.Second)
+	q = limiter.Take("client", limit)
+	assert.False(t, q.Exceeded)
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	limit := &RateLimit{Rate: 1, Burst: 2}
+
+	for i := 0; i < 100; i++ {
+		_, _ = store.Take(fmt.Sprintf("random-%d", i), limit)
+	}
+	slow := &RateLimit{Rate: 1.0 / 60, Burst: 2}
+	_, _ = store.Take("client", slow)
+	_, _ = store.Take("client", slow)
+	assert.Len(t, store.buckets, 101)
+
+	// Refilled buckets are evicted by the next sweep while the others are kept
+	now = now.Add(bucketSweepInterval + time.Second)
+	q, _ := store.Take("client", slow)
+	assert.Len(t, store.buckets, 1)
+	assert.Equal(t, 0, q.Remaining)
+	q, _ = store.Take("client", slow)
+	assert.True(t, q.Exceeded)
+
+	// Evicted buckets start again with a full burst
+	q, _ = store.Take("random-1", limit)
+	assert.Equal(t, 1, q.Remaining)
+}
+
+func TestRateLimitedAuthorizations(t *testing.T) {
+	a := NewAuthorizations()
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	a.SetRateLimitStore(store)
+
+	auth, err := NewAuthorizationFromYaml([]byte("clientID: client\nmode: deny\nrateLimit:\n  requestsPerMinute: 2\n"))
+	assert.NoError(t, err)
+	a.Add(auth)
+
+	req := &Request{ClientID: "client", Path: "/pokemon", Method: HTTPMethodGet}
+	d := a.Check(req)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 1, d.Quota.Remaining)
+	assert.True(t, a.Check(req).Allowed)
+
+	d = a.Check(req)
+	assert.False(t, d.Allowed)
+	assert.True(t, d.Quota.Exceeded)
+	assert.Equal(t, 30*time.Second, d.Quota.RetryAfter)
+
+	// Denied requests do not consume the quota
+	d = a.Check(&Request{ClientID: "unknown", Path: "/pokemon", Method: HTTPMethodGet})
+	assert.False(t, d.Allowed)
+	assert.Nil(t, d.Quota)
+
+	// Unknown clients falling back to the _default policy do not share their quotas
+	auth, err = NewAuthorizationFromYaml([]byte("clientID: _default\nmode: deny\nrateLimit:\n  requestsPerMinute: 1\n"))
+	assert.NoError(t, err)
+	a.Add(auth)
+	assert.True(t, a.Check(&Request{ClientID: "unknown", Path: "/pokemon", Method: HTTPMethodGet}).Allowed)
+	assert.False(t, a.Check(&Request{ClientID: "unknown", Path: "/pokemon", Method: HTTPMethodGet}).Allowed)
+	assert.True(t, a.Check(&Request{ClientID: "other", Path: "/pokemon", Method: HTTPMethodGet}).Allowed)
+}
+
+func TestRateLimitRollback(t *testing.T) {
+	a := NewAuthorizations()
+	store := NewMemoryStore()
+	now := time.Now()
+	store.now = func() time.Time { return now }
+	a.SetRateLimitStore(store)
+
+	auth, err := NewAuthorizationFromYaml([]byte(`
+clientID: client
+mode: allow
+rateLimit:
+  requestsPerMinute: 3
+paths:
+  - /berries
+  - path: /pokemon
+    rateLimit:
+      requestsPerMinute: 1
+  - path: /pokemon
+    rateLimit:
+      requestsPerMinute: 5
+`))
+	assert.NoError(t, err)
+	a.Add(auth)
+
+	pokemon := &Request{ClientID: "client", Path: "/pokemon", Method: HTTPMethodGet}
+	berries := &Request{ClientID: "client", Path: "/berries", Method: HTTPMethodGet}
+
+	// Identical path rules each enforce their own quota
+	d := a.Check(pokemon)
+	assert.True(t, d.Allowed)
+	assert.Equal(t, 0, d.Quota.Remaining)
+	d = a.Check(pokemon)
+	assert.False(t, d.Allowed)
+
+	// The denied request was refunded to the client wide quota
+	assert.True(t, a.Check(berries).Allowed)
+	assert.True(t, a.Check(berries).Allowed)
+	assert.False(t, a.Check(berries).Allowed)
+}
+
+// fakeRedis is a minimal stand-in for a redis server supporting the commands used by the RedisStore
+func fakeRedis(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	var mu sync.Mutex
+	counters := make(map[string]int64)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+				for {
+					cmd, err := c.read()
+					if err != nil {
+						return
+					}
+					args := cmd.([]interface{})
+					switch args[0] {
+					case "INCR":
+						mu.Lock()
+						counters[args[1].(string)]++
+						fmt.Fprintf(conn, ":%d\r\n", counters[args[1].(string)])
+						mu.Unlock()
+					case "DECR":
+						mu.Lock()
+						counters[args[1].(string)]--
+						fmt.Fprintf(conn, ":%d\r\n", counters[args[1].(string)])
+						mu.Unlock()
+					case "PEXPIRE":
+						fmt.Fprint(conn, ":1\r\n")
+					case "PING":
+						fmt.Fprint(conn, "+PONG\r\n")
+					default:
+						fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+					}
+				}
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestRedisStore(t *testing.T) {
+	listener := fakeRedis(t)
+	defer listener.Close()
+
+	now := time.Unix(1000, 0)
+	replicas := make([]*RedisStore, 0)
+	for i := 0; i < 2; i++ {
+		store, err := NewRedisStore("redis://"+listener.Addr().String(), time.Second)
+		assert.NoError(t, err)
+		store.now = func() time.Time { return now }
+		defer store.Close()
+		replicas = append(replicas, store)
+	}
+
+	limit := &RateLimit{Rate: 1, Burst: 2}
+	q, err := replicas[0].Take("client", limit)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, q.Remaining)
+	q, err = replicas[1].Take("client", limit)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, q.Remaining)
+
+	// The quota is shared across replicas
+	q, err = replicas[0].Take("client", limit)
+	assert.NoError(t, err)
+	assert.True(t, q.Exceeded)
+	assert.Equal(t, 2*time.Second, q.RetryAfter)
+
+	// Refunded requests can be performed again
+	assert.NoError(t, replicas[1].Refund("client", limit))
+	assert.NoError(t, replicas[1].Refund("client", limit))
+	q, err = replicas[0].Take("client", limit)
+	assert.NoError(t, err)
+	assert.False(t, q.Exceeded)
+
+	now = now.Add(2 * time.Second)
+	q, err = replicas[1].Take("client", limit)
+	assert.NoError(t, err)
+	assert.False(t, q.Exceeded)
+
+	_, err = NewRedisStore("http://localhost:6379", time.Second)
+	assert.Error(t, err)
+	_, err = NewRedisStore("localhost", time.Second)
+	assert.Error(t, err)
+}
+
+func TestLimiterFallback(t *testing.T) {
+	listener := fakeRedis(t)
+	store, err := NewRedisStore(listener.Addr().String(), 100*time.Millisecond)
+	assert.NoError(t, err)
+	listener.Close()
+
+	limiter := NewLimiter(store)
+	limit := &RateLimit{Rate: 1, Burst: 1}
+	q := limiter.Take("client", limit)
+	assert.False(t, q.Exceeded)
+	assert.True(t, limiter.degraded.Load())
+
+	q = limiter.Take("client", limit)
+	assert.True(t, q.Exceeded)
+}
+
+// flakyStore is a rate limit store which can be made unreachable
+type flakyStore struct {
+	*MemoryStore
+	failing atomic.Bool
+	calls   atomic.Int32
+}
+
+func (s *flakyStore) Take(key string, limit *RateLimit) (*Quota, error) {
+	s.calls.Add(1)
+	if s.failing.Load() {
+		return nil, errors.New("unreachable")
+	}
+	return s.MemoryStore.Take(key, limit)
+}
+
+func (s *flakyStore) Ping() error {
+	if s.failing.Load() {
+		return errors.New("unreachable")
+	}
+	return nil
+}
+
+func TestLimiterCircuitBreaker(t *testing.T) {
+	store := &flakyStore{MemoryStore: NewMemoryStore()}
+	store.failing.Store(true)
+	limiter := NewLimiter(store)
+	limiter.backoff = 10 * time.Millisecond
+	limit := &RateLimit{Rate: 1, Burst: 10}
+
+	assert.False(t, limiter.Take("client", limit).Exceeded)
+	assert.True(t, limiter.degraded.Load())
+
+	// The store is not used while it is unreachable
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, limiter.Take("client", limit).Exceeded)
+	assert.Equal(t, int32(1), store.calls.Load())
+
+	// The store is used again once a probe succeeded
+	store.failing.Store(false)
+	assert.Eventually(t, func() bool { return !limiter.degraded.Load() }, 2*time.Second, 10*time.Millisecond)
+	assert.False(t, limiter.Take("client", limit).Exceeded)
+	assert.Equal(t, int32(2), store.calls.Load())
+}
+
+func TestDefaultPolicy(t *testing.T) {
+	_, err := ParseDefaultPolicy("maybe")
+	assert.Error(t, err)
+
+	a := NewAuthorizations()
+	allowed, _ := a.IsAllowed("localhost", "client", "/pokemon", HTTPMethodGet)
+	assert.True(t, allowed)
+
+	// The default policy never grants requests without identity
+	allowed, err = a.IsAllowed("localhost", "", "/pokemon", HTTPMethodGet)
+	assert.False(t, allowed)
+	assert.ErrorIs(t, err, ErrMissingIdentity)
+
+	policy, err := ParseDefaultPolicy("Deny")
+	assert.NoError(t, err)
+	a.SetDefaultPolicy(policy)
+	d := a.Check(&Request{ClientID: "client", Path: "/pokemon", Method: HTTPMethodGet})
+	assert.False(t, d.Allowed)
+	assert.Equal(t, ErrNoConfiguration.Error(), d.Reason)
+
+	a.SetDefaultPolicy(DefaultPolicyDryRun)
+	d = a.Check(&Request{ClientID: "client", Path: "/pokemon", Method: HTTPMethodGet})
+	assert.True(t, d.Allowed)
+	assert.True(t, d.DryRun)
+}
+
+func TestPendingAuthorizations(t *testing.T) {
+	a := NewPendingAuthorizations()
+	assert.False(t, a.Loaded())
+
+	// The default policy only applies once the client configurations were loaded
+	d := a.Check(&Request{ClientID: "client", Path: "/pokemon", Method: HTTPMethodGet})
+	assert.False(t, d.Allowed)
+	assert.ErrorIs(t, d.Err(), ErrNotLoaded)
+	assert.Equal(t, ReasonNoConfiguration, d.Code)
+
+	a.Replace(NewAuthorizations())
+	d = a.Check(&Request{ClientID: "client", Path: "/pokemon", Method: HTTPMethodGet})
+	assert.True(t, d.Allowed)
+	assert.Equal(t, RuleDefaultPolicy, d.Rule)
+}
+
+func TestFallbackPolicies(t *testing.T) {
+	a := NewAuthorizations()
+	auth, err := NewAuthorizationFromYaml([]byte("clientID: client\nmode: allow\npaths:\n  - /pokemon\n"))
+	assert.NoError(t, err)
+	a.Add(auth)
+
+	allowed, err := a.IsAllowed("localhost", "unknown", "/berries", HTTPMethodGet)
+	assert.False(t, allowed)
+	assert.EqualError(t, err, "no authz configuration defined for unknown")
+	allowed, err = a.IsAllowed("localhost", "", "/berries", HTTPMethodGet)
+	assert.False(t, allowed)
+	assert.ErrorIs(t, err, ErrMissingIdentity)
+
+	auth, err = NewAuthorizationFromYaml([]byte("clientID: _default\nmode: allow\npaths:\n  - path: /berries\n    methods: GET\n"))
+	assert.NoError(t, err)
+	a.Add(auth)
+	auth, err = NewAuthorizationFromYaml([]byte("clientID: _anonymous\nmode: allow\npaths:\n  - path: /public\n    methods: GET\n"))
+	assert.NoError(t, err)
+	a.Add(auth)
+
+	allowed, _ = a.IsAllowed("localhost", "unknown", "/berries", HTTPMethodGet)
+	assert.True(t, allowed)
+	allowed, _ = a.IsAllowed("localhost", "unknown", "/pokemon", HTTPMethodGet)
+	assert.False(t, allowed)
+	allowed, _ = a.IsAllowed("localhost", "", "/public", HTTPMethodGet)
+	assert.True(t, allowed)
+	allowed, _ = a.IsAllowed("localhost", "", "/berries", HTTPMethodGet)
+	assert.False(t, allowed)
+
+	// Known clients are not affected by the fallback policies
+	allowed, _ = a.IsAllowed("localhost", "client", "/berries", HTTPMethodGet)
+	assert.False(t, allowed)
+}
+
+func TestLoaded(t *testing.T) {
+	a := NewAuthorizations()
+	assert.False(t, a.Loaded())
+
+	// An empty configuration directory is a valid policy set
+	loaded, err := LoadAll(t.TempDir())
+	assert.NoError(t, err)
+	assert.True(t, loaded.Loaded())
+
+	a.Replace(loaded)
+	assert.True(t, a.Loaded())
+}
+
+func TestLoadStatus(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "client.yaml"), []byte("clientID: client\nmode: allow\npaths:\n  - path: /pokemon\n    methods: GET,FETCH\n"), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "broken.yaml"), []byte("mode: allow\n"), 0600))
+
+	a, err := LoadAll(dir)
+	assert.NoError(t, err)
+
+	status := a.Status()
+	assert.Equal(t, dir, status.Source)
+	assert.Equal(t, 1, status.Clients)
+	assert.Len(t, status.Hash, 64)
+	assert.Equal(t, []LoadError{{File: filepath.Join(dir, "broken.yaml"), Error: ErrMissingClientID.Error()}}, status.Errors)
+
+	auth, ok := a.Client("client")
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(dir, "client.yaml"), auth.Source.File)
+	assert.Equal(t, []string{"http method 'fetch' is not a supported method and will be ignored for clientID 'client'"}, auth.Warnings)
+
+	js, err := json.Marshal(auth)
+	assert.NoError(t, err)
+	assert.Contains(t, string(js), `"paths":{"GET":["/pokemon"]}`)
+	assert.Contains(t, string(js), `"mode":"allow"`)
+
+	// The same content always produces the same hash
+	other, err := LoadAll(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, status.Hash, other.Status().Hash)
+
+	a.ReloadFailed(errors.New("boom"))
+	assert.Equal(t, "boom", a.Status().LastError)
+	a.Replace(other)
+	assert.Empty(t, a.Status().LastError)
+}
+
+func TestDecisionRule(t *testing.T) {
+	a := NewAuthorizations()
+	d := a.Check(&Request{ClientID: "client", Path: "/pokemon", Method: HTTPMethodGet})
+	assert.Equal(t, RuleDefaultPolicy, d.Rule)
+
+	yml := `
+clientID: client
+mode: allow
+hosts:
+  - localhost
+paths:
+  - path: /pokemon
+    methods: GET
+  - /graphql
+graphql:
+  operations:
+    - name: GetPokemon
+      type: query
+grpc:
+  - pokemon.v1.Pokedex/Get*
+`
+	auth, err := NewAuthorizationFromYaml([]byte(yml))
+	assert.NoError(t, err)
+	a.Add(auth)
+	auth, err = NewAuthorizationFromYaml([]byte("clientID: _default\nmode: deny\n"))
+	assert.NoError(t, err)
+	a.Add(auth)
+
+	d = a.Check(&Request{Host: "localhost", ClientID: "client", Path: "/pokemon", Method: HTTPMethodGet})
+	assert.True(t, d.Allowed)
+	assert.Equal(t, "client", d.ClientID)
+	assert.Equal(t, "paths GET /pokemon", d.Rule)
+
+	d = a.Check(&Request{Host: "localhost", ClientID: "client", Path: "/berries", Method: HTTPMethodGet})
+	assert.False(t, d.Allowed)
+	assert.Empty(t, d.Rule)
+	assert.Equal(t, ReasonPathDenied, d.Code)
+
+	d = a.Check(&Request{Host: "elsewhere", ClientID: "client", Path: "/pokemon", Method: HTTPMethodGet})
+	assert.False(t, d.Allowed)
+	assert.Equal(t, RuleHosts, d.Rule)
+	assert.Equal(t, ReasonHostMismatch, d.Code)
+
+	d = a.Check(&Request{Host: "localhost", ClientID: "client", Path: "/graphql", Method: HTTPMethodPost, Body: []byte(`{"query":"query GetPokemon { a }"}`)})
+	assert.True(t, d.Allowed)
+	assert.Equal(t, "graphql operation query ^(?:GetPokemon)$", d.Rule)
+	assert.Empty(t, d.Code)
+
+	d = a.Check(&Request{Host: "localhost", ClientID: "client", Path: "/graphql", Method: HTTPMethodPost, Body: []byte(`{"query":"mutation DeletePokemon { a }"}`)})
+	assert.False(t, d.Allowed)
+	assert.Equal(t, ReasonOperationDenied, d.Code)
+
+	d = a.Check(&Request{Host: "localhost", ClientID: "client", Path: "/pokemon.v1.Pokedex/GetPokemon", Method: HTTPMethodPost, Headers: map[string]string{"content-type": "application/grpc"}})
+	assert.True(t, d.Allowed)
+	assert.Equal(t, "grpc pokemon.v1.Pokedex/Get*", d.Rule)
+
+	// Unknown clients are evaluated against the default client policy
+	d = a.Check(&Request{Host: "localhost", ClientID: "unknown", Path: "/pokemon", Method: HTTPMethodGet})
+	assert.True(t, d.Allowed)
+	assert.Equal(t, DefaultClientID, d.ClientID)
+}
+
+func TestRules(t *testing.T) {
+	yml := `
+clientID: client
+mode: allow
+paths:
+  - path: /pokemon
+    methods: GET, POST
+  - /graphql
+graphql:
+  operations:
+    - name: GetPokemon
+      type: query
+grpc:
+  - pokemon.v1.Pokedex/Get*
+`
+	auth, err := NewAuthorizationFromYaml([]byte(yml))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"grpc pokemon.v1.Pokedex/Get*",
+		"paths ALL /graphql",
+		"paths GET /pokemon",
+		"paths POST /pokemon",
+		"graphql operation query ^(?:GetPokemon)$",
+	}, auth.Rules())
+}
+
+func TestEvaluationRequests(t *testing.T) {
+	a := NewAuthorizations()
+	auth, err := NewAuthorizationFromYaml([]byte("clientID: client\nmode: deny\nrateLimit:\n  requestsPerMinute: 1\n"))
+	assert.NoError(t, err)
+	a.Add(auth)
+
+	// Evaluations never consume the client quotas
+	for i := 0; i < 3; i++ {
+		assert.True(t, a.Check(&Request{ClientID: "client", Path: "/pokemon", Method: HTTPMethodGet, Evaluation: true}).Allowed)
+	}
+	assert.True(t, a.Check(&Request{ClientID: "client", Path: "/pokemon", Method: HTTPMethodGet}).Allowed)
+	d := a.Check(&Request{ClientID: "client", Path: "/pokemon", Method: HTTPMethodGet})
+	assert.False(t, d.Allowed)
+	assert.Equal(t, RuleRateLimit, d.Rule)
+	assert.Equal(t, ReasonRateLimited, d.Code)
+}
+
+func TestPolicyBundle(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	_, other, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	newBundle := func() *Bundle {
+		return &Bundle{
+			Version: "1.0.0",
+			Files: map[string][]byte{
+				"clients/client.yaml":   []byte("clientID: client\nmode: allow\npaths:\n  - /pokemon\n"),
+				"clients/broken.yaml":   []byte("mode: allow\n"),
+				"roles/trainer.yaml":    []byte("role: trainer\n"),
+				"tests/client_test.yml": []byte("client: client\n"),
+			},
+		}
+	}
+	write := func(b *Bundle) string {
+		file := filepath.Join(t.TempDir(), "bundle.tar.gz")
+		f, err := os.Create(file)
+		assert.NoError(t, err)
+		assert.NoError(t, b.Write(f))
+		assert.NoError(t, f.Close())
+		return file
+	}
+
+	b := newBundle()
+	b.Sign(private)
+	file := write(b)
+	a, err := LoadBundle(file, public)
+	assert.NoError(t, err)
+
+	allowed, _ := a.IsAllowed("localhost", "client", "/pokemon", HTTPMethodGet)
+	assert.True(t, allowed)
+	status := a.Status()
+	assert.Equal(t, "1.0.0", status.Version)
+	assert.Equal(t, b.Hash(), status.Hash)
+	assert.Equal(t, 1, status.Clients)
+	assert.Len(t, status.Errors, 1)
+	auth, _ := a.Client("client")
+	assert.Equal(t, file+"!/clients/client.yaml", auth.Source.File)
+
+	// Unsigned bundles are refused
+	_, err = LoadBundle(write(newBundle()), public)
+	assert.ErrorIs(t, err, ErrUnsignedBundle)
+
+	// Bundles signed with another key are refused
+	b = newBundle()
+	b.Sign(other)
+	_, err = LoadBundle(write(b), public)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+
+	// Tampered, added or removed files and versions are detected
+	for _, tamper := range []func(*Bundle){
+		func(b *Bundle) { b.Files["clients/client.yaml"] = []byte("clientID: client\nmode: deny\n") },
+		func(b *Bundle) { b.Files["clients/intruder.yaml"] = []byte("clientID: intruder\nmode: deny\n") },
+		func(b *Bundle) { delete(b.Files, "roles/trainer.yaml") },
+		func(b *Bundle) { b.Version = "2.0.0" },
+	} {
+		b = newBundle()
+		b.Sign(private)
+		tamper(b)
+		_, err = LoadBundle(write(b), public)
+		assert.ErrorIs(t, err, ErrInvalidSignature)
+	}
+}
+
+func TestForgedBundle(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	a := []byte("clientID: a\nmode: allow\npaths:\n  - /pokemon\n")
+	b := []byte("clientID: b\nmode: allow\npaths:\n  - /berries\n")
+	signed := &Bundle{Version: "1.0.0", Files: map[string][]byte{"clients/a.yaml": a, "clients/b.yaml": b}}
+	signed.Sign(private)
+
+	// A single entry whose name embeds the line of another file cannot reproduce the signed payload
+	sum := sha256.Sum256(b)
+	forged := &Bundle{
+		Version:   signed.Version,
+		Signature: signed.Signature,
+		Files:     map[string][]byte{"clients/a.yaml\n" + hex.EncodeToString(sum[:]) + "  clients/b.yaml": a},
+	}
+	assert.NotEqual(t, signed.Payload(), forged.Payload())
+	assert.ErrorIs(t, forged.Verify(public), ErrInvalidSignature)
+
+	file := filepath.Join(t.TempDir(), "bundle.tar.gz")
+	f, err := os.Create(file)
+	assert.NoError(t, err)
+	assert.NoError(t, forged.Write(f))
+	assert.NoError(t, f.Close())
+	_, err = LoadBundle(file, public)
+	assert.ErrorContains(t, err, "contains control characters")
+}
+
+func TestReadBundle(t *testing.T) {
+	archive := func(entries map[string]string) *bytes.Buffer {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for name, content := range entries {
+			assert.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+			_, err := tw.Write([]byte(content))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, tw.Close())
+		assert.NoError(t, gz.Close())
+		return &buf
+	}
+
+	b, err := ReadBundle(archive(map[string]string{"./manifest.yaml": "version: 1.0.0\n", "./clients/a.yaml": "clientID: a\n"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "1.0.0", b.Version)
+	assert.Contains(t, b.Files, "clients/a.yaml")
+
+	_, err = ReadBundle(archive(map[string]string{"clients/a.yaml": "clientID: a\n"}))
+	assert.EqualError(t, err, "policy bundle has no manifest.yaml")
+	_, err = ReadBundle(archive(map[string]string{"manifest.yaml": "signature: abc\n"}))
+	assert.EqualError(t, err, "policy bundle manifest has no version")
+	_, err = ReadBundle(archive(map[string]string{"manifest.yaml": "version: 1\n", "../etc/passwd": "root"}))
+	assert.EqualError(t, err, "policy bundle entry '../etc/passwd' is outside of the bundle")
+	for _, name := range []string{"/etc/passwd", "clients/../../etc/passwd", "clients/../a.yaml", "clients/a.yaml\nclients/b.yaml", "clients/\x7fa.yaml"} {
+		_, err = ReadBundle(archive(map[string]string{"manifest.yaml": "version: 1\n", name: "clientID: a\n"}))
+		assert.Error(t, err, "%q", name)
+	}
+	_, err = ReadBundle(archive(map[string]string{"manifest.yaml": "version: \"1\\n\"\n"}))
+	assert.Error(t, err)
+	_, err = ReadBundle(bytes.NewBufferString("not an archive"))
+	assert.Error(t, err)
+}
+
+func TestParsePublicKey(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(public)
+	assert.NoError(t, err)
+
+	key, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	assert.NoError(t, err)
+	assert.Equal(t, public, key)
+
+	_, err = ParsePublicKey([]byte("not a key"))
+	assert.Error(t, err)
+}
+
+func TestBundlePoller(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	archive := func(version string, mode string, sign bool) []byte {
+		b := &Bundle{Version: version, Files: map[string][]byte{"clients/client.yaml": []byte("clientID: client\nmode: " + mode + "\n")}}
+		if sign {
+			b.Sign(private)
+		}
+		var buf bytes.Buffer
+		assert.NoError(t, b.Write(&buf))
+		return buf.Bytes()
+	}
+
+	var mu sync.Mutex
+	content, etag, down := archive("1", "deny", true), `"v1"`, false
+	requests, notModified := 0, 0
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write(content)
+	}))
+	defer source.Close()
+	serve := func(c []byte, e string, d bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		content, etag, down = c, e, d
+	}
+	allowed := func(a *Authorizations) bool {
+		ok, _ := a.IsAllowed("localhost", "client", "/pokemon", HTTPMethodGet)
+		return ok
+	}
+
+	cache := filepath.Join(t.TempDir(), "cache", "bundle.tar.gz")
+	a := NewAuthorizations()
+	p := NewBundlePoller(source.URL, public, a)
+	p.CacheFile = cache
+
+	assert.NoError(t, p.Poll(context.Background()))
+	assert.True(t, a.Loaded())
+	assert.True(t, allowed(a))
+	assert.Equal(t, "1", a.Status().Version)
+
+	// Unchanged bundles are not downloaded again
+	assert.NoError(t, p.Poll(context.Background()))
+	assert.Equal(t, 1, notModified)
+
+	// Tampered or unsigned bundles are refused and the active bundle is kept
+	serve(archive("2", "allow", false), `"v2"`, false)
+	assert.ErrorIs(t, p.Poll(context.Background()), ErrUnsignedBundle)
+	assert.True(t, allowed(a))
+	assert.Contains(t, a.Status().LastError, "refusing to activate policy bundle version '2'")
+
+	serve(archive("3", "allow", true), `"v3"`, false)
+	assert.NoError(t, p.Poll(context.Background()))
+	assert.False(t, allowed(a))
+	assert.Equal(t, "3", a.Status().Version)
+	assert.Empty(t, a.Status().LastError)
+
+	// Cold starts use the last good bundle while the source is down
+	serve(nil, "", true)
+	cold := NewAuthorizations()
+	p = NewBundlePoller(source.URL, public, cold)
+	p.CacheFile = cache
+	p.Interval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.Start(ctx)
+	assert.True(t, cold.Loaded())
+	assert.Equal(t, "3", cold.Status().Version)
+	assert.Contains(t, cold.Status().LastError, "503")
+
+	// The cached etag is reused once the source is back
+	serve(archive("3", "allow", true), `"v3"`, false)
+	assert.NoError(t, p.Poll(context.Background()))
+	assert.Equal(t, 2, notModified)
+}
+
+func TestBundlePollerBackoff(t *testing.T) {
+	p := NewBundlePoller("http://localhost", nil, NewAuthorizations())
+	p.Interval = 10 * time.Second
+	p.InitialBackoff = time.Second
+	p.MaxBackoff = 5 * time.Second
+
+	assert.Equal(t, 10*time.Second, p.delay(0))
+	assert.Equal(t, time.Second, p.delay(1))
+	assert.Equal(t, 2*time.Second, p.delay(2))
+	assert.Equal(t, 4*time.Second, p.delay(3))
+	assert.Equal(t, 5*time.Second, p.delay(4))
+	assert.Equal(t, 5*time.Second, p.delay(40))
+}
+
+func TestRuleUsage(t *testing.T) {
+	yml := "clientID: client\nmode: allow\npaths:\n  - path: /pokemon\n    methods: GET\n  - path: /berries\n    methods: GET\n"
+	auth, err := NewAuthorizationFromYaml([]byte(yml))
+	assert.NoError(t, err)
+	a := NewAuthorizations()
+	a.EnableCache(10, time.Minute)
+	a.Add(auth)
+
+	for i := 0; i < 3; i++ {
+		a.Check(&Request{ClientID: "client", Path: "/pokemon", Method: HTTPMethodGet})
+	}
+	// Evaluations are not accounted
+	a.Check(&Request{ClientID: "client", Path: "/berries", Method: HTTPMethodGet, Evaluation: true})
+
+	usage := auth.Usage()
+	assert.Len(t, usage, 2)
+	assert.Equal(t, "paths GET /pokemon", usage[0].Rule)
+	assert.Equal(t, uint64(3), usage[0].Matches)
+	assert.WithinDuration(t, time.Now(), *usage[0].LastMatch, time.Minute)
+	assert.Equal(t, RuleUsage{Rule: "paths GET /berries"}, usage[1])
+
+	// Reloads keep the counts of the unchanged rules
+	yml = "clientID: client\nmode: allow\npaths:\n  - path: /pokemon\n    methods: GET\n  - path: /items\n    methods: GET\n"
+	reloaded, err := NewAuthorizationFromYaml([]byte(yml))
+	assert.NoError(t, err)
+	a.Replace(NewLoadedAuthorizations("test", []*Authorization{reloaded}, nil))
+	a.Check(&Request{ClientID: "client", Path: "/items", Method: HTTPMethodGet})
+	usage = reloaded.Usage()
+	assert.Equal(t, uint64(3), usage[0].Matches)
+	assert.Equal(t, "paths GET /items", usage[1].Rule)
+	assert.Equal(t, uint64(1), usage[1].Matches)
+
+	// Snapshots are restored on startup, clients loaded later get their counts once configured
+	file := filepath.Join(t.TempDir(), "usage.json")
+	assert.NoError(t, a.SaveUsage(file))
+	restored := NewAuthorizations()
+	assert.NoError(t, restored.LoadUsage(file))
+	assert.Equal(t, uint64(3), restored.Usage()["client"][0].Matches)
+	auth, err = NewAuthorizationFromYaml([]byte(yml))
+	assert.NoError(t, err)
+	restored.Replace(NewLoadedAuthorizations("test", []*Authorization{auth}, nil))
+	restored.Check(&Request{ClientID: "client", Path: "/pokemon", Method: HTTPMethodGet})
+	usage = auth.Usage()
+	assert.Equal(t, uint64(4), usage[0].Matches)
+	assert.Equal(t, uint64(1), usage[1].Matches)
+
+	ch := make(chan prometheus.Metric, 10)
+	NewUsageCollector(restored).Collect(ch)
+	close(ch)
+	assert.Len(t, ch, 4)
+	var m dto.Metric
+	assert.NoError(t, (<-ch).Write(&m))
+	assert.Equal(t, 4.0, m.GetCounter().GetValue())
+	assert.Equal(t, "paths GET /pokemon", m.GetLabel()[1].GetValue())
+}
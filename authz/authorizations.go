@@ -8,54 +8,262 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultClientID   = "_default"   // DefaultClientID identifies the policy applied to unknown clients
+	AnonymousClientID = "_anonymous" // AnonymousClientID identifies the policy applied to requests without client identity
+)
+
+// DefaultPolicy is the outcome of the requests evaluated while no client configuration is loaded
+type DefaultPolicy string
+
+const (
+	DefaultPolicyAllow  DefaultPolicy = "allow"   // DefaultPolicyAllow grants all the requests
+	DefaultPolicyDeny   DefaultPolicy = "deny"    // DefaultPolicyDeny refuses all the requests
+	DefaultPolicyDryRun DefaultPolicy = "dry-run" // DefaultPolicyDryRun grants all the requests but reports them as denied
+)
+
+// ParseDefaultPolicy translates the provided string to a DefaultPolicy
+func ParseDefaultPolicy(policy string) (DefaultPolicy, error) {
+	switch p := DefaultPolicy(strings.ToLower(strings.TrimSpace(policy))); p {
+	case DefaultPolicyAllow, DefaultPolicyDeny, DefaultPolicyDryRun:
+		return p, nil
+	default:
+		return "", fmt.Errorf("default policy should either be '%s', '%s' or '%s'", DefaultPolicyAllow, DefaultPolicyDeny, DefaultPolicyDryRun)
+	}
+}
+
+var (
+	// ErrNoConfiguration is returned when no client configuration is loaded and the default policy denies requests
+	ErrNoConfiguration = errors.New("no authz configuration loaded")
+	// ErrNotLoaded is returned while the client configurations expected from a remote source were never loaded
+	ErrNotLoaded = errors.New("client configurations are not loaded yet")
+	// ErrMissingIdentity is returned when a request has no client identity and no anonymous policy is configured
+	ErrMissingIdentity = errors.New("missing client identity and no anonymous policy configured")
 )
 
 // Authorizations is a collection of multiple client authorizations
 type Authorizations struct {
+	mu             sync.RWMutex
 	authorizations map[string]*Authorization
+	cache          *DecisionCache
+	limiter        *Limiter
+	defaultPolicy  DefaultPolicy
+	loaded         bool
+	pending        bool // pending denies all the requests until a set of client authorizations is loaded
+	status         ReloadStatus
+	restored       UsageSnapshot // restored holds the restored rules usage of the clients which are not configured yet
 }
 
 // NewAuthorizations instantiates a new Authorizations object
 func NewAuthorizations() *Authorizations {
 	return &Authorizations{
 		authorizations: make(map[string]*Authorization),
+		limiter:        NewLimiter(NewMemoryStore()),
+		defaultPolicy:  DefaultPolicyAllow,
+		status:         ReloadStatus{Errors: make([]LoadError, 0)},
+		restored:       make(UsageSnapshot),
 	}
 }
 
+// NewPendingAuthorizations instantiates an empty Authorizations object awaiting its client configurations from a remote source.
+// All the requests are denied until a set of client authorizations is loaded, the default policy only applies afterwards.
+func NewPendingAuthorizations() *Authorizations {
+	a := NewAuthorizations()
+	a.pending = true
+	return a
+}
+
 // Add appends the provided auth configuration to the collection
 func (a *Authorizations) Add(auth *Authorization) error {
 	if len(auth.ClientID) == 0 {
 		return errors.New("cannot add an empty clientID")
 	}
 	slog.Info(fmt.Sprintf("Adding configuration for clientID '%s'", auth.ClientID))
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inherit(auth, a.authorizations[auth.ClientID])
 	a.authorizations[auth.ClientID] = auth
+	a.loaded = true
+	a.status.LoadedAt = time.Now()
+	if a.cache != nil {
+		a.cache.Purge()
+	}
 	return nil
 }
 
+// Replace atomically swaps the client authorizations with the ones of the provided collection.
+// Cached decisions are invalidated before any request can be evaluated against the new authorizations.
+func (a *Authorizations) Replace(other *Authorizations) {
+	other.mu.RLock()
+	authorizations := other.authorizations
+	status := other.status
+	other.mu.RUnlock()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, auth := range authorizations {
+		a.inherit(auth, a.authorizations[id])
+	}
+	a.authorizations = authorizations
+	a.loaded = true
+	a.status = status
+	a.status.LoadedAt = time.Now()
+	a.status.LastAttempt = a.status.LoadedAt
+	a.status.LastError = ""
+	if a.cache != nil {
+		a.cache.Purge()
+	}
+}
+
+// Loaded returns true once a valid set of client authorizations has been loaded, even if it is empty
+func (a *Authorizations) Loaded() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.loaded
+}
+
+// SetRateLimitStore configures the store used to account the clients rate limits
+func (a *Authorizations) SetRateLimitStore(store RateLimitStore) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.limiter = NewLimiter(store)
+}
+
+// SetDefaultPolicy configures the outcome of the requests evaluated while no client configuration is loaded
+func (a *Authorizations) SetDefaultPolicy(policy DefaultPolicy) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.defaultPolicy = policy
+}
+
+// EnableCache caches up to size decisions for the provided ttl, a zero size or ttl disables the cache.
+// Decisions depending on the request body are never cached.
+func (a *Authorizations) EnableCache(size int, ttl time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if size <= 0 || ttl <= 0 {
+		a.cache = nil
+		return
+	}
+	a.cache = NewDecisionCache(size, ttl)
+}
+
 // IsAllowed ensures the provided clientID is configured for accessing the provided path with the given method
 func (a *Authorizations) IsAllowed(host string, clientID string, path string, method HTTPMethod) (bool, error) {
+	return a.IsRequestAllowed(&Request{Host: host, ClientID: clientID, Path: path, Method: method})
+}
+
+// IsRequestAllowed ensures the request client is configured for accessing the request path, method and body operations.
+// Requests of unknown clients are evaluated against the _default policy, requests without client identity against the _anonymous policy.
+func (a *Authorizations) IsRequestAllowed(req *Request) (bool, error) {
+	_, decision := a.evaluate(req)
+	return decision.Allowed, decision.Err()
+}
 
+// evaluate returns the decision of the policy applying to the request without accounting its rate limits.
+// The returned authorization is nil if the decision was taken by the default policy or if no policy applies.
+func (a *Authorizations) evaluate(req *Request) (*Authorization, Decision) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.pending && !a.loaded {
+		return nil, Decision{Allowed: false, Reason: ErrNotLoaded.Error(), Rule: RuleDefaultPolicy, Code: ReasonNoConfiguration, err: ErrNotLoaded}
+	}
+	// Requests without identity are only granted by an anonymous policy, the default policy never applies to them
+	if _, ok := a.authorizations[AnonymousClientID]; !ok && len(req.ClientID) == 0 {
+		return nil, Decision{Allowed: false, Reason: ErrMissingIdentity.Error(), Code: ReasonMissingIdentity, err: ErrMissingIdentity}
+	}
 	if len(a.authorizations) == 0 {
-		return true, nil // No configuration found we allow a passthrough
+		switch a.defaultPolicy {
+		case DefaultPolicyDeny:
+			return nil, Decision{Allowed: false, Reason: ErrNoConfiguration.Error(), Rule: RuleDefaultPolicy, Code: ReasonNoConfiguration, err: ErrNoConfiguration}
+		case DefaultPolicyDryRun:
+			return nil, Decision{Allowed: true, DryRun: true, Reason: fmt.Sprintf("dry-run: %s, request would be denied", ErrNoConfiguration), Rule: RuleDefaultPolicy}
+		}
+		return nil, Decision{Allowed: true, Rule: RuleDefaultPolicy} // No configuration found we allow a passthrough
 	}
 
-	reason := ""
-	allowed := true
+	auth, err := a.lookup(req.ClientID)
+	if err != nil {
+		code := ReasonUnknownClient
+		if errors.Is(err, ErrMissingIdentity) {
+			code = ReasonMissingIdentity
+		}
+		return nil, Decision{Allowed: false, Reason: err.Error(), Code: code, err: err}
+	}
 
-	auth, authFound := a.authorizations[clientID]
-	if !authFound || !auth.IsAllowed(host, path, method) {
-		allowed = false
-		if !authFound {
-			reason = fmt.Sprintf("no authz configuration defined for %s", clientID)
-		} else {
-			reason = fmt.Sprintf("%s is not authorized to access %s %s", clientID, method, path)
+	cacheable := a.cache != nil && auth.cacheable(req)
+	key := ""
+	if cacheable {
+		key = CacheKey(req)
+		if decision, ok := a.cache.Get(key); ok {
+			return auth, decision
 		}
 	}
 
-	if !allowed {
-		return false, errors.New(reason)
+	decision := Decision{Allowed: true, ClientID: auth.ClientID}
+	rule, code, err := auth.evaluate(req)
+	decision.Rule = rule
+	if err != nil {
+		decision.Allowed = false
+		decision.Reason = err.Error()
+		decision.Code = code
+		decision.err = err
 	}
-	return true, nil
+
+	if cacheable {
+		a.cache.Put(key, decision)
+	}
+	return auth, decision
+}
+
+// lookup returns the authorization applying to the provided clientID, falling back to the _default and _anonymous policies.
+// Callers must hold the read lock.
+func (a *Authorizations) lookup(clientID string) (*Authorization, error) {
+	if len(clientID) == 0 {
+		if auth, ok := a.authorizations[AnonymousClientID]; ok {
+			return auth, nil
+		}
+		return nil, ErrMissingIdentity
+	}
+
+	if auth, ok := a.authorizations[clientID]; ok {
+		return auth, nil
+	}
+	if auth, ok := a.authorizations[DefaultClientID]; ok {
+		return auth, nil
+	}
+	return nil, fmt.Errorf("no authz configuration defined for %s", clientID)
+}
+
+// Check evaluates the request authorization and consumes the client rate limit quotas when the request is granted.
+// The rule which decided the outcome is accounted in the client rules usage.
+// Evaluation requests never consume rate limit quotas nor are accounted.
+func (a *Authorizations) Check(req *Request) Decision {
+	auth, decision := a.evaluate(req)
+	if auth != nil && auth.usage != nil && !req.Evaluation && len(decision.Rule) > 0 {
+		auth.usage.record(decision.Rule, time.Now())
+	}
+	if !decision.Allowed || auth == nil || req.Evaluation {
+		return decision
+	}
+
+	a.mu.RLock()
+	limiter := a.limiter
+	a.mu.RUnlock()
+
+	decision.Quota = limiter.Allow(auth.rateLimits(req))
+	if decision.Quota != nil && decision.Quota.Exceeded {
+		decision.Allowed = false
+		decision.Reason = fmt.Sprintf("%s exceeded its rate limit of %d requests", auth.ClientID, decision.Quota.Limit)
+		decision.Rule = RuleRateLimit
+		decision.Code = ReasonRateLimited
+	}
+	return decision
 }
 
 // LoadAll loads all the client authorization yaml files from the provided directory
@@ -71,6 +279,8 @@ func LoadAll(dir string) (*Authorizations, error) {
 	}
 
 	authz := NewAuthorizations()
+	authz.status.Source = dir
+	sources := make([]*Source, 0)
 
 	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -78,18 +288,16 @@ func LoadAll(dir string) (*Authorizations, error) {
 		}
 
 		// Check if the file is a regular file and has a YAML extension
-		if !info.IsDir() && (strings.HasSuffix(info.Name(), ".yaml") || strings.HasSuffix(info.Name(), ".yml")) {
+		if !info.IsDir() && isYaml(info.Name()) {
 			content, err := os.ReadFile(path)
 			if err != nil {
-				fmt.Println("Error:", err)
-
+				slog.Error(fmt.Sprintf("unable to read '%s' see details for errors", path), slog.Any("error", err))
+				authz.status.Errors = append(authz.status.Errors, LoadError{File: path, Error: err.Error()})
+				return nil
 			}
-			conf, err := NewAuthorizationFromYaml(content)
-			if err != nil {
-				slog.Error(fmt.Sprintf("unable to load '%s' see details for errors", path), slog.Any("error", err))
+			if source := authz.loadFile(path, content); source != nil {
+				sources = append(sources, source)
 			}
-			slog.Info(fmt.Sprintf("%s - loaded authorizations from '%s'", conf.ClientID, path))
-			authz.authorizations[conf.ClientID] = conf
 		}
 
 		return nil
@@ -99,9 +307,37 @@ func LoadAll(dir string) (*Authorizations, error) {
 		slog.Error(fmt.Sprintf("an error occured while load authorization files from '%s' see details for errors", dir), slog.Any("error", err))
 	}
 
-	if len(authz.authorizations) == 0 {
-		slog.Warn(fmt.Sprintf("no configuration files could be loaded from '%s' jar will accept all requests", dir))
+	authz.seal(sources)
+	return authz, nil
+}
+
+// isYaml returns true if the provided file name has a YAML extension
+func isYaml(name string) bool {
+	return strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml")
+}
+
+// loadFile adds the client authorization described by the provided file content and returns its source.
+// Files which cannot be loaded are recorded in the load errors and a nil source is returned.
+func (a *Authorizations) loadFile(path string, content []byte) *Source {
+	conf, err := NewAuthorizationFromYaml(content)
+	if err != nil {
+		slog.Error(fmt.Sprintf("unable to load '%s' see details for errors", path), slog.Any("error", err))
+		a.status.Errors = append(a.status.Errors, LoadError{File: path, Error: err.Error()})
+		return nil
 	}
+	conf.Source = NewSource(path, content)
+	slog.Info(fmt.Sprintf("%s - loaded authorizations from '%s'", conf.ClientID, path))
+	a.authorizations[conf.ClientID] = conf
+	return conf.Source
+}
 
-	return authz, nil
+// seal marks the loaded authorizations as a complete set identified by the hash of the provided sources
+func (a *Authorizations) seal(sources []*Source) {
+	if len(a.authorizations) == 0 {
+		slog.Warn(fmt.Sprintf("no configuration files could be loaded from '%s' the default policy will apply to all requests", a.status.Source))
+	}
+	a.loaded = true
+	a.status.Hash = hashSources(sources)
+	a.status.LoadedAt = time.Now()
+	a.status.LastAttempt = a.status.LoadedAt
 }
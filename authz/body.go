@@ -0,0 +1,467 @@
+package authz
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// DefaultMaxBodySize is the maximum size of a request body jarl accepts to inspect when none is configured
+const DefaultMaxBodySize = 64 * 1024
+
+// OperationKind identifies the protocol carried by an inspected request body
+type OperationKind string
+
+const (
+	OperationGraphQL OperationKind = "graphql" // OperationGraphQL GraphQL document
+	OperationJSONRPC OperationKind = "jsonrpc" // OperationJSONRPC JSON-RPC call
+)
+
+// Operation is a single operation extracted from a request body
+type Operation struct {
+	Kind OperationKind // Kind is the protocol the operation was extracted from
+	Type string        // Type is the GraphQL operation type (query, mutation, subscription), empty for JSON-RPC
+	Name string        // Name is the GraphQL operation name or the JSON-RPC method
+}
+
+func (op Operation) String() string {
+	if len(op.Type) > 0 {
+		return fmt.Sprintf("%s %s %s", op.Kind, op.Type, op.Name)
+	}
+	return fmt.Sprintf("%s %s", op.Kind, op.Name)
+}
+
+// OperationRule matches operations extracted from request bodies
+type OperationRule struct {
+	Name *regexp.Regexp // Name must fully match the operation name
+	Type string         // Type restricts the rule to a GraphQL operation type, empty matches all types
+}
+
+func (r *OperationRule) String() string {
+	if len(r.Type) > 0 {
+		return fmt.Sprintf("%s %s", r.Type, r.Name)
+	}
+	return r.Name.String()
+}
+
+// Matches returns true if the provided operation is matched by the rule
+func (r *OperationRule) Matches(op Operation) bool {
+	if len(r.Type) > 0 && r.Type != op.Type {
+		return false
+	}
+	return r.Name.MatchString(op.Name)
+}
+
+// BodyInspection configures which requests bodies are parsed for a given protocol and the rules applied to their operations
+type BodyInspection struct {
+	Path  *regexp.Regexp   // Path selects the requests whose body will be inspected
+	Rules []*OperationRule // Rules lists the operations allowed or denied depending on the client mode
+}
+
+var (
+	// ErrBodyTruncated is returned when the body of an inspected request was only partially forwarded by Envoy
+	ErrBodyTruncated = errors.New("request body was truncated by envoy and cannot be inspected, increase with_request_body max_request_bytes")
+	// ErrBodyTooLarge is returned when the body of an inspected request exceeds the configured maximum size
+	ErrBodyTooLarge = errors.New("request body exceeds the maximum inspected size")
+	// ErrNoOperation is returned when no operation could be extracted from an inspected request body
+	ErrNoOperation = errors.New("no operation found in request body")
+)
+
+var graphQLOperationTypes = map[string]bool{"query": true, "mutation": true, "subscription": true}
+
+// configureBodyInspection parses the graphql and jsonrpc sections of a client configuration
+//
+// Expected yaml format
+//
+//	maxBodySize: 65536 # optional maximum inspected body size in bytes
+//	graphql:
+//	  path: /graphql # regex selecting the requests whose body is inspected
+//	  operations:
+//	    - GetPokemon # operation name regex, any operation type
+//	    - name: List.*
+//	      type: query
+//	jsonrpc:
+//	  path: /rpc
+//	  methods:
+//	    - pokemon\..*
+func (auth *Authorization) configureBodyInspection(yamlMap map[string]interface{}) error {
+	if size, ok := yamlMap["maxBodySize"]; ok {
+		s, ok := size.(int)
+		if !ok || s <= 0 {
+			return fmt.Errorf("maxBodySize should be a positive number of bytes for clientID '%s'", auth.ClientID)
+		}
+		auth.MaxBodySize = s
+	}
+
+	if section, ok := yamlMap["graphql"]; ok {
+		inspection, err := auth.newBodyInspection(section, "/graphql", "operations")
+		if err != nil {
+			return err
+		}
+		auth.GraphQL = inspection
+	}
+
+	if section, ok := yamlMap["jsonrpc"]; ok {
+		inspection, err := auth.newBodyInspection(section, "/rpc", "methods")
+		if err != nil {
+			return err
+		}
+		auth.JSONRPC = inspection
+	}
+	return nil
+}
+
+func (auth *Authorization) newBodyInspection(section interface{}, defaultPath string, rulesKey string) (*BodyInspection, error) {
+	construct, ok := section.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unsupported body inspection construct for clientID '%s': %v", auth.ClientID, section)
+	}
+
+	path := defaultPath
+	if p, ok := construct["path"]; ok {
+		if path, ok = p.(string); !ok {
+			return nil, invalidType("path", "a string", p)
+		}
+	}
+	rx, err := regexp.Compile(path)
+	if err != nil {
+		return nil, fmt.Errorf("body inspection path '%s' is not a valid regex for clientID '%s' : %w", path, auth.ClientID, err)
+	}
+
+	inspection := &BodyInspection{Path: rx, Rules: make([]*OperationRule, 0)}
+	rules := make([]interface{}, 0)
+	if r, ok := construct[rulesKey]; ok {
+		if rules, ok = r.([]interface{}); !ok {
+			return nil, invalidType(rulesKey, "a list", r)
+		}
+	}
+	for _, r := range rules {
+		rule := &OperationRule{}
+		name := ""
+		switch v := r.(type) {
+		case string:
+			name = v
+		case map[string]interface{}:
+			if n, ok := v["name"]; ok {
+				if name, ok = n.(string); !ok {
+					return nil, invalidType("name", "a string", n)
+				}
+			}
+			t := ""
+			if tv, ok := v["type"]; ok {
+				if t, ok = tv.(string); !ok {
+					return nil, invalidType("type", "a string", tv)
+				}
+			}
+			rule.Type = strings.ToLower(strings.TrimSpace(t))
+			if len(rule.Type) > 0 && !graphQLOperationTypes[rule.Type] {
+				auth.warn(fmt.Sprintf("operation type '%s' is not supported and will be ignored for clientID '%s'", rule.Type, auth.ClientID), nil)
+				continue
+			}
+		default:
+			auth.warn(fmt.Sprintf("unsupported operation construct detected for clientID '%s': %v", auth.ClientID, r), nil)
+			continue
+		}
+
+		if len(name) == 0 {
+			name = ".*"
+		}
+		rx, err := regexp.Compile("^(?:" + name + ")$")
+		if err != nil {
+			auth.warn(fmt.Sprintf("operation '%s' is not a valid regex and will be ignored for clientID '%s'", name, auth.ClientID), err)
+			continue
+		}
+		rule.Name = rx
+		inspection.Rules = append(inspection.Rules, rule)
+	}
+	return inspection, nil
+}
+
+// inspectBody extracts the operations carried by the request body and ensures the client is allowed to perform them.
+// Requests which do not target an inspected path are ignored. The returned rule describes the operation rule
+// which decided the outcome, empty if the request was not inspected or if no operation rule matched.
+func (auth *Authorization) inspectBody(req *Request) (string, error) {
+	type inspector struct {
+		kind       OperationKind
+		inspection *BodyInspection
+		extract    func(*Request) ([]Operation, error)
+	}
+
+	rule := ""
+	for _, i := range []inspector{{OperationGraphQL, auth.GraphQL, graphQLOperations}, {OperationJSONRPC, auth.JSONRPC, jsonRPCOperations}} {
+		if i.inspection == nil || !i.inspection.Path.MatchString(req.Path) {
+			continue
+		}
+
+		inspected := fmt.Sprintf("%s path %s", i.kind, i.inspection.Path)
+		if req.BodyTruncated {
+			return inspected, ErrBodyTruncated
+		}
+		if len(req.Body) > auth.maxBodySize() {
+			return inspected, fmt.Errorf("%w of %d bytes", ErrBodyTooLarge, auth.maxBodySize())
+		}
+
+		ops, err := i.extract(req)
+		if err != nil {
+			return inspected, err
+		}
+
+		for _, op := range ops {
+			var matched *OperationRule
+			for _, r := range i.inspection.Rules {
+				if r.Matches(op) {
+					matched = r
+					break
+				}
+			}
+			rule = ""
+			if matched != nil {
+				rule = fmt.Sprintf("%s operation %s", i.kind, matched)
+			}
+			if (matched != nil) != auth.Allow {
+				return rule, fmt.Errorf("%s is not authorized to perform %s", auth.ClientID, op)
+			}
+		}
+	}
+	return rule, nil
+}
+
+func (auth *Authorization) maxBodySize() int {
+	if auth.MaxBodySize > 0 {
+		return auth.MaxBodySize
+	}
+	return DefaultMaxBodySize
+}
+
+type graphQLRequest struct {
+	Query         string `json:"query"`
+	OperationName string `json:"operationName"`
+}
+
+// graphQLOperations extracts the GraphQL operations from a JSON encoded (possibly batched) request,
+// a raw application/graphql document or the query string of a GET request
+func graphQLOperations(req *Request) ([]Operation, error) {
+	body := bytes.TrimSpace(req.Body)
+	requests := make([]graphQLRequest, 0)
+
+	switch {
+	case len(body) == 0:
+		_, rawQuery, _ := strings.Cut(req.Path, "?")
+		values, err := url.ParseQuery(rawQuery)
+		if err != nil || len(values.Get("query")) == 0 {
+			return nil, ErrNoOperation
+		}
+		requests = append(requests, graphQLRequest{Query: values.Get("query"), OperationName: values.Get("operationName")})
+	case body[0] == '[':
+		if err := json.Unmarshal(body, &requests); err != nil {
+			return nil, fmt.Errorf("invalid graphql batch request body: %w", err)
+		}
+	case body[0] == '{':
+		var r graphQLRequest
+		if err := json.Unmarshal(body, &r); err != nil {
+			return nil, fmt.Errorf("invalid graphql request body: %w", err)
+		}
+		requests = append(requests, r)
+	default:
+		requests = append(requests, graphQLRequest{Query: string(body)})
+	}
+
+	if len(requests) == 0 {
+		return nil, ErrNoOperation
+	}
+
+	ops := make([]Operation, 0, len(requests))
+	for _, r := range requests {
+		op, err := selectGraphQLOperation(r.Query, r.OperationName)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// selectGraphQLOperation returns the operation of the document which will be executed by the GraphQL server
+func selectGraphQLOperation(document string, operationName string) (Operation, error) {
+	ops, err := parseGraphQLOperations(document)
+	if err != nil {
+		return Operation{}, err
+	}
+
+	if len(operationName) > 0 {
+		for _, op := range ops {
+			if op.Name == operationName {
+				return op, nil
+			}
+		}
+		return Operation{}, fmt.Errorf("graphql operation '%s' not found in document", operationName)
+	}
+
+	switch len(ops) {
+	case 0:
+		return Operation{}, ErrNoOperation
+	case 1:
+		return ops[0], nil
+	default:
+		return Operation{}, errors.New("graphql document contains multiple operations but no operationName was provided")
+	}
+}
+
+// parseGraphQLOperations lists the operation definitions of a GraphQL document.
+// Only the top level definitions are scanned, selection sets are skipped.
+func parseGraphQLOperations(document string) ([]Operation, error) {
+	ops := make([]Operation, 0)
+	depth := 0
+	inHeader := false // true between a definition keyword and its selection set
+
+	for i := 0; i < len(document); {
+		c := document[i]
+		switch {
+		case c == '#':
+			for i < len(document) && document[i] != '\n' {
+				i++
+			}
+		case c == '"':
+			end, err := skipGraphQLString(document, i)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+		case c == '{' || c == '(' || c == '[':
+			if c == '{' && depth == 0 {
+				if !inHeader {
+					ops = append(ops, Operation{Kind: OperationGraphQL, Type: "query"})
+				}
+				inHeader = false
+			}
+			depth++
+			i++
+		case c == '}' || c == ')' || c == ']':
+			depth--
+			if depth < 0 {
+				return nil, errors.New("malformed graphql document: unbalanced brackets")
+			}
+			i++
+		case isGraphQLNameStart(c):
+			name, end := readGraphQLName(document, i)
+			i = end
+			if depth > 0 || inHeader {
+				continue
+			}
+			switch {
+			case graphQLOperationTypes[name]:
+				op := Operation{Kind: OperationGraphQL, Type: name}
+				j := skipGraphQLIgnored(document, i)
+				if j < len(document) && isGraphQLNameStart(document[j]) {
+					op.Name, i = readGraphQLName(document, j)
+				}
+				ops = append(ops, op)
+				inHeader = true
+			case name == "fragment":
+				inHeader = true
+			default:
+				return nil, fmt.Errorf("malformed graphql document: unexpected definition '%s'", name)
+			}
+		default:
+			i++
+		}
+	}
+
+	if depth != 0 {
+		return nil, errors.New("malformed graphql document: unbalanced brackets")
+	}
+	return ops, nil
+}
+
+func isGraphQLNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func readGraphQLName(document string, start int) (string, int) {
+	end := start
+	for end < len(document) && (isGraphQLNameStart(document[end]) || (document[end] >= '0' && document[end] <= '9')) {
+		end++
+	}
+	return document[start:end], end
+}
+
+// skipGraphQLIgnored skips white spaces, commas and comments
+func skipGraphQLIgnored(document string, i int) int {
+	for i < len(document) {
+		switch document[i] {
+		case ' ', '\t', '\n', '\r', ',':
+			i++
+		case '#':
+			for i < len(document) && document[i] != '\n' {
+				i++
+			}
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// skipGraphQLString returns the index following the string or block string starting at start
+func skipGraphQLString(document string, start int) (int, error) {
+	if strings.HasPrefix(document[start:], `"""`) {
+		end := strings.Index(document[start+3:], `"""`)
+		if end < 0 {
+			return 0, errors.New("malformed graphql document: unterminated block string")
+		}
+		return start + 3 + end + 3, nil
+	}
+	for i := start + 1; i < len(document); i++ {
+		switch document[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
+		case '\n':
+			return 0, errors.New("malformed graphql document: unterminated string")
+		}
+	}
+	return 0, errors.New("malformed graphql document: unterminated string")
+}
+
+type jsonRPCRequest struct {
+	Method *string `json:"method"`
+}
+
+// jsonRPCOperations extracts the methods invoked by a JSON-RPC call or batch
+func jsonRPCOperations(req *Request) ([]Operation, error) {
+	body := bytes.TrimSpace(req.Body)
+	requests := make([]jsonRPCRequest, 0)
+
+	switch {
+	case len(body) == 0:
+		return nil, ErrNoOperation
+	case body[0] == '[':
+		if err := json.Unmarshal(body, &requests); err != nil {
+			return nil, fmt.Errorf("invalid json-rpc batch request body: %w", err)
+		}
+	default:
+		var r jsonRPCRequest
+		if err := json.Unmarshal(body, &r); err != nil {
+			return nil, fmt.Errorf("invalid json-rpc request body: %w", err)
+		}
+		requests = append(requests, r)
+	}
+
+	if len(requests) == 0 {
+		return nil, ErrNoOperation
+	}
+
+	ops := make([]Operation, 0, len(requests))
+	for _, r := range requests {
+		if r.Method == nil {
+			return nil, errors.New("invalid json-rpc request body: missing method")
+		}
+		ops = append(ops, Operation{Kind: OperationJSONRPC, Name: *r.Method})
+	}
+	return ops, nil
+}
@@ -0,0 +1,309 @@
+package authz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// BundleManifest is the name of the manifest file at the root of a policy bundle
+	BundleManifest = "manifest.yaml"
+	// MaxBundleSize is the maximum uncompressed size of a policy bundle
+	MaxBundleSize = 32 * 1024 * 1024
+
+	bundleClientsDir       = "clients/"
+	bundleSignatureContext = "jarl-bundle-v2\n"
+)
+
+var (
+	// ErrUnsignedBundle is returned when a policy bundle manifest carries no signature
+	ErrUnsignedBundle = errors.New("policy bundle is not signed")
+	// ErrInvalidSignature is returned when a policy bundle signature does not match its content
+	ErrInvalidSignature = errors.New("policy bundle signature is invalid")
+)
+
+// Bundle is a versioned and signed archive of policy files
+//
+// Expected archive layout
+// manifest.yaml # version: 1.0.0 and signature: base64 encoded Ed25519 signature
+// clients/*.yaml # client configurations
+// roles/ tests/ # any other file is covered by the signature but not loaded
+type Bundle struct {
+	Version   string            // Version is the bundle version as declared in the manifest
+	Signature []byte            // Signature is the Ed25519 signature of the bundle payload
+	Files     map[string][]byte // Files maps the archive paths to their content, the manifest excluded
+}
+
+type bundleManifest struct {
+	Version   string `yaml:"version"`
+	Signature string `yaml:"signature,omitempty"`
+}
+
+// ReadBundle reads a tar.gz policy bundle, the bundle signature is not verified
+func ReadBundle(r io.Reader) (*Bundle, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy bundle archive: %w", err)
+	}
+	defer func() { _ = gz.Close() }()
+
+	bundle := &Bundle{Files: make(map[string][]byte)}
+	var manifest []byte
+	remaining := int64(MaxBundleSize)
+
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy bundle archive: %w", err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+		default:
+			return nil, fmt.Errorf("policy bundle entry '%s' is not a regular file", header.Name)
+		}
+
+		name, err := bundleEntryName(header.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := bundle.Files[name]; ok || (name == BundleManifest && manifest != nil) {
+			return nil, fmt.Errorf("policy bundle entry '%s' is duplicated", name)
+		}
+
+		content, err := io.ReadAll(io.LimitReader(archive, remaining+1))
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy bundle archive: %w", err)
+		}
+		remaining -= int64(len(content))
+		if remaining < 0 {
+			return nil, fmt.Errorf("policy bundle exceeds %d bytes", MaxBundleSize)
+		}
+
+		if name == BundleManifest {
+			manifest = content
+			continue
+		}
+		bundle.Files[name] = content
+	}
+
+	if manifest == nil {
+		return nil, fmt.Errorf("policy bundle has no %s", BundleManifest)
+	}
+	var m bundleManifest
+	if err := yaml.Unmarshal(manifest, &m); err != nil {
+		return nil, fmt.Errorf("invalid policy bundle manifest: %w", err)
+	}
+	if len(m.Version) == 0 {
+		return nil, errors.New("policy bundle manifest has no version")
+	}
+	if hasControlCharacters(m.Version) {
+		return nil, fmt.Errorf("policy bundle version %q contains control characters", m.Version)
+	}
+	bundle.Version = m.Version
+	if len(m.Signature) > 0 {
+		if bundle.Signature, err = base64.StdEncoding.DecodeString(m.Signature); err != nil {
+			return nil, fmt.Errorf("invalid policy bundle signature encoding: %w", err)
+		}
+	}
+	return bundle, nil
+}
+
+// bundleEntryName validates an archive entry name and returns it relative to the bundle root.
+// Names containing control characters, parent directory references or absolute paths are refused.
+func bundleEntryName(entry string) (string, error) {
+	if hasControlCharacters(entry) {
+		return "", fmt.Errorf("policy bundle entry %q contains control characters", entry)
+	}
+	trimmed := strings.TrimPrefix(entry, "./")
+	if path.IsAbs(trimmed) || strings.HasPrefix(trimmed, "\\") {
+		return "", fmt.Errorf("policy bundle entry '%s' is outside of the bundle", entry)
+	}
+	for _, segment := range strings.FieldsFunc(trimmed, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return "", fmt.Errorf("policy bundle entry '%s' is outside of the bundle", entry)
+		}
+	}
+	return path.Clean(trimmed), nil
+}
+
+// hasControlCharacters returns true if the provided string contains control characters or is not valid UTF-8
+func hasControlCharacters(s string) bool {
+	if !utf8.ValidString(s) {
+		return true
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Payload returns the content covered by the bundle signature: the bundle version followed by
+// the hex encoded sha256 and the path of every file sorted by path, one file per line.
+// The version and the paths are prefixed by their length in bytes so that the payload cannot be rebuilt from other names.
+func (b *Bundle) Payload() []byte {
+	names := make([]string, 0, len(b.Files))
+	for name := range b.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.WriteString(bundleSignatureContext)
+	fmt.Fprintf(&buf, "version %d:%s\n", len(b.Version), b.Version)
+	for _, name := range names {
+		sum := sha256.Sum256(b.Files[name])
+		fmt.Fprintf(&buf, "%s %d:%s\n", hex.EncodeToString(sum[:]), len(name), name)
+	}
+	return buf.Bytes()
+}
+
+// Hash returns the hex encoded sha256 of the bundle payload
+func (b *Bundle) Hash() string {
+	sum := sha256.Sum256(b.Payload())
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign signs the bundle payload with the provided private key
+func (b *Bundle) Sign(key ed25519.PrivateKey) {
+	b.Signature = ed25519.Sign(key, b.Payload())
+}
+
+// Verify ensures the bundle content was signed by the private key matching the provided public key
+func (b *Bundle) Verify(key ed25519.PublicKey) error {
+	if len(b.Signature) == 0 {
+		return ErrUnsignedBundle
+	}
+	if !ed25519.Verify(key, b.Payload(), b.Signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Write writes the bundle as a tar.gz archive
+func (b *Bundle) Write(w io.Writer) error {
+	m := bundleManifest{Version: b.Version}
+	if len(b.Signature) > 0 {
+		m.Signature = base64.StdEncoding.EncodeToString(b.Signature)
+	}
+	manifest, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(b.Files))
+	for name := range b.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	gz := gzip.NewWriter(w)
+	archive := tar.NewWriter(gz)
+	write := func(name string, content []byte) error {
+		if err := archive.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+		_, err := archive.Write(content)
+		return err
+	}
+
+	if err := write(BundleManifest, manifest); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := write(name, b.Files[name]); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Authorizations compiles the client configurations stored in the bundle clients directory.
+// The provided source identifies the bundle location in the reload status and client sources.
+func (b *Bundle) Authorizations(source string) *Authorizations {
+	names := make([]string, 0, len(b.Files))
+	for name := range b.Files {
+		if strings.HasPrefix(name, bundleClientsDir) && isYaml(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	authz := NewAuthorizations()
+	authz.status.Source = source
+	authz.status.Version = b.Version
+	sources := make([]*Source, 0, len(names))
+	for _, name := range names {
+		if s := authz.loadFile(fmt.Sprintf("%s!/%s", source, name), b.Files[name]); s != nil {
+			sources = append(sources, s)
+		}
+	}
+	authz.seal(sources)
+	authz.status.Hash = b.Hash()
+	return authz
+}
+
+// LoadBundle reads the policy bundle stored at the provided path and compiles its client configurations.
+// Bundles which are not signed by the private key matching the provided public key are refused.
+func LoadBundle(file string, key ed25519.PublicKey) (*Authorizations, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	bundle, err := ReadBundle(f)
+	if err != nil {
+		return nil, err
+	}
+	if err := bundle.Verify(key); err != nil {
+		return nil, fmt.Errorf("refusing to load policy bundle '%s' version '%s': %w", file, bundle.Version, err)
+	}
+	return bundle.Authorizations(file), nil
+}
+
+// ParsePublicKey parses a PEM encoded PKIX Ed25519 public key
+func ParsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded public key found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is a %T, an Ed25519 key is expected", key)
+	}
+	return edKey, nil
+}
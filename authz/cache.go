@@ -0,0 +1,180 @@
+package authz
+
+import (
+	"container/list"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var cacheHitsCounter = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "jarl_decision_cache_hits_total",
+		Help: "No of decisions served from the cache",
+	},
+)
+
+var cacheMissesCounter = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "jarl_decision_cache_misses_total",
+		Help: "No of decisions not found in the cache",
+	},
+)
+
+var cacheEvictionsCounter = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "jarl_decision_cache_evictions_total",
+		Help: "No of cached decisions evicted because the cache was full",
+	},
+)
+
+// ReasonCode classifies why a request was denied
+type ReasonCode string
+
+const (
+	ReasonMissingIdentity ReasonCode = "missing_identity" // ReasonMissingIdentity the request has no client identity and no anonymous policy is configured
+	ReasonUnknownClient   ReasonCode = "unknown_client"   // ReasonUnknownClient no policy is configured for the client and no default policy applies
+	ReasonHostMismatch    ReasonCode = "host_mismatch"    // ReasonHostMismatch the request host is not one of the client hosts
+	ReasonPathDenied      ReasonCode = "path_denied"      // ReasonPathDenied the client is not allowed to access the path or gRPC method
+	ReasonOperationDenied ReasonCode = "operation_denied" // ReasonOperationDenied the request body could not be inspected or carries a denied operation
+	ReasonRateLimited     ReasonCode = "rate_limited"     // ReasonRateLimited the client exceeded its rate limit
+	ReasonNoConfiguration ReasonCode = "no_configuration" // ReasonNoConfiguration no client configuration is loaded and the default policy denies requests
+)
+
+// Decision is the outcome of an authorization check
+type Decision struct {
+	Allowed  bool       // Allowed is true if the request was granted
+	Reason   string     // Reason details why the request was denied
+	Quota    *Quota     // Quota is the most restrictive rate limit quota applied to the request, nil if the request is not rate limited
+	DryRun   bool       // DryRun is true if the request was allowed by a dry-run policy but would have been denied otherwise
+	ClientID string     // ClientID identifies the client policy which was applied, _default or _anonymous for fallback policies, empty if none applied
+	Rule     string     // Rule describes the rule which decided the outcome, empty if no rule matched
+	Code     ReasonCode // Code classifies the deny reason, empty if the request was granted
+	err      error
+}
+
+// Err returns the deny reason as an error, nil if the request was granted
+func (d Decision) Err() error {
+	if d.Allowed {
+		return nil
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return errors.New(d.Reason)
+}
+
+type cacheEntry struct {
+	key      string
+	decision Decision
+	expires  time.Time
+}
+
+// DecisionCache is a bounded LRU cache of authorization decisions whose entries expire after a TTL
+type DecisionCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+	now     func() time.Time
+}
+
+// NewDecisionCache creates a new cache holding at most size decisions for the provided ttl
+func NewDecisionCache(size int, ttl time.Duration) *DecisionCache {
+	return &DecisionCache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+// CacheKey returns the identity, host, method and path tuple identifying a request decision.
+// Hosts are kept as is since they are matched case sensitively, requests differing by case may be decided differently.
+func CacheKey(req *Request) string {
+	grpc := "http"
+	if req.IsGRPC() {
+		grpc = "grpc"
+	}
+	return strings.Join([]string{req.ClientID, req.Host, string(req.Method), req.Path, grpc}, "\x00")
+}
+
+// Get returns the decision cached for the provided key
+func (c *DecisionCache) Get(key string) (Decision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elt, ok := c.entries[key]
+	if !ok {
+		cacheMissesCounter.Inc()
+		return Decision{}, false
+	}
+
+	entry := elt.Value.(*cacheEntry)
+	if c.now().After(entry.expires) {
+		c.lru.Remove(elt)
+		delete(c.entries, key)
+		cacheMissesCounter.Inc()
+		return Decision{}, false
+	}
+
+	c.lru.MoveToFront(elt)
+	cacheHitsCounter.Inc()
+	return entry.decision, true
+}
+
+// Put caches the provided decision, evicting the least recently used decision if the cache is full
+func (c *DecisionCache) Put(key string, decision Decision) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elt, ok := c.entries[key]; ok {
+		entry := elt.Value.(*cacheEntry)
+		entry.decision = decision
+		entry.expires = c.now().Add(c.ttl)
+		c.lru.MoveToFront(elt)
+		return
+	}
+
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		if oldest != nil {
+			c.lru.Remove(oldest)
+			delete(c.entries, oldest.Value.(*cacheEntry).key)
+			cacheEvictionsCounter.Inc()
+		}
+	}
+
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, decision: decision, expires: c.now().Add(c.ttl)})
+}
+
+// Purge removes all the cached decisions
+func (c *DecisionCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Len returns the number of cached decisions
+func (c *DecisionCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// cacheable returns true if the decision for the provided request only depends on its cache key
+func (auth *Authorization) cacheable(req *Request) bool {
+	for _, inspection := range []*BodyInspection{auth.GraphQL, auth.JSONRPC} {
+		if inspection != nil && inspection.Path.MatchString(req.Path) {
+			return false
+		}
+	}
+	return true
+}
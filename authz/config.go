@@ -0,0 +1,43 @@
+package authz
+
+import (
+	"bytes"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// ModeAllow is the mode of the client configurations allowing only the listed paths
+	ModeAllow = modeAllow
+	// ModeDeny is the mode of the client configurations denying only the listed paths
+	ModeDeny = modeDeny
+)
+
+// ClientConfig is the yaml representation of a client configuration as parsed by NewAuthorizationFromYaml,
+// it is used by the tools generating client configurations.
+type ClientConfig struct {
+	ClientID string       `yaml:"clientID"`
+	Hosts    []string     `yaml:"hosts,omitempty"`
+	Mode     string       `yaml:"mode"`
+	Paths    []PathConfig `yaml:"paths,omitempty"`
+}
+
+// PathConfig is the yaml representation of a client path
+type PathConfig struct {
+	Path    string `yaml:"path"`
+	Methods string `yaml:"methods,omitempty"` // Methods is a comma separated list of HTTP methods, all methods if empty
+}
+
+// Marshal returns the yaml client configuration
+func (c *ClientConfig) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
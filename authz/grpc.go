@@ -0,0 +1,165 @@
+package authz
+
+import (
+	"fmt"
+	"mime"
+	"regexp"
+	"strings"
+)
+
+// GRPCContentType is the content type of the gRPC calls, optionally followed by a +codec suffix
+const GRPCContentType = "application/grpc"
+
+// GRPCRule matches the fully-qualified gRPC services and methods invoked by a client
+type GRPCRule struct {
+	Service *regexp.Regexp // Service matches the fully-qualified service name (package.Service)
+	Method  *regexp.Regexp // Method matches the method name
+	pattern string
+}
+
+func (r *GRPCRule) String() string {
+	if len(r.pattern) > 0 {
+		return r.pattern
+	}
+	return fmt.Sprintf("%s/%s", r.Service, r.Method)
+}
+
+// Matches returns true if the provided service and method are matched by the rule
+func (r *GRPCRule) Matches(service string, method string) bool {
+	return r.Service.MatchString(service) && r.Method.MatchString(method)
+}
+
+// NewGRPCRule creates a rule from wildcard patterns, '*' matches any sequence of characters
+func NewGRPCRule(service string, method string) (*GRPCRule, error) {
+	service = strings.TrimSpace(service)
+	method = strings.TrimSpace(method)
+	if len(service) == 0 {
+		return nil, fmt.Errorf("grpc service cannot be empty")
+	}
+	if len(method) == 0 {
+		method = "*"
+	}
+	if strings.Contains(method, "/") {
+		return nil, fmt.Errorf("grpc method '%s' cannot contain '/'", method)
+	}
+	return &GRPCRule{Service: wildcard(service), Method: wildcard(method), pattern: service + "/" + method}, nil
+}
+
+// wildcard compiles a pattern where '*' matches any sequence of characters into a full-match regex
+func wildcard(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+}
+
+// ConfigureGRPC configures the provided gRPC service and comma separated methods.
+// A service given as package.Service/Method configures the single method.
+func (auth *Authorization) ConfigureGRPC(service string, methods string) error {
+	if s, m, found := strings.Cut(service, "/"); found {
+		if len(methods) > 0 {
+			return fmt.Errorf("grpc rule '%s' cannot define both a method and a methods list for clientID '%s'", service, auth.ClientID)
+		}
+		service, methods = s, m
+	}
+
+	if len(methods) == 0 {
+		methods = "*"
+	}
+
+	for _, m := range strings.Split(methods, ",") {
+		rule, err := NewGRPCRule(service, m)
+		if err != nil {
+			return fmt.Errorf("grpc rule '%s/%s' is invalid and will be ignored for clientID '%s' : %w", service, m, auth.ClientID, err)
+		}
+		auth.GRPC = append(auth.GRPC, rule)
+	}
+	return nil
+}
+
+// configureGRPCRules parses the grpc section of a client configuration
+//
+// Expected yaml format
+//
+//	grpc:
+//	  - pokemon.v1.PokemonService/GetPokemon # single method
+//	  - pokemon.v1.BerryService # all the methods of a service
+//	  - service: pokemon.v1.*
+//	    methods: List*, Get*
+func (auth *Authorization) configureGRPCRules(yamlMap map[string]interface{}) error {
+	g, ok := yamlMap["grpc"]
+	if !ok {
+		return nil
+	}
+	rules, ok := g.([]interface{})
+	if !ok {
+		return invalidType("grpc", "a list", g)
+	}
+
+	for _, r := range rules {
+		service, methods := "", ""
+		switch v := r.(type) {
+		case string:
+			service = v
+		case map[string]interface{}:
+			if s, ok := v["service"]; ok {
+				if service, ok = s.(string); !ok {
+					return invalidType("service", "a string", s)
+				}
+			}
+			if m, ok := v["methods"]; ok {
+				if methods, ok = m.(string); !ok {
+					return invalidType("methods", "a string", m)
+				}
+			}
+		default:
+			auth.warn(fmt.Sprintf("unsupported grpc construct detected for clientID '%s': %v", auth.ClientID, r), nil)
+			continue
+		}
+
+		if err := auth.ConfigureGRPC(service, methods); err != nil {
+			auth.warn("incompatible grpc rule detected", err)
+		}
+	}
+	return nil
+}
+
+// IsGRPCAllowed returns true if the provided gRPC method invocation should be granted
+func (auth *Authorization) IsGRPCAllowed(host string, service string, method string) bool {
+	allowed, _ := auth.matchGRPC(host, service, method)
+	return allowed
+}
+
+// matchGRPC returns true if the provided gRPC method invocation should be granted and the rule which decided the outcome, empty if no rule matched
+func (auth *Authorization) matchGRPC(host string, service string, method string) (bool, string) {
+	if !auth.hostAllowed(host) {
+		return false, RuleHosts
+	}
+
+	for _, r := range auth.GRPC {
+		if r.Matches(service, method) {
+			return auth.Allow, fmt.Sprintf("grpc %s", r)
+		}
+	}
+	return !auth.Allow, ""
+}
+
+// IsGRPC returns true if the request is a gRPC call, gRPC-Web calls are handled as regular HTTP requests
+func (req *Request) IsGRPC() bool {
+	mediaType, _, err := mime.ParseMediaType(req.Headers["content-type"])
+	if err != nil {
+		return false
+	}
+	return mediaType == GRPCContentType || strings.HasPrefix(mediaType, GRPCContentType+"+")
+}
+
+// GRPCMethod returns the fully-qualified service and the method invoked by a gRPC request.
+// ok is false if the request is not a gRPC call or if its path is not a valid gRPC path.
+func (req *Request) GRPCMethod() (service string, method string, ok bool) {
+	if !req.IsGRPC() || !strings.HasPrefix(req.Path, "/") {
+		return "", "", false
+	}
+
+	service, method, ok = strings.Cut(req.Path[1:], "/")
+	if !ok || len(service) == 0 || len(method) == 0 || strings.ContainsAny(method, "/?") {
+		return "", "", false
+	}
+	return service, method, true
+}
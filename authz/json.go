@@ -0,0 +1,96 @@
+package authz
+
+import (
+	"encoding/json"
+	"regexp"
+)
+
+// authorizationJSON is the JSON representation of a compiled client authorization
+type authorizationJSON struct {
+	ClientID       string                  `json:"clientID"`
+	Mode           string                  `json:"mode"`
+	Hosts          []string                `json:"hosts"`
+	Paths          map[HTTPMethod][]string `json:"paths"`
+	MaxBodySize    int                     `json:"maxBodySize"`
+	GraphQL        *bodyInspectionJSON     `json:"graphql,omitempty"`
+	JSONRPC        *bodyInspectionJSON     `json:"jsonrpc,omitempty"`
+	GRPC           []grpcRuleJSON          `json:"grpc"`
+	RateLimit      *RateLimit              `json:"rateLimit,omitempty"`
+	PathRateLimits []rateLimitRuleJSON     `json:"pathRateLimits"`
+	Source         *Source                 `json:"source,omitempty"`
+	Warnings       []string                `json:"warnings"`
+}
+
+type bodyInspectionJSON struct {
+	Path  string              `json:"path"`
+	Rules []operationRuleJSON `json:"rules"`
+}
+
+type operationRuleJSON struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+type grpcRuleJSON struct {
+	Service string `json:"service"`
+	Method  string `json:"method"`
+}
+
+type rateLimitRuleJSON struct {
+	Path    string       `json:"path"`
+	Methods []HTTPMethod `json:"methods"`
+	Limit   *RateLimit   `json:"limit"`
+}
+
+// MarshalJSON renders the effective authorization, regular expressions are rendered as compiled
+func (auth *Authorization) MarshalJSON() ([]byte, error) {
+	mode := modeDeny
+	if auth.Allow {
+		mode = modeAllow
+	}
+
+	v := authorizationJSON{
+		ClientID:       auth.ClientID,
+		Mode:           mode,
+		Hosts:          append(make([]string, 0, len(auth.Hosts)), auth.Hosts...),
+		Paths:          make(map[HTTPMethod][]string),
+		MaxBodySize:    auth.maxBodySize(),
+		GraphQL:        newBodyInspectionJSON(auth.GraphQL),
+		JSONRPC:        newBodyInspectionJSON(auth.JSONRPC),
+		GRPC:           make([]grpcRuleJSON, 0, len(auth.GRPC)),
+		RateLimit:      auth.RateLimit,
+		PathRateLimits: make([]rateLimitRuleJSON, 0, len(auth.PathRateLimits)),
+		Source:         auth.Source,
+		Warnings:       append(make([]string, 0, len(auth.Warnings)), auth.Warnings...),
+	}
+	for method, endpoints := range auth.Endpoints {
+		v.Paths[method] = patterns(endpoints)
+	}
+	for _, r := range auth.GRPC {
+		v.GRPC = append(v.GRPC, grpcRuleJSON{Service: r.Service.String(), Method: r.Method.String()})
+	}
+	for _, r := range auth.PathRateLimits {
+		v.PathRateLimits = append(v.PathRateLimits, rateLimitRuleJSON{Path: r.Path.String(), Methods: r.Methods, Limit: r.Limit})
+	}
+	return json.Marshal(v)
+}
+
+func newBodyInspectionJSON(inspection *BodyInspection) *bodyInspectionJSON {
+	if inspection == nil {
+		return nil
+	}
+	v := &bodyInspectionJSON{Path: inspection.Path.String(), Rules: make([]operationRuleJSON, 0, len(inspection.Rules))}
+	for _, r := range inspection.Rules {
+		v.Rules = append(v.Rules, operationRuleJSON{Name: r.Name.String(), Type: r.Type})
+	}
+	return v
+}
+
+// patterns returns the source text of the provided regular expressions
+func patterns(rxs []*regexp.Regexp) []string {
+	p := make([]string, 0, len(rxs))
+	for _, rx := range rxs {
+		p = append(p, rx.String())
+	}
+	return p
+}
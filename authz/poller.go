@@ -0,0 +1,249 @@
+package authz
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPollInterval is the interval at which policy bundles are polled when none is configured
+	DefaultPollInterval = 30 * time.Second
+	// DefaultMaxBackoff is the maximum delay between two attempts while the policy bundle source is failing
+	DefaultMaxBackoff = 5 * time.Minute
+
+	initialBackoff = time.Second
+	etagSuffix     = ".etag"
+)
+
+// IsBundleURL returns true if the provided bundle location is an HTTP(S) URL
+func IsBundleURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// BundlePoller periodically fetches a signed policy bundle from an HTTP(S) URL and activates it into the target authorizations.
+// The last good bundle is kept on disk so that the authorizations can be restored on cold starts while the source is down.
+type BundlePoller struct {
+	URL            string            // URL is the location of the policy bundle
+	Key            ed25519.PublicKey // Key verifies the bundle signatures
+	CacheFile      string            // CacheFile stores the last good bundle, disabled if empty
+	Interval       time.Duration     // Interval is the delay between two polls, DefaultPollInterval if unset
+	InitialBackoff time.Duration     // InitialBackoff is the delay before retrying a failed poll, doubled after every failure
+	MaxBackoff     time.Duration     // MaxBackoff caps the delay between two failed polls, DefaultMaxBackoff if unset
+	Client         *http.Client      // Client performs the requests, http.DefaultClient if nil
+
+	target *Authorizations
+	mu     sync.Mutex // mu serializes the polls
+	etag   string
+}
+
+// NewBundlePoller creates a poller activating the bundle fetched from url into target
+func NewBundlePoller(url string, key ed25519.PublicKey, target *Authorizations) *BundlePoller {
+	return &BundlePoller{
+		URL:            url,
+		Key:            key,
+		Interval:       DefaultPollInterval,
+		InitialBackoff: initialBackoff,
+		MaxBackoff:     DefaultMaxBackoff,
+		Client:         &http.Client{Timeout: 30 * time.Second},
+		target:         target,
+	}
+}
+
+// Poll fetches the bundle and activates it if it changed since the last poll.
+// Failed polls are recorded in the target reload status and the active authorizations are left untouched.
+func (p *BundlePoller) Poll(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.poll(ctx)
+	if err != nil {
+		slog.Error(fmt.Sprintf("unable to fetch policy bundle from '%s', keeping the active client configurations", p.URL), slog.Any("error", err))
+		p.target.ReloadFailed(err)
+	}
+	return err
+}
+
+func (p *BundlePoller) poll(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return err
+	}
+	if len(p.etag) > 0 && p.target.Loaded() {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		p.target.touch()
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("unexpected policy bundle response status '%s'", resp.Status)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, MaxBundleSize+1))
+	if err != nil {
+		return err
+	}
+	if len(content) > MaxBundleSize {
+		return fmt.Errorf("policy bundle exceeds %d bytes", MaxBundleSize)
+	}
+
+	auths, err := p.activate(content)
+	if err != nil {
+		return err
+	}
+	p.etag = resp.Header.Get("ETag")
+	p.store(content)
+	slog.Info(fmt.Sprintf("activated policy bundle version '%s' from '%s'", auths.Status().Version, p.URL))
+	return nil
+}
+
+// activate verifies the provided bundle and swaps it with the active authorizations
+func (p *BundlePoller) activate(content []byte) (*Authorizations, error) {
+	bundle, err := ReadBundle(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if err := bundle.Verify(p.Key); err != nil {
+		return nil, fmt.Errorf("refusing to activate policy bundle version '%s': %w", bundle.Version, err)
+	}
+	auths := bundle.Authorizations(p.URL)
+	p.target.Replace(auths)
+	return auths, nil
+}
+
+// store writes the last good bundle and its ETag to the cache file, replacing the previous ones atomically
+func (p *BundlePoller) store(content []byte) {
+	if len(p.CacheFile) == 0 {
+		return
+	}
+	if err := writeFileAtomic(p.CacheFile, content); err != nil {
+		slog.Warn(fmt.Sprintf("unable to store the last good policy bundle to '%s'", p.CacheFile), slog.Any("error", err))
+		return
+	}
+	if err := writeFileAtomic(p.CacheFile+etagSuffix, []byte(p.etag)); err != nil {
+		slog.Warn(fmt.Sprintf("unable to store the last good policy bundle etag to '%s'", p.CacheFile+etagSuffix), slog.Any("error", err))
+	}
+}
+
+// LoadCached activates the last good bundle stored in the cache file, its signature is verified again
+func (p *BundlePoller) LoadCached() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.CacheFile) == 0 {
+		return errors.New("no policy bundle cache file configured")
+	}
+	content, err := os.ReadFile(p.CacheFile)
+	if err != nil {
+		return err
+	}
+	auths, err := p.activate(content)
+	if err != nil {
+		return err
+	}
+	if etag, err := os.ReadFile(p.CacheFile + etagSuffix); err == nil {
+		p.etag = string(etag)
+	}
+	slog.Info(fmt.Sprintf("activated last good policy bundle version '%s' from '%s'", auths.Status().Version, p.CacheFile))
+	return nil
+}
+
+// Start performs a first poll, falling back to the last good bundle if the source is down, and keeps polling until ctx is done
+func (p *BundlePoller) Start(ctx context.Context) {
+	if err := p.Poll(ctx); err != nil {
+		if cerr := p.LoadCached(); cerr != nil {
+			slog.Error("unable to activate the last good policy bundle", slog.Any("error", cerr))
+		} else {
+			p.target.ReloadFailed(err)
+		}
+	}
+	go p.Run(ctx)
+}
+
+// Run polls the bundle at the configured interval until ctx is done, backing off exponentially while polls fail
+func (p *BundlePoller) Run(ctx context.Context) {
+	failures := 0
+	for {
+		timer := time.NewTimer(p.delay(failures))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := p.Poll(ctx); err != nil {
+			failures++
+			continue
+		}
+		failures = 0
+	}
+}
+
+// delay returns the delay before the next poll after the provided number of consecutive failures
+func (p *BundlePoller) delay(failures int) time.Duration {
+	interval := p.Interval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	if failures == 0 {
+		return interval
+	}
+
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultMaxBackoff
+	}
+	backoff := p.InitialBackoff
+	if backoff <= 0 {
+		backoff = initialBackoff
+	}
+	for i := 1; i < failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxBackoff)
+}
+
+// writeFileAtomic writes the content to a temporary file renamed to the provided path
+func writeFileAtomic(file string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -0,0 +1,353 @@
+package authz
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit is a token bucket rate limit configuration
+type RateLimit struct {
+	Rate  float64 `json:"requestsPerSecond"` // Rate is the number of requests per second refilled in the bucket
+	Burst int     `json:"burst"`             // Burst is the bucket capacity
+}
+
+// RateLimitRule applies a rate limit to the requests matching a path and methods
+type RateLimitRule struct {
+	Path    *regexp.Regexp
+	Methods []HTTPMethod // Methods restricts the rule to the provided methods, all the methods are matched if empty
+	Limit   *RateLimit
+}
+
+// Matches returns true if the rule applies to the provided path and method
+func (r *RateLimitRule) Matches(path string, method HTTPMethod) bool {
+	if !r.Path.MatchString(path) {
+		return false
+	}
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, m := range r.Methods {
+		if m == method || m == HTTPMethodAll {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	storeProbeBackoff    = time.Second      // storeProbeBackoff is the initial delay after which an unreachable rate limit store is probed
+	storeMaxProbeBackoff = 30 * time.Second // storeMaxProbeBackoff is the maximum delay between two probes of an unreachable rate limit store
+	bucketSweepInterval  = time.Minute      // bucketSweepInterval is the interval at which the refilled in-process buckets are evicted
+)
+
+// Quota is the state of a rate limit after a request was accounted
+type Quota struct {
+	Limit      int           // Limit is the maximum number of requests which can be performed in a burst
+	Remaining  int           // Remaining is the number of requests which can still be performed
+	Reset      time.Duration // Reset is the duration after which the quota is fully replenished
+	RetryAfter time.Duration // RetryAfter is the duration after which a request will be accepted again, only set when Exceeded
+	Exceeded   bool          // Exceeded is true if the request was rejected
+}
+
+// newRateLimit parses a rate limit construct
+//
+// Expected yaml format
+//
+//	rateLimit:
+//	  requestsPerSecond: 10 # or requestsPerMinute
+//	  burst: 20 # optional, defaults to the number of requests per second/minute
+func newRateLimit(construct interface{}) (*RateLimit, error) {
+	values, ok := construct.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unsupported rate limit construct: %v", construct)
+	}
+
+	perSecond, hasSecond := values["requestsPerSecond"]
+	perMinute, hasMinute := values["requestsPerMinute"]
+	if hasSecond == hasMinute {
+		return nil, fmt.Errorf("rate limit should define either requestsPerSecond or requestsPerMinute")
+	}
+
+	count, interval := perSecond, time.Second
+	if hasMinute {
+		count, interval = perMinute, time.Minute
+	}
+	requests, ok := count.(int)
+	if !ok || requests <= 0 {
+		return nil, fmt.Errorf("rate limit requests should be a positive number: %v", count)
+	}
+
+	limit := &RateLimit{Rate: float64(requests) / interval.Seconds(), Burst: requests}
+	if b, ok := values["burst"]; ok {
+		burst, ok := b.(int)
+		if !ok || burst <= 0 {
+			return nil, fmt.Errorf("rate limit burst should be a positive number: %v", b)
+		}
+		limit.Burst = burst
+	}
+	return limit, nil
+}
+
+// configureRateLimit parses the client wide rate limit of a client configuration
+func (auth *Authorization) configureRateLimit(yamlMap map[string]interface{}) error {
+	construct, ok := yamlMap["rateLimit"]
+	if !ok {
+		return nil
+	}
+	limit, err := newRateLimit(construct)
+	if err != nil {
+		return fmt.Errorf("invalid rate limit for clientID '%s' : %w", auth.ClientID, err)
+	}
+	auth.RateLimit = limit
+	return nil
+}
+
+// ConfigurePathRateLimit applies the provided rate limit construct to the given path and comma separated methods
+func (auth *Authorization) ConfigurePathRateLimit(path string, methods string, construct interface{}) error {
+	limit, err := newRateLimit(construct)
+	if err != nil {
+		return fmt.Errorf("invalid rate limit for path '%s' and clientID '%s' : %w", path, auth.ClientID, err)
+	}
+
+	rx, err := regexp.Compile(path)
+	if err != nil {
+		return fmt.Errorf("path '%s' is not a valid regex and will be ignored for clientID '%s' : %w", path, auth.ClientID, err)
+	}
+
+	rule := &RateLimitRule{Path: rx, Methods: make([]HTTPMethod, 0), Limit: limit}
+	for _, m := range strings.Split(methods, ",") {
+		if method := ParseHTTPMethod(m); method != HTTPMethodUnknown {
+			rule.Methods = append(rule.Methods, method)
+		}
+	}
+	auth.PathRateLimits = append(auth.PathRateLimits, rule)
+	return nil
+}
+
+// rateLimits returns the rate limits applying to the request indexed by a key unique for the client.
+// Path rules are keyed by their index so that identical rules do not share their quota.
+// Unknown clients falling back to the _default policy each get their own quotas.
+func (auth *Authorization) rateLimits(req *Request) map[string]*RateLimit {
+	identity := auth.ClientID
+	if auth.ClientID == DefaultClientID {
+		identity = fmt.Sprintf("%s|%s", DefaultClientID, req.ClientID)
+	}
+
+	limits := make(map[string]*RateLimit)
+	if auth.RateLimit != nil {
+		limits[fmt.Sprintf("client|%s", identity)] = auth.RateLimit
+	}
+	for i, r := range auth.PathRateLimits {
+		if r.Matches(req.Path, req.Method) {
+			limits[fmt.Sprintf("path|%d|%s", i, identity)] = r.Limit
+		}
+	}
+	return limits
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // full is the time at which the bucket is refilled, it is then equivalent to a new bucket
+}
+
+// refilled updates the time at which the bucket is refilled
+func (b *tokenBucket) refilled(limit *RateLimit) {
+	b.full = b.last.Add(time.Duration((float64(limit.Burst) - b.tokens) / limit.Rate * float64(time.Second)))
+}
+
+// take refills the bucket for the elapsed time and consumes a token if available
+func (b *tokenBucket) take(now time.Time, limit *RateLimit) *Quota {
+	burst := float64(limit.Burst)
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	quota := &Quota{Limit: limit.Burst}
+	if b.tokens < 1 {
+		quota.Exceeded = true
+		quota.RetryAfter = time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+	} else {
+		b.tokens--
+	}
+	quota.Remaining = int(b.tokens)
+	quota.Reset = time.Duration((burst - b.tokens) / limit.Rate * float64(time.Second))
+	b.refilled(limit)
+	return quota
+}
+
+// refund gives back a token previously consumed from the bucket
+func (b *tokenBucket) refund(limit *RateLimit) {
+	b.tokens = math.Min(float64(limit.Burst), b.tokens+1)
+	b.refilled(limit)
+}
+
+// RateLimitStore accounts the requests performed against the rate limits
+type RateLimitStore interface {
+	// Take consumes a request from the quota identified by key
+	Take(key string, limit *RateLimit) (*Quota, error)
+	// Refund gives back a request previously consumed from the quota identified by key
+	Refund(key string, limit *RateLimit) error
+	// Ping returns an error if the store is unreachable
+	Ping() error
+}
+
+// MemoryStore is a RateLimitStore enforcing rate limits using in-process token buckets.
+// Buckets are periodically evicted once refilled, the number of tracked keys is bounded by the recently active ones.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+	sweepAt time.Time
+}
+
+// NewMemoryStore creates a new in-process rate limit store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// Take consumes a token from the bucket identified by key
+func (m *MemoryStore) Take(key string, limit *RateLimit) (*Quota, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if now.After(m.sweepAt) {
+		m.sweep(now)
+		m.sweepAt = now.Add(bucketSweepInterval)
+	}
+
+	bucket, ok := m.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		m.buckets[key] = bucket
+	}
+	return bucket.take(now, limit), nil
+}
+
+// sweep evicts the refilled buckets, callers must hold the lock
+func (m *MemoryStore) sweep(now time.Time) {
+	for key, bucket := range m.buckets {
+		if !now.Before(bucket.full) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// Refund gives back a token to the bucket identified by key
+func (m *MemoryStore) Refund(key string, limit *RateLimit) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if bucket, ok := m.buckets[key]; ok {
+		bucket.refund(limit)
+	}
+	return nil
+}
+
+// Ping always succeeds, in-process buckets are always reachable
+func (m *MemoryStore) Ping() error {
+	return nil
+}
+
+// Limiter enforces rate limits using a RateLimitStore, falling back to in-process token buckets
+// when the store is unreachable. Once the store failed it is no longer used until a background probe succeeds.
+type Limiter struct {
+	store      RateLimitStore
+	fallback   *MemoryStore
+	degraded   atomic.Bool
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// NewLimiter creates a new limiter backed by the provided store
+func NewLimiter(store RateLimitStore) *Limiter {
+	return &Limiter{
+		store:      store,
+		fallback:   NewMemoryStore(),
+		backoff:    storeProbeBackoff,
+		maxBackoff: storeMaxProbeBackoff,
+	}
+}
+
+// Take consumes a request from the quota identified by key
+func (l *Limiter) Take(key string, limit *RateLimit) *Quota {
+	quota, _ := l.take(key, limit)
+	return quota
+}
+
+// take consumes a request from the quota identified by key and returns the store which accounted it
+func (l *Limiter) take(key string, limit *RateLimit) (*Quota, RateLimitStore) {
+	if !l.degraded.Load() {
+		quota, err := l.store.Take(key, limit)
+		if err == nil {
+			return quota, l.store
+		}
+		if l.degraded.CompareAndSwap(false, true) {
+			slog.Warn("rate limit store is unreachable, falling back to per replica quotas", slog.Any("error", err))
+			go l.probe()
+		}
+	}
+
+	quota, _ := l.fallback.Take(key, limit)
+	return quota, l.fallback
+}
+
+// probe pings the unreachable store with an exponential backoff until it recovers
+func (l *Limiter) probe() {
+	backoff := l.backoff
+	for {
+		time.Sleep(backoff)
+		err := l.store.Ping()
+		if err == nil {
+			l.degraded.Store(false)
+			slog.Info("rate limit store is reachable again, quotas are enforced across replicas")
+			return
+		}
+		backoff = min(2*backoff, l.maxBackoff)
+		slog.Debug("rate limit store is still unreachable", slog.Any("error", err), slog.Duration("retry", backoff))
+	}
+}
+
+// Allow consumes a request from all the provided rate limits and returns the most restrictive quota, nil if no limit applies.
+// Limits are taken in a stable order, when one is exceeded the requests already consumed from the other ones are refunded.
+func (l *Limiter) Allow(limits map[string]*RateLimit) *Quota {
+	keys := make([]string, 0, len(limits))
+	for key := range limits {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	type taken struct {
+		key   string
+		store RateLimitStore
+	}
+	consumed := make([]taken, 0, len(keys))
+
+	var quota *Quota
+	for _, key := range keys {
+		q, store := l.take(key, limits[key])
+		if q.Exceeded {
+			for _, t := range consumed {
+				if err := t.store.Refund(t.key, limits[t.key]); err != nil {
+					slog.Warn("unable to refund rate limit quota", slog.String("key", t.key), slog.Any("error", err))
+				}
+			}
+			return q
+		}
+		consumed = append(consumed, taken{key: key, store: store})
+		if quota == nil || q.Remaining < quota.Remaining {
+			quota = q
+		}
+	}
+	return quota
+}
@@ -0,0 +1,269 @@
+package authz
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisKeyPrefix = "jarl:ratelimit:"
+	redisPoolSize  = 16
+)
+
+// RedisStore is a RateLimitStore sharing the quotas across replicas through a server speaking the Redis protocol.
+// Requests are accounted in fixed windows lasting the time needed to refill a full burst.
+type RedisStore struct {
+	address  string
+	password string
+	db       int
+	timeout  time.Duration
+	pool     chan *redisConn
+	now      func() time.Time
+}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewRedisStore creates a store connecting to the provided address, either host:port or redis://[:password@]host:port[/db].
+// Every command exceeding the timeout is considered as failed.
+func NewRedisStore(address string, timeout time.Duration) (*RedisStore, error) {
+	store := &RedisStore{
+		address: address,
+		timeout: timeout,
+		pool:    make(chan *redisConn, redisPoolSize),
+		now:     time.Now,
+	}
+
+	if strings.Contains(address, "://") {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis address '%s' : %w", address, err)
+		}
+		if u.Scheme != "redis" {
+			return nil, fmt.Errorf("unsupported redis scheme '%s'", u.Scheme)
+		}
+		store.address = u.Host
+		if u.User != nil {
+			store.password, _ = u.User.Password()
+		}
+		if db := strings.TrimPrefix(u.Path, "/"); len(db) > 0 {
+			if store.db, err = strconv.Atoi(db); err != nil {
+				return nil, fmt.Errorf("invalid redis database '%s' : %w", db, err)
+			}
+		}
+	}
+
+	if _, _, err := net.SplitHostPort(store.address); err != nil {
+		return nil, fmt.Errorf("invalid redis address '%s' : %w", address, err)
+	}
+	return store, nil
+}
+
+// window returns the fixed window of the quota identified by key the provided time belongs to,
+// along with the redis key counting its requests and the duration until it ends
+func (s *RedisStore) window(key string, limit *RateLimit, now time.Time) (string, time.Duration, time.Duration) {
+	window := time.Duration(float64(limit.Burst) / limit.Rate * float64(time.Second))
+	if window < time.Millisecond {
+		window = time.Millisecond
+	}
+	index := now.UnixNano() / int64(window)
+	reset := time.Duration((index+1)*int64(window) - now.UnixNano())
+	return fmt.Sprintf("%s%s:%d", redisKeyPrefix, key, index), window, reset
+}
+
+// Take accounts a request in the current window of the quota identified by key
+func (s *RedisStore) Take(key string, limit *RateLimit) (*Quota, error) {
+	k, window, reset := s.window(key, limit, s.now())
+	replies, err := s.do(
+		[]string{"INCR", k},
+		[]string{"PEXPIRE", k, strconv.FormatInt(2*window.Milliseconds(), 10)},
+	)
+	if err != nil {
+		return nil, err
+	}
+	count, ok := replies[0].(int64)
+	if !ok {
+		return nil, fmt.Errorf("unexpected redis INCR reply %v", replies[0])
+	}
+
+	quota := &Quota{Limit: limit.Burst, Remaining: limit.Burst - int(count), Reset: reset}
+	if quota.Remaining < 0 {
+		quota.Remaining = 0
+		quota.Exceeded = true
+		quota.RetryAfter = reset
+	}
+	return quota, nil
+}
+
+// Refund gives back a request accounted in the current window of the quota identified by key.
+// A request accounted in a window which has since ended is refunded to the current one.
+func (s *RedisStore) Refund(key string, limit *RateLimit) error {
+	k, window, _ := s.window(key, limit, s.now())
+	_, err := s.do(
+		[]string{"DECR", k},
+		[]string{"PEXPIRE", k, strconv.FormatInt(2*window.Milliseconds(), 10)},
+	)
+	return err
+}
+
+// Ping checks the server is reachable
+func (s *RedisStore) Ping() error {
+	_, err := s.do([]string{"PING"})
+	return err
+}
+
+// Close closes the pooled connections
+func (s *RedisStore) Close() {
+	for {
+		select {
+		case c := <-s.pool:
+			_ = c.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// do pipelines the provided commands and returns their replies
+func (s *RedisStore) do(commands ...[]string) ([]interface{}, error) {
+	c, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := c.pipeline(s.timeout, commands...)
+	if err != nil {
+		_ = c.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case s.pool <- c:
+	default:
+		_ = c.conn.Close()
+	}
+	return replies, nil
+}
+
+// conn returns a pooled connection or dials a new one
+func (s *RedisStore) conn() (*redisConn, error) {
+	select {
+	case c := <-s.pool:
+		return c, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", s.address, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	setup := make([][]string, 0)
+	if len(s.password) > 0 {
+		setup = append(setup, []string{"AUTH", s.password})
+	}
+	if s.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	if len(setup) > 0 {
+		if _, err := c.pipeline(s.timeout, setup...); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// pipeline writes all the commands before reading their replies, redis errors are returned as errors
+func (c *redisConn) pipeline(timeout time.Duration, commands ...[]string) ([]interface{}, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var sb strings.Builder
+	for _, cmd := range commands {
+		fmt.Fprintf(&sb, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := io.WriteString(c.conn, sb.String()); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, 0, len(commands))
+	for range commands {
+		reply, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if rerr, ok := reply.(redisError); ok {
+			return nil, rerr
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// read reads a single RESP reply
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("malformed redis reply")
+	}
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return redisError(payload), nil
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(payload)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			v, err := c.read()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unsupported redis reply type '%c'", line[0])
+	}
+}
@@ -0,0 +1,13 @@
+package authz
+
+// Request holds the attributes of an inbound request evaluated against the client authorizations
+type Request struct {
+	Host          string            // Host is the originally contacted host
+	ClientID      string            // ClientID is the client identifier extracted from the authz header
+	Path          string            // Path is the requested path
+	Method        HTTPMethod        // Method is the requested HTTP method
+	Headers       map[string]string // Headers are the inbound request headers, keys are lowercased
+	Body          []byte            // Body is the request body as forwarded by Envoy when configured with with_request_body
+	BodyTruncated bool              // BodyTruncated is true when Envoy only forwarded a partial body
+	Evaluation    bool              // Evaluation is true for what-if requests which must not consume rate limit quotas nor be accounted in metrics
+}
@@ -0,0 +1,114 @@
+package authz
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+)
+
+// Source describes where a client authorization was loaded from
+type Source struct {
+	File     string    `json:"file"`     // File is the path of the configuration file
+	Hash     string    `json:"hash"`     // Hash is the hex encoded sha256 of the configuration file content
+	LoadedAt time.Time `json:"loadedAt"` // LoadedAt is the time at which the file was loaded
+}
+
+// NewSource describes the provided configuration file content
+func NewSource(file string, content []byte) *Source {
+	sum := sha256.Sum256(content)
+	return &Source{File: file, Hash: hex.EncodeToString(sum[:]), LoadedAt: time.Now()}
+}
+
+// LoadError reports a configuration file which could not be loaded and was skipped
+type LoadError struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+// ReloadStatus describes the active client authorizations and the outcome of the last reload attempt
+type ReloadStatus struct {
+	Source      string      `json:"source"`              // Source is the location the active authorizations were loaded from
+	Version     string      `json:"version,omitempty"`   // Version is the version of the active policy bundle, empty when loaded from a directory
+	Hash        string      `json:"hash"`                // Hash identifies the content of the active authorizations
+	LoadedAt    time.Time   `json:"loadedAt"`            // LoadedAt is the activation time of the active authorizations
+	Clients     int         `json:"clients"`             // Clients is the number of configured clients
+	Errors      []LoadError `json:"errors"`              // Errors lists the configuration files skipped while loading the active authorizations
+	LastAttempt time.Time   `json:"lastAttempt"`         // LastAttempt is the time of the last reload attempt
+	LastError   string      `json:"lastError,omitempty"` // LastError is the error of the last reload attempt, empty if it succeeded
+}
+
+// hashSources computes a hash identifying the content of all the provided sources
+func hashSources(sources []*Source) string {
+	h := sha256.New()
+	for _, s := range sources {
+		h.Write([]byte(s.File))
+		h.Write([]byte{0})
+		h.Write([]byte(s.Hash))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// NewLoadedAuthorizations creates a complete set of authorizations from the provided client authorizations.
+// The source identifies where the authorizations were loaded from and errors lists the configurations which were skipped.
+func NewLoadedAuthorizations(source string, auths []*Authorization, errors []LoadError) *Authorizations {
+	authz := NewAuthorizations()
+	authz.status.Source = source
+	authz.status.Errors = append(authz.status.Errors, errors...)
+	sources := make([]*Source, 0, len(auths))
+	for _, auth := range auths {
+		authz.authorizations[auth.ClientID] = auth
+		if auth.Source != nil {
+			sources = append(sources, auth.Source)
+		}
+	}
+	authz.seal(sources)
+	return authz
+}
+
+// Status returns the description of the active client authorizations
+func (a *Authorizations) Status() ReloadStatus {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	status := a.status
+	status.Clients = len(a.authorizations)
+	status.Errors = append(make([]LoadError, 0, len(a.status.Errors)), a.status.Errors...)
+	return status
+}
+
+// ReloadFailed records a failed reload attempt, the active authorizations are left untouched
+func (a *Authorizations) ReloadFailed(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.status.LastAttempt = time.Now()
+	a.status.LastError = err.Error()
+}
+
+// touch records a successful reload attempt which left the active authorizations unchanged
+func (a *Authorizations) touch() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.status.LastAttempt = time.Now()
+	a.status.LastError = ""
+}
+
+// Clients returns the configured client authorizations sorted by clientID
+func (a *Authorizations) Clients() []*Authorization {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	clients := make([]*Authorization, 0, len(a.authorizations))
+	for _, auth := range a.authorizations {
+		clients = append(clients, auth)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ClientID < clients[j].ClientID })
+	return clients
+}
+
+// Client returns the authorization configured for the provided clientID
+func (a *Authorizations) Client(clientID string) (*Authorization, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	auth, ok := a.authorizations[clientID]
+	return auth, ok
+}
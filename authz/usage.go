@@ -0,0 +1,213 @@
+package authz
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RuleUsage counts the requests matched by a client rule
+type RuleUsage struct {
+	Rule      string     `json:"rule"`                // Rule is the rule as reported by the decisions Rule
+	Matches   uint64     `json:"matches"`             // Matches is the number of requests the rule decided
+	LastMatch *time.Time `json:"lastMatch,omitempty"` // LastMatch is the time of the last request the rule decided, nil if it never matched
+}
+
+// UsageSnapshot lists the rules usage by clientID
+type UsageSnapshot map[string][]RuleUsage
+
+// ruleCounter accounts the matches of a single rule
+type ruleCounter struct {
+	matches   atomic.Uint64
+	lastMatch atomic.Int64 // lastMatch is the unix time in nanoseconds of the last match, 0 if the rule never matched
+}
+
+// ruleUsage accounts the matches of the rules of a client.
+// It is shared by the successive configurations of a client so that reloads keep the counts.
+type ruleUsage struct {
+	mu       sync.RWMutex
+	counters map[string]*ruleCounter
+}
+
+func newRuleUsage() *ruleUsage {
+	return &ruleUsage{counters: make(map[string]*ruleCounter)}
+}
+
+// counter returns the counter of the provided rule, creating it if needed
+func (u *ruleUsage) counter(rule string) *ruleCounter {
+	u.mu.RLock()
+	c, ok := u.counters[rule]
+	u.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if c, ok = u.counters[rule]; !ok {
+		c = &ruleCounter{}
+		u.counters[rule] = c
+	}
+	return c
+}
+
+// record accounts a match of the provided rule
+func (u *ruleUsage) record(rule string, now time.Time) {
+	c := u.counter(rule)
+	c.matches.Add(1)
+	c.lastMatch.Store(now.UnixNano())
+}
+
+// restore adds the snapshot counts to the rule counters, the most recent match time is kept
+func (u *ruleUsage) restore(usage []RuleUsage) {
+	for _, r := range usage {
+		c := u.counter(r.Rule)
+		c.matches.Add(r.Matches)
+		if r.LastMatch != nil && r.LastMatch.UnixNano() > c.lastMatch.Load() {
+			c.lastMatch.Store(r.LastMatch.UnixNano())
+		}
+	}
+}
+
+// Usage returns the number of requests decided by each client rule and the time of their last match, in the Rules order.
+// Counts are kept across reloads as long as the rule is unchanged.
+func (auth *Authorization) Usage() []RuleUsage {
+	rules := auth.Rules()
+	usage := make([]RuleUsage, 0, len(rules))
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if seen[rule] {
+			continue
+		}
+		seen[rule] = true
+		r := RuleUsage{Rule: rule}
+		if auth.usage != nil {
+			c := auth.usage.counter(rule)
+			r.Matches = c.matches.Load()
+			if last := c.lastMatch.Load(); last > 0 {
+				t := time.Unix(0, last).UTC()
+				r.LastMatch = &t
+			}
+		}
+		usage = append(usage, r)
+	}
+	return usage
+}
+
+// inherit carries the rule counts of the previous configuration of the client over, or the restored counts if it is a new client.
+// Callers must hold the write lock.
+func (a *Authorizations) inherit(auth *Authorization, previous *Authorization) {
+	if previous != nil && previous.usage != nil {
+		auth.usage = previous.usage
+		return
+	}
+	if auth.usage == nil {
+		auth.usage = newRuleUsage()
+	}
+	if restored, ok := a.restored[auth.ClientID]; ok {
+		auth.usage.restore(restored)
+		delete(a.restored, auth.ClientID)
+	}
+}
+
+// Usage returns the rules usage of all the configured clients.
+// Restored counts of clients which are not configured yet are included so that they survive the next snapshot.
+func (a *Authorizations) Usage() UsageSnapshot {
+	snapshot := make(UsageSnapshot)
+	for _, auth := range a.Clients() {
+		snapshot[auth.ClientID] = auth.Usage()
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for id, usage := range a.restored {
+		if _, ok := snapshot[id]; !ok {
+			snapshot[id] = usage
+		}
+	}
+	return snapshot
+}
+
+// RestoreUsage adds the snapshot counts to the configured clients rule counters.
+// Counts of clients which are not configured yet are restored once they are loaded.
+func (a *Authorizations) RestoreUsage(snapshot UsageSnapshot) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for id, usage := range snapshot {
+		auth, ok := a.authorizations[id]
+		if !ok {
+			a.restored[id] = usage
+			continue
+		}
+		if auth.usage == nil {
+			auth.usage = newRuleUsage()
+		}
+		auth.usage.restore(usage)
+	}
+}
+
+// SaveUsage writes the rules usage snapshot to the provided file
+func (a *Authorizations) SaveUsage(file string) error {
+	content, err := json.MarshalIndent(a.Usage(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, content)
+}
+
+// LoadUsage restores the rules usage snapshot stored in the provided file
+func (a *Authorizations) LoadUsage(file string) error {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var snapshot UsageSnapshot
+	if err := json.Unmarshal(content, &snapshot); err != nil {
+		return err
+	}
+	a.RestoreUsage(snapshot)
+	return nil
+}
+
+var (
+	ruleMatchesDesc = prometheus.NewDesc(
+		"jarl_rule_matches_total",
+		"No of requests decided by each client rule",
+		[]string{"client", "rule"}, nil,
+	)
+	ruleLastMatchDesc = prometheus.NewDesc(
+		"jarl_rule_last_match_timestamp_seconds",
+		"Unix time of the last request decided by each client rule",
+		[]string{"client", "rule"}, nil,
+	)
+)
+
+// usageCollector exports the rules usage of the configured clients
+type usageCollector struct {
+	auths *Authorizations
+}
+
+// NewUsageCollector returns a prometheus collector exporting the rules usage of the provided authorizations.
+// Only the rules of the configured clients are exported, the labels cardinality is bounded by the configuration.
+func NewUsageCollector(auths *Authorizations) prometheus.Collector {
+	return &usageCollector{auths: auths}
+}
+
+func (c *usageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ruleMatchesDesc
+	ch <- ruleLastMatchDesc
+}
+
+func (c *usageCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, auth := range c.auths.Clients() {
+		for _, r := range auth.Usage() {
+			ch <- prometheus.MustNewConstMetric(ruleMatchesDesc, prometheus.CounterValue, float64(r.Matches), auth.ClientID, r.Rule)
+			if r.LastMatch != nil {
+				ch <- prometheus.MustNewConstMetric(ruleLastMatchDesc, prometheus.GaugeValue, float64(r.LastMatch.UnixNano())/1e9, auth.ClientID, r.Rule)
+			}
+		}
+	}
+}
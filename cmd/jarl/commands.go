@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// command is a jarl subcommand, it returns the process exit code
+type command func(args []string) int
+
+// commands maps the subcommands to their implementation, jarl starts the server when no subcommand is provided
+var commands = map[string]command{
+	"import":   importCommand,
+	"generate": generateCommand,
+	"coverage": coverageCommand,
+	"diff":     diffCommand,
+}
+
+// runCommand runs the subcommand named by the first argument, false if the arguments do not name a subcommand
+func runCommand(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return 0, false
+	}
+	return cmd(args[1:]), true
+}
+
+// subcommand dispatches the arguments to the named nested subcommands
+func subcommand(name string, args []string, nested map[string]command) int {
+	if len(args) == 0 || nested[args[0]] == nil {
+		names := make([]string, 0, len(nested))
+		for n := range nested {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "usage: jarl %s <%s> [flags]\n", name, strings.Join(names, "|"))
+		return 2
+	}
+	return nested[args[0]](args[1:])
+}
+
+// parseInterspersed parses the flags found before and after the positional arguments and returns the positional arguments
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	positional := make([]string, 0)
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+}
+
+// splitList splits a comma separated list, ignoring the empty items
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+var unsafeFileName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// clientFileName returns a file name for the provided clientID
+func clientFileName(clientID string) string {
+	return strings.Trim(unsafeFileName.ReplaceAllString(clientID, "_"), "_.") + ".yaml"
+}
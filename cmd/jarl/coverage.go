@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/fredjeck/jarl/authz"
+	"github.com/fredjeck/jarl/coverage"
+	"github.com/fredjeck/jarl/openapi"
+)
+
+// coverageCommand reports which clients can reach the endpoints of an OpenAPI document or of a decision log
+func coverageCommand(args []string) int {
+	flags := flag.NewFlagSet("jarl coverage", flag.ContinueOnError)
+	configuration := flags.String("c", "/var/run/jarl/configuration", "Folder containing the clients configurations")
+	spec := flags.String("openapi", "", "OpenAPI 3 document listing the endpoints")
+	log := flags.String("log", "", "jarl JSON decision log replayed against the clients configurations, - for the standard input")
+	host := flags.String("host", "", "Host the OpenAPI operations are evaluated against, the first host of each client if empty")
+	format := flags.String("format", string(coverage.FormatMarkdown), "Report format: csv, markdown or html")
+	output := flags.String("o", "", "File the report is written to, printed to the standard output if empty")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: jarl coverage [-openapi spec.yaml] [-log decisions.log] [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(*spec) == 0 && len(*log) == 0 {
+		return usageError(flags, errors.New("at least one of -openapi or -log is required"))
+	}
+
+	auths, err := authz.LoadAll(*configuration)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report := coverage.New(auths)
+	if len(*spec) > 0 {
+		doc, err := openapi.Load(*spec)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to load '%s': %s\n", *spec, err)
+			return 1
+		}
+		report.AddOpenAPI(doc, *host)
+	}
+	if len(*log) > 0 {
+		if err := readDecisionLog(report, *log); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to read '%s': %s\n", *log, err)
+			return 1
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if len(*output) > 0 {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := report.Write(w, coverage.Format(*format)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// readDecisionLog replays the decision log stored in the provided file, - reads the standard input
+func readDecisionLog(report *coverage.Report, file string) error {
+	if file == "-" {
+		return report.ReadDecisionLog(os.Stdin)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return report.ReadDecisionLog(f)
+}
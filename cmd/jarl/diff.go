@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/fredjeck/jarl/authz"
+	"github.com/fredjeck/jarl/diff"
+)
+
+// diffCommand reports the semantic changes between two client configurations folders, it exits with 1 if they differ
+func diffCommand(args []string) int {
+	flags := flag.NewFlagSet("jarl diff", flag.ContinueOnError)
+	corpus := flags.String("requests", "", "jarl JSON decision log of sample requests, the requests whose decision changes are reported")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: jarl diff old/ new/ [-requests decisions.log]")
+		fmt.Fprintln(flags.Output(), "Exits with 0 if the configurations are equivalent, 1 if they differ and 2 on errors.")
+		flags.PrintDefaults()
+	}
+	dirs, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(dirs) != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	auths := make([]*authz.Authorizations, 0, len(dirs))
+	for _, dir := range dirs {
+		a, err := authz.LoadAll(dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		for _, e := range a.Status().Errors {
+			fmt.Fprintf(os.Stderr, "warning: '%s' was not loaded: %s\n", e.File, e.Error)
+		}
+		auths = append(auths, a)
+	}
+	before, after := auths[0], auths[1]
+
+	changes := diff.Compare(before, after)
+	for _, c := range changes {
+		fmt.Fprintln(os.Stdout, c)
+	}
+	if len(*corpus) == 0 {
+		return exitCode(len(changes) > 0)
+	}
+
+	f, err := os.Open(*corpus)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer f.Close()
+	requests, err := diff.ReadRequests(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to read '%s': %s\n", *corpus, err)
+		return 2
+	}
+	flips := diff.Flips(before, after, requests)
+	if len(flips) > 0 {
+		fmt.Fprintf(os.Stdout, "\nDecision changes (%d distinct requests out of %d):\n", len(flips), len(requests))
+	}
+	for _, flip := range flips {
+		fmt.Fprintln(os.Stdout, flip)
+	}
+	return exitCode(len(changes) > 0 || len(flips) > 0)
+}
+
+// exitCode returns the diff(1) like exit code, 1 if differences were found
+func exitCode(differ bool) int {
+	if differ {
+		return 1
+	}
+	return 0
+}
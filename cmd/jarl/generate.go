@@ -0,0 +1,207 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fredjeck/jarl/authz"
+	"github.com/fredjeck/jarl/mesh"
+	"github.com/fredjeck/jarl/openapi"
+)
+
+// generateCommand generates configurations from the jarl client configurations
+func generateCommand(args []string) int {
+	return subcommand("generate", args, map[string]command{
+		"istio":        generateIstioCommand,
+		"envoy":        generateEnvoyCommand,
+		"from-openapi": generateFromOpenAPICommand,
+	})
+}
+
+// generateFromOpenAPICommand generates a client configuration allowed to call the selected operations of an OpenAPI 3 document
+func generateFromOpenAPICommand(args []string) int {
+	flags := flag.NewFlagSet("jarl generate from-openapi", flag.ContinueOnError)
+	client := flags.String("client", "", "ClientID of the generated client configuration")
+	hosts := flags.String("hosts", "", "Comma separated list of the client hosts")
+	tags := flags.String("tags", "", "Comma separated list of the tags of the allowed operations")
+	operations := flags.String("operations", "", "Comma separated list of the operationIds of the allowed operations")
+	roles := flags.String("roles", "", "Comma separated list of the x-jarl-roles of the allowed operations")
+	output := flags.String("o", "", "Folder the client configuration is written to, printed to the standard output if empty")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: jarl generate from-openapi spec.yaml -client id [flags]")
+		fmt.Fprintln(flags.Output(), "All the operations are allowed if no tag, operationId or role is selected.")
+		flags.PrintDefaults()
+	}
+	files, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(files) != 1 || len(*client) == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	doc, err := openapi.Load(files[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to load '%s': %s\n", files[0], err)
+		return 1
+	}
+	selection := openapi.Selection{Tags: splitList(*tags), OperationIDs: splitList(*operations), Roles: splitList(*roles)}
+	config := doc.Client(*client, splitList(*hosts), selection)
+	if len(config.Paths) == 0 {
+		fmt.Fprintln(os.Stderr, "no operation matches the selection")
+		return 1
+	}
+
+	err = writeClients(*output, []*authz.ClientConfig{config}, func(*authz.ClientConfig) string {
+		return fmt.Sprintf("# Generated from OpenAPI %s %s (%s)\n", doc.Info.Title, doc.Info.Version, filepath.Base(files[0]))
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to write client configuration: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// wiringFlags declares the flags shared by the mesh wiring generators
+type wiringFlags struct {
+	flags         *flag.FlagSet
+	configuration *string
+	grpcPort      *string
+	header        *string
+	forward       *string
+	provider      *string
+	address       *string
+	timeout       *time.Duration
+	failOpen      *bool
+	output        *string
+}
+
+func newWiringFlags(name string) *wiringFlags {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	return &wiringFlags{
+		flags:         flags,
+		configuration: flags.String("c", "/var/run/jarl/configuration", "Folder containing the clients configurations"),
+		grpcPort:      flags.String("g", "9000", "gRPC server port or unix:///path/to.sock of jarl"),
+		header:        flags.String("a", "x-forwarded-sub", "HTTP Header key identifying the connected client"),
+		forward:       flags.String("forward-header", "", "Comma separated list of additional request headers forwarded to jarl"),
+		provider:      flags.String("provider", mesh.DefaultProvider, "Name of the extension provider and cluster"),
+		address:       flags.String("address", "127.0.0.1", "IP address jarl listens on"),
+		timeout:       flags.Duration("timeout", mesh.DefaultTimeout, "Timeout of the check requests"),
+		failOpen:      flags.Bool("fail-open", false, "Allow the requests when jarl cannot be reached"),
+		output:        flags.String("o", "", "Folder the configurations are written to, printed to the standard output if empty"),
+	}
+}
+
+// wiring parses the flags and returns the wiring scoped to the loaded client configurations
+func (f *wiringFlags) wiring(args []string) (*mesh.Wiring, error) {
+	if err := f.flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	w := mesh.NewWiring(0, *f.header)
+	if socket, ok := strings.CutPrefix(*f.grpcPort, "unix://"); ok {
+		w.Socket = socket
+	} else {
+		port, err := strconv.Atoi(*f.grpcPort)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gRPC port '%s'", *f.grpcPort)
+		}
+		w.Port = port
+	}
+	w.Headers = append(w.Headers, splitList(*f.forward)...)
+	w.Provider, w.Address, w.Timeout, w.FailOpen = *f.provider, *f.address, *f.timeout, *f.failOpen
+
+	auths, err := authz.LoadAll(*f.configuration)
+	if err != nil {
+		return nil, err
+	}
+	for _, note := range w.Configure(auths.Clients()) {
+		fmt.Fprintf(os.Stderr, "note: %s\n", note)
+	}
+	return w, nil
+}
+
+// generateIstioCommand generates the Istio extension provider, ServiceEntry and AuthorizationPolicy delegating the checks to jarl
+func generateIstioCommand(args []string) int {
+	f := newWiringFlags("jarl generate istio")
+	namespace := f.flags.String("namespace", "", "Namespace of the protected workloads")
+	selector := f.flags.String("selector", "", "Comma separated key=value labels of the protected workloads, all the namespace workloads if empty")
+	service := f.flags.String("service", mesh.DefaultService, "Host name the mesh uses to reach jarl, a ServiceEntry is generated if -address is set")
+
+	w, err := f.wiring(args)
+	if err != nil {
+		return usageError(f.flags, err)
+	}
+	w.Namespace, w.Service = *namespace, *service
+	if len(*selector) > 0 {
+		w.Selector = make(map[string]string)
+		for _, label := range strings.Split(*selector, ",") {
+			k, v, ok := strings.Cut(label, "=")
+			if !ok {
+				return usageError(f.flags, fmt.Errorf("invalid selector label '%s'", label))
+			}
+			w.Selector[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+
+	manifests, err := w.Istio()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return writeManifests(*f.output, manifests)
+}
+
+// generateEnvoyCommand generates the Envoy ext_authz HTTP filter and cluster delegating the checks to jarl
+func generateEnvoyCommand(args []string) int {
+	f := newWiringFlags("jarl generate envoy")
+	w, err := f.wiring(args)
+	if err != nil {
+		return usageError(f.flags, err)
+	}
+	manifests, err := w.Envoy()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return writeManifests(*f.output, manifests)
+}
+
+// usageError reports a command line error, flag parsing errors are already reported by the flag set
+func usageError(flags *flag.FlagSet, err error) int {
+	if !flags.Parsed() || err == flag.ErrHelp {
+		return 2
+	}
+	fmt.Fprintln(os.Stderr, err)
+	return 1
+}
+
+// writeManifests writes the manifests to the provided folder or to the standard output as a multi-documents yaml stream
+func writeManifests(folder string, manifests []mesh.Manifest) int {
+	if len(folder) > 0 {
+		if err := os.MkdirAll(folder, 0750); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	for i, m := range manifests {
+		if len(folder) > 0 {
+			if err := os.WriteFile(filepath.Join(folder, m.Name), m.Content, 0640); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			continue
+		}
+		if i > 0 {
+			fmt.Fprintln(os.Stdout, "---")
+		}
+		_, _ = os.Stdout.Write(m.Content)
+	}
+	return 0
+}
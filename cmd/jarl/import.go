@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fredjeck/jarl/authz"
+	"github.com/fredjeck/jarl/mesh"
+)
+
+// importCommand converts third party authorization policies into jarl client configurations
+func importCommand(args []string) int {
+	return subcommand("import", args, map[string]command{
+		"istio": importIstioCommand,
+	})
+}
+
+// importIstioCommand converts Istio AuthorizationPolicy resources into jarl client configurations
+func importIstioCommand(args []string) int {
+	flags := flag.NewFlagSet("jarl import istio", flag.ContinueOnError)
+	output := flags.String("o", "", "Folder the client configurations are written to, printed to the standard output if empty")
+	header := flags.String("a", "x-forwarded-sub", "HTTP Header key identifying the connected client, its AuthorizationPolicy conditions are translated to clients")
+	strict := flags.Bool("strict", false, "Exit with an error if some AuthorizationPolicy constructs could not be translated")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: jarl import istio [flags] [policy.yaml ...]")
+		fmt.Fprintln(flags.Output(), "Reads the AuthorizationPolicy resources from the provided files or from the standard input.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	importer := mesh.NewIstioImporter(*header)
+	files := flags.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, file := range files {
+		if err := readPolicies(file, importer.Read); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to import '%s': %s\n", file, err)
+			return 1
+		}
+	}
+
+	if err := writeClients(*output, importer.Clients(), func(c *authz.ClientConfig) string {
+		return fmt.Sprintf("# Imported from Istio AuthorizationPolicy %s\n", strings.Join(importer.Sources(c.ClientID), ", "))
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to write client configurations: %s\n", err)
+		return 1
+	}
+
+	issues := importer.Report()
+	for _, issue := range issues {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", issue)
+	}
+	if *strict && len(issues) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readPolicies reads the provided file, the standard input if file is -
+func readPolicies(file string, read func(io.Reader) error) error {
+	if file == "-" {
+		return read(os.Stdin)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return read(f)
+}
+
+// writeClients writes one file per client configuration to the provided folder, or all the configurations
+// to the standard output as a multi-documents yaml stream if folder is empty
+func writeClients(folder string, clients []*authz.ClientConfig, header func(*authz.ClientConfig) string) error {
+	if len(folder) > 0 {
+		if err := os.MkdirAll(folder, 0750); err != nil {
+			return err
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, client := range clients {
+		content, err := client.Marshal()
+		if err != nil {
+			return err
+		}
+		content = append([]byte(header(client)), content...)
+
+		if len(folder) == 0 {
+			if i > 0 {
+				fmt.Fprintln(os.Stdout, "---")
+			}
+			if _, err := os.Stdout.Write(content); err != nil {
+				return err
+			}
+			continue
+		}
+
+		name := clientFileName(client.ClientID)
+		for n := 2; names[name]; n++ {
+			name = fmt.Sprintf("%s-%d.yaml", strings.TrimSuffix(clientFileName(client.ClientID), ".yaml"), n)
+		}
+		names[name] = true
+		if err := os.WriteFile(filepath.Join(folder, name), content, 0640); err != nil {
+			return err
+		}
+	}
+	return nil
+}
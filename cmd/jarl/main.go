@@ -16,51 +16,355 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fredjeck/jarl/authz"
+	"github.com/fredjeck/jarl/crd"
 	"github.com/fredjeck/jarl/logging"
 	"github.com/fredjeck/jarl/server"
+	"github.com/fredjeck/jarl/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 var (
-	httpPort      = flag.String("h", "8000", "HTTP server port")
-	grpcPort      = flag.String("g", "9000", "gRPC server port")
+	httpPort      = flag.String("h", "8000", "HTTP server port or unix:///path/to.sock")
+	grpcPort      = flag.String("g", "9000", "gRPC server port or unix:///path/to.sock")
+	socketMode    = flag.Uint("socket-mode", uint(server.DefaultSocketMode), "File permissions of the unix domain sockets")
 	header        = flag.String("a", "x-forwarded-sub", "HTTP Header key identifying the connected client")
 	configuration = flag.String("c", "/var/run/jarl/configuration", "Folder containing the clients configurations")
+	cacheSize     = flag.Int("cache-size", 0, "Maximum number of cached authorization decisions, 0 disables the cache")
+	cacheTTL      = flag.Duration("cache-ttl", time.Minute, "Duration for which authorization decisions are cached")
+	defaultPolicy = flag.String("default-policy", "allow", "Outcome of the requests while no client configuration is loaded: allow, deny or dry-run")
+	grpcCert      = flag.String("grpc-tls-cert", "", "PEM certificate file enabling TLS on the gRPC server")
+	grpcKey       = flag.String("grpc-tls-key", "", "PEM private key file of the gRPC server certificate")
+	grpcClientCA  = flag.String("grpc-tls-client-ca", "", "PEM CA bundle used to verify the gRPC client certificates, enables mTLS")
+	httpCert      = flag.String("http-tls-cert", "", "PEM certificate file enabling TLS on the HTTP server")
+	httpKey       = flag.String("http-tls-key", "", "PEM private key file of the HTTP server certificate")
+	httpClientCA  = flag.String("http-tls-client-ca", "", "PEM CA bundle used to verify the HTTP client certificates, enables mTLS")
+	drainPeriod   = flag.Duration("drain-period", server.DefaultDrainPeriod, "Duration during which health checks report not serving before shutting down")
+	shutdownTime  = flag.Duration("shutdown-timeout", server.DefaultShutdownTimeout, "Duration given to in-flight requests to complete once the drain period is over")
+	redisAddress  = flag.String("ratelimit-redis", "", "Redis address (host:port or redis://[:password@]host:port[/db]) sharing the rate limits across replicas, in-process if empty")
+	redisTimeout  = flag.Duration("ratelimit-redis-timeout", 50*time.Millisecond, "Timeout after which the rate limits fall back to in-process quotas")
+	adminPort     = flag.String("admin", "", "Admin API port bound to the loopback interface, host:port or unix:///path/to.sock, served by the HTTP server if empty")
+	adminToken    = flag.String("admin-token", os.Getenv("JARL_ADMIN_TOKEN"), "Bearer token required by the admin API, defaults to the JARL_ADMIN_TOKEN environment variable")
+	bundle        = flag.String("bundle", "", "Signed tar.gz policy bundle file or http(s) URL loaded instead of the configuration folder")
+	bundleKey     = flag.String("bundle-public-key", "", "PEM Ed25519 public key verifying the policy bundle signature")
+	bundlePoll    = flag.Duration("bundle-poll-interval", authz.DefaultPollInterval, "Interval at which the policy bundle URL is polled")
+	bundleCache   = flag.String("bundle-cache", filepath.Join(os.TempDir(), "jarl", "bundle.tar.gz"), "File storing the last good policy bundle fetched from the bundle URL, used on cold starts")
+	kubernetes    = flag.Bool("kubernetes", false, "Load the client configurations from the JarlClientPolicy custom resources instead of the configuration folder")
+	kubeNamespace = flag.String("kubernetes-namespace", "", "Namespace of the watched JarlClientPolicy resources, all namespaces if empty")
+	kubeconfig    = flag.String("kubeconfig", "", "Kubeconfig file used to reach the Kubernetes API server, in-cluster configuration if empty")
+	ruleUsage     = flag.String("rule-usage-file", "", "File the rules usage counts are restored from at startup and saved to on shutdown, not persisted if empty")
+	tracingExport = flag.String("tracing", "", "Exporter of the check requests spans: otlp-grpc or otlp-http, tracing is disabled if empty")
+	tracingTarget = flag.String("tracing-endpoint", "", "OTLP collector host:port, defaults to the OTEL_EXPORTER_OTLP_ENDPOINT environment variable or the OTLP default port on localhost")
+	tracingPlain  = flag.Bool("tracing-insecure", false, "Disable TLS when connecting to the OTLP collector")
+	tracingRatio  = flag.Float64("tracing-sample-ratio", 1, "Ratio of the traces started by jarl which are sampled, spans of traced requests follow the upstream sampling decision")
+	decisionSinks = flag.String("decision-log", string(logging.SinkStdout), "Comma separated destinations of the decision log: none, stdout, file, syslog or fluent")
+	decisionFile  = flag.String("decision-log-file", "/var/log/jarl/decisions.log", "File the decisions are written to by the file decision log")
+	decisionSize  = flag.Int64("decision-log-max-size", 100, "Size in megabytes after which the decision log file is rotated, never rotated if 0")
+	decisionKeep  = flag.Int("decision-log-max-backups", 5, "Number of rotated decision log files which are kept")
+	syslogAddress = flag.String("decision-log-syslog", "", "Syslog daemon address (udp://host:port or tcp://host:port) of the syslog decision log, the local daemon if empty")
+	fluentAddress = flag.String("decision-log-fluent", "localhost:24224", "Fluentd / Fluent Bit forward input host:port of the fluent decision log")
+	fluentTag     = flag.String("decision-log-fluent-tag", logging.DefaultFluentTag, "Tag of the decision records sent to Fluent")
+	allowHeaders  = flag.String("log-allow-headers", "", "Comma separated headers which are the only ones logged and echoed back, all the headers if empty")
+	denyHeaders   = flag.String("log-deny-headers", "", "Comma separated headers which are neither logged nor echoed back")
+	redactHeaders = flag.String("log-redact-headers", "", "Comma separated headers whose value is redacted, in addition to the known secret headers")
+	hashHeaders   = flag.String("log-hash-headers", "", "Comma separated headers whose value is replaced by its hash")
+	hashClientID  = flag.Bool("log-hash-client-id", false, "Replace the logged client identifiers and the authz header value by their hash")
+	hashKey       = flag.String("log-hash-key", os.Getenv("JARL_LOG_HASH_KEY"), "Key of the HMAC-SHA256 identifiers hashes, plain SHA-256 if empty, defaults to the JARL_LOG_HASH_KEY environment variable")
+	contextSize   = flag.Int("log-max-context-size", logging.DefaultMaxContextSize, "Maximum size in bytes of the logged and echoed back request context, the body is removed first, unlimited if 0")
+	decisionQueue = flag.Int("decision-log-buffer", logging.DefaultDecisionBuffer, "Number of decision records buffered while the decision log destination is busy, records are dropped once it is full")
 )
 
 func main() {
 
+	if code, ok := runCommand(os.Args[1:]); ok {
+		os.Exit(code)
+	}
+
 	logging.Setup()
 
 	flag.Parse()
 
 	conf := &server.Configuration{
-		HTTPListenOn:             fmt.Sprintf(":%s", *httpPort),
-		GRPCListenOn:             fmt.Sprintf(":%s", *grpcPort),
+		HTTPListenOn:             listenAddress(*httpPort),
+		GRPCListenOn:             listenAddress(*grpcPort),
+		SocketMode:               os.FileMode(*socketMode),
 		HTTPAuthZHeader:          *header,
 		ClientsConfigurationPath: *configuration,
+		GRPCTLS:                  tlsConfiguration(*grpcCert, *grpcKey, *grpcClientCA),
+		HTTPTLS:                  tlsConfiguration(*httpCert, *httpKey, *httpClientCA),
+		DrainPeriod:              *drainPeriod,
+		ShutdownTimeout:          *shutdownTime,
+		AdminToken:               *adminToken,
+		Redactor:                 redactor(),
+	}
+	if len(*adminPort) > 0 {
+		conf.AdminListenOn = adminListenAddress(*adminPort)
+	}
+
+	key, err := bundlePublicKey()
+	if err != nil {
+		slog.Error("invalid policy bundle configuration", slog.Any(logging.KeyError, err))
+		os.Exit(1)
 	}
 
-	auths, err := authz.LoadAll(*configuration)
+	// Bundles fetched from an URL and custom resources are activated by their source once the server is started
+	load := func() (*authz.Authorizations, error) { return authz.LoadAll(*configuration) }
+	if authz.IsBundleURL(*bundle) || *kubernetes {
+		// Requests are denied until the first bundle is activated or the custom resources are synced
+		load = func() (*authz.Authorizations, error) { return authz.NewPendingAuthorizations(), nil }
+	} else if len(*bundle) > 0 {
+		load = func() (*authz.Authorizations, error) { return authz.LoadBundle(*bundle, key) }
+	}
+	auths, err := load()
+	if err != nil {
+		slog.Error("unable to load client configurations", slog.Any(logging.KeyError, err))
+		os.Exit(1)
+	}
+	policy, err := authz.ParseDefaultPolicy(*defaultPolicy)
 	if err != nil {
-		slog.Error(fmt.Sprintf("unable to load client configurations from '%s'", *configuration), slog.Any("error", logging.KeyError))
+		slog.Error("invalid default policy", slog.Any(logging.KeyError, err))
 		os.Exit(1)
 	}
+	auths.SetDefaultPolicy(policy)
+	auths.EnableCache(*cacheSize, *cacheTTL)
+
+	if len(*redisAddress) > 0 {
+		store, err := authz.NewRedisStore(*redisAddress, *redisTimeout)
+		if err != nil {
+			slog.Error("unable to configure the rate limit store", slog.Any(logging.KeyError, err))
+			os.Exit(1)
+		}
+		defer store.Close()
+		auths.SetRateLimitStore(store)
+	}
 	conf.Authorizations = auths
 
+	exporter, err := tracing.ParseExporter(*tracingExport)
+	if err != nil {
+		slog.Error("invalid tracing configuration", slog.Any(logging.KeyError, err))
+		os.Exit(1)
+	}
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Configuration{
+		Exporter:    exporter,
+		Endpoint:    *tracingTarget,
+		Insecure:    *tracingPlain,
+		SampleRatio: *tracingRatio,
+		Version:     server.Version,
+	})
+	if err != nil {
+		slog.Error("unable to configure tracing", slog.Any(logging.KeyError, err))
+		os.Exit(1)
+	}
+
+	decisions, err := decisionLog(conf.Redactor)
+	if err != nil {
+		slog.Error("unable to configure the decision log", slog.Any(logging.KeyError, err))
+		os.Exit(1)
+	}
+	logging.SetDecisionLog(decisions)
+
+	prometheus.MustRegister(authz.NewUsageCollector(auths))
+	if len(*ruleUsage) > 0 {
+		if err := auths.LoadUsage(*ruleUsage); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn(fmt.Sprintf("unable to restore the rules usage from '%s'", *ruleUsage), slog.Any(logging.KeyError, err))
+		}
+	}
+
 	s := server.NewJarlAuthzServer(conf)
 	go s.Start()
-	defer s.Stop()
 
-	// Wait for the process to be shutdown.
+	// Reload the client configurations on SIGHUP and wait for the process to be shutdown.
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	<-sigs
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	// The server reports not ready until the first policy bundle is activated
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var poller *authz.BundlePoller
+	if authz.IsBundleURL(*bundle) {
+		poller = authz.NewBundlePoller(*bundle, key, auths)
+		poller.Interval = *bundlePoll
+		poller.CacheFile = *bundleCache
+		poller.Start(ctx)
+	} else if *kubernetes {
+		source, err := policySource(auths)
+		if err != nil {
+			slog.Error("unable to watch JarlClientPolicy resources", slog.Any(logging.KeyError, err))
+			os.Exit(1)
+		}
+		go func() {
+			if err := source.Run(ctx); err != nil {
+				slog.Error("stopped watching JarlClientPolicy resources", slog.Any(logging.KeyError, err))
+			}
+		}()
+	}
+
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			s.Shutdown()
+			saveUsage(auths)
+			flushSpans(shutdownTracing)
+			flushDecisions(decisions)
+			return
+		}
+		if poller != nil {
+			_ = poller.Poll(ctx)
+			continue
+		}
+		if *kubernetes {
+			slog.Info("JarlClientPolicy resources are watched, ignoring reload request")
+			continue
+		}
+		reload(conf, load)
+	}
+}
+
+// listenAddress returns the address to listen on for the provided port, host:port or unix domain socket
+func listenAddress(port string) string {
+	if strings.HasPrefix(port, "unix://") || strings.Contains(port, ":") {
+		return port
+	}
+	return fmt.Sprintf(":%s", port)
+}
+
+// adminListenAddress returns the address the admin API listens on, a bare port is bound to the loopback interface
+func adminListenAddress(port string) string {
+	if strings.HasPrefix(port, "unix://") || strings.Contains(port, ":") {
+		return port
+	}
+	return fmt.Sprintf("127.0.0.1:%s", port)
+}
+
+// tlsConfiguration returns the listener TLS configuration, nil if no certificate is provided
+func tlsConfiguration(cert string, key string, clientCA string) *server.TLSConfiguration {
+	if len(cert) == 0 && len(key) == 0 {
+		return nil
+	}
+	return &server.TLSConfiguration{CertFile: cert, KeyFile: key, ClientCAFile: clientCA}
+}
+
+// bundlePublicKey returns the key verifying the policy bundle signature, nil if no bundle is configured
+func bundlePublicKey() (ed25519.PublicKey, error) {
+	if len(*bundle) == 0 {
+		return nil, nil
+	}
+
+	if len(*bundleKey) == 0 {
+		return nil, errors.New("a public key is required to verify the policy bundle signature")
+	}
+	pem, err := os.ReadFile(*bundleKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := authz.ParsePublicKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy bundle public key '%s' : %w", *bundleKey, err)
+	}
+	return key, nil
+}
+
+// policySource creates the source activating the JarlClientPolicy resources into auths
+func policySource(auths *authz.Authorizations) (*crd.PolicySource, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return crd.NewPolicySource(client, *kubeNamespace, auths), nil
+}
+
+// saveUsage persists the rules usage counts so that they survive restarts
+func saveUsage(auths *authz.Authorizations) {
+	if len(*ruleUsage) == 0 {
+		return
+	}
+	if err := auths.SaveUsage(*ruleUsage); err != nil {
+		slog.Error(fmt.Sprintf("unable to save the rules usage to '%s'", *ruleUsage), slog.Any(logging.KeyError, err))
+	}
+}
+
+// flushSpans exports the pending spans, giving up after the shutdown timeout
+func flushSpans(shutdown func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTime)
+	defer cancel()
+	if err := shutdown(ctx); err != nil {
+		slog.Error("unable to export the pending spans", slog.Any(logging.KeyError, err))
+	}
+}
+
+// redactor creates the redactor sanitizing the logged and echoed back requests
+func redactor() *logging.Redactor {
+	hashed := splitList(*hashHeaders)
+	if *hashClientID {
+		hashed = append(hashed, *header)
+	}
+	return logging.NewRedactor(logging.RedactionConfiguration{
+		AllowHeaders:   splitList(*allowHeaders),
+		DenyHeaders:    splitList(*denyHeaders),
+		RedactHeaders:  splitList(*redactHeaders),
+		HashHeaders:    hashed,
+		HashClientID:   *hashClientID,
+		HashKey:        *hashKey,
+		MaxContextSize: *contextSize,
+	})
+}
+
+// decisionLog creates the decision log writing to the configured destinations
+func decisionLog(redactor *logging.Redactor) (*logging.DecisionLog, error) {
+	sinks, err := logging.ParseSinks(*decisionSinks)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := logging.NewSink(logging.SinkConfiguration{
+		Sinks:          sinks,
+		File:           *decisionFile,
+		FileMaxSize:    *decisionSize * 1024 * 1024,
+		FileMaxBackups: *decisionKeep,
+		Syslog:         *syslogAddress,
+		Fluent:         *fluentAddress,
+		FluentTag:      *fluentTag,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return logging.NewDecisionLog(sink, *decisionQueue, redactor), nil
+}
+
+// flushDecisions writes the buffered decision records, giving up after the shutdown timeout
+func flushDecisions(decisions *logging.DecisionLog) {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTime)
+	defer cancel()
+	if err := decisions.Close(ctx); err != nil {
+		slog.Error("unable to write the pending decision records", slog.Any(logging.KeyError, err))
+	}
+}
+
+// reload loads the client configurations and swaps them with the active ones
+func reload(conf *server.Configuration, load func() (*authz.Authorizations, error)) {
+	slog.Info("reloading client configurations")
+	auths, err := load()
+	if err != nil {
+		slog.Error("unable to reload client configurations, keeping the active ones", slog.Any(logging.KeyError, err))
+		conf.Authorizations.ReloadFailed(err)
+		return
+	}
+	conf.Authorizations.Replace(auths)
 }
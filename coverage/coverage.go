@@ -0,0 +1,189 @@
+// Package coverage - Client x endpoint access reports
+package coverage
+
+import (
+	"io"
+	"slices"
+	"sort"
+
+	"github.com/fredjeck/jarl/authz"
+	"github.com/fredjeck/jarl/logging"
+	"github.com/fredjeck/jarl/openapi"
+)
+
+// Endpoint is an API endpoint and the clients which can reach it
+type Endpoint struct {
+	Method authz.HTTPMethod
+	Host   string          // Host is the observed host, empty for OpenAPI operations
+	Path   string          // Path is the OpenAPI path template or the observed path
+	Access map[string]bool // Access is true for the clients allowed to call the endpoint
+	Hits   int             // Hits counts the observed requests to the endpoint
+
+	operation *openapi.Operation
+}
+
+// Reachable returns true if at least one client can call the endpoint
+func (e *Endpoint) Reachable() bool {
+	for _, allowed := range e.Access {
+		if allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Report is a client x endpoint access matrix.
+//
+// OpenAPI operations are evaluated with a sample path, integer path parameters are replaced by 1 and the other ones
+// by their name. Observed requests are evaluated as logged, against the active client configurations.
+type Report struct {
+	Clients     []string
+	Endpoints   []*Endpoint
+	Observed    bool                // Observed is true if the rules usage was computed from observed requests
+	Requests    int                 // Requests counts the observed requests
+	UnusedRules map[string][]string // UnusedRules lists per client the rules which matched no observed request, or no OpenAPI operation if no request was observed
+
+	auths *authz.Authorizations
+	used  map[string]map[string]bool
+}
+
+// New creates an empty report for the provided client authorizations
+func New(auths *authz.Authorizations) *Report {
+	r := &Report{
+		Clients:     make([]string, 0),
+		Endpoints:   make([]*Endpoint, 0),
+		UnusedRules: make(map[string][]string),
+		auths:       auths,
+		used:        make(map[string]map[string]bool),
+	}
+	for _, c := range auths.Clients() {
+		r.Clients = append(r.Clients, c.ClientID)
+		r.used[c.ClientID] = make(map[string]bool)
+	}
+	return r
+}
+
+// AddOpenAPI adds the document operations to the report endpoints.
+// Operations are evaluated against the provided host, or the first host of each client if empty.
+func (r *Report) AddOpenAPI(doc *openapi.Document, host string) {
+	for _, op := range doc.Operations() {
+		e := &Endpoint{Method: op.Method, Path: op.Path, Access: make(map[string]bool), operation: op}
+		for _, c := range r.auths.Clients() {
+			h := host
+			if len(h) == 0 && len(c.Hosts) > 0 {
+				h = c.Hosts[0]
+			}
+			e.Access[c.ClientID] = r.evaluate(c.ClientID, h, op.Sample(), op.Method, !r.Observed)
+		}
+		r.Endpoints = append(r.Endpoints, e)
+	}
+	r.unused()
+}
+
+// ReadDecisionLog replays the requests of a jarl JSON decision log, one decision per line.
+// Requests are counted against the matching OpenAPI operation when one was added, other requests are added as endpoints.
+// Logged paths are evaluated with their query string, as the server evaluated them.
+func (r *Report) ReadDecisionLog(reader io.Reader) error {
+	if !r.Observed {
+		r.Observed = true
+		for _, used := range r.used {
+			clear(used)
+		}
+	}
+
+	observed := make(map[string]*Endpoint)
+	err := logging.ReadRequests(reader, func(ctx *logging.Context) {
+		path := ctx.Path
+		method := authz.ParseHTTPMethod(ctx.Method)
+		r.Requests++
+
+		if _, ok := r.used[ctx.ClientID]; ok {
+			r.evaluate(ctx.ClientID, ctx.Host, path, method, true)
+		}
+
+		if e := r.operation(method, path); e != nil {
+			e.Hits++
+			return
+		}
+		key := string(method) + " " + ctx.Host + path
+		e, ok := observed[key]
+		if !ok {
+			e = &Endpoint{Method: method, Host: ctx.Host, Path: path, Access: make(map[string]bool)}
+			for _, c := range r.Clients {
+				e.Access[c] = r.evaluate(c, ctx.Host, path, method, false)
+			}
+			observed[key] = e
+		}
+		e.Hits++
+	})
+	if err != nil {
+		return err
+	}
+
+	endpoints := make([]*Endpoint, 0, len(observed))
+	for _, e := range observed {
+		endpoints = append(endpoints, e)
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		a, b := endpoints[i], endpoints[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if a.Method != b.Method {
+			return a.Method < b.Method
+		}
+		return a.Host < b.Host
+	})
+	r.Endpoints = append(r.Endpoints, endpoints...)
+	r.unused()
+	return nil
+}
+
+// Unreachable returns the endpoints no client can call
+func (r *Report) Unreachable() []*Endpoint {
+	endpoints := make([]*Endpoint, 0)
+	for _, e := range r.Endpoints {
+		if !e.Reachable() {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints
+}
+
+// evaluate returns true if the client is allowed to perform the request, the matched rule is recorded as used if track is set
+func (r *Report) evaluate(clientID string, host string, path string, method authz.HTTPMethod, track bool) bool {
+	decision := r.auths.Check(&authz.Request{
+		ClientID:   clientID,
+		Host:       host,
+		Path:       path,
+		Method:     method,
+		Headers:    make(map[string]string),
+		Evaluation: true,
+	})
+	if track && decision.ClientID == clientID && len(decision.Rule) > 0 {
+		r.used[clientID][decision.Rule] = true
+	}
+	return decision.Allowed
+}
+
+// operation returns the OpenAPI operation endpoint matching the request, nil if none
+func (r *Report) operation(method authz.HTTPMethod, path string) *Endpoint {
+	for _, e := range r.Endpoints {
+		if e.operation != nil && e.Method == method && e.operation.Matches(path) {
+			return e
+		}
+	}
+	return nil
+}
+
+// unused computes the rules which were not used by any client
+func (r *Report) unused() {
+	clear(r.UnusedRules)
+	for _, c := range r.auths.Clients() {
+		for _, rule := range c.Rules() {
+			if !r.used[c.ClientID][rule] && !slices.Contains(r.UnusedRules[c.ClientID], rule) {
+				r.UnusedRules[c.ClientID] = append(r.UnusedRules[c.ClientID], rule)
+			}
+		}
+	}
+}
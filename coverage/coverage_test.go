@@ -0,0 +1,157 @@
+package coverage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/fredjeck/jarl/authz"
+	"github.com/fredjeck/jarl/openapi"
+	"github.com/stretchr/testify/assert"
+)
+
+const spec = `
+openapi: 3.0.3
+info:
+  title: Pokedex
+  version: 1.0.0
+paths:
+  /pokemon:
+    get: {}
+  /pokemon/{id}:
+    parameters:
+    - name: id
+      in: path
+      schema:
+        type: integer
+    get: {}
+    delete: {}
+  /berries:
+    post: {}
+`
+
+func authorizations(t *testing.T, configs ...string) *authz.Authorizations {
+	auths := make([]*authz.Authorization, 0)
+	for _, c := range configs {
+		auth, err := authz.NewAuthorizationFromYaml([]byte(c))
+		assert.NoError(t, err)
+		auths = append(auths, auth)
+	}
+	return authz.NewLoadedAuthorizations("test", auths, nil)
+}
+
+func TestOpenAPICoverage(t *testing.T) {
+	auths := authorizations(t, `
+clientID: ash
+hosts: [pokedex.local]
+mode: allow
+paths:
+  - path: ^/pokemon$
+    methods: GET
+  - path: ^/pokemon/[0-9]+$
+    methods: GET
+  - path: ^/items$
+`, `
+clientID: misty
+mode: deny
+paths:
+  - path: ^/pokemon
+    methods: DELETE
+`)
+	doc, err := openapi.Parse([]byte(spec))
+	assert.NoError(t, err)
+
+	r := New(auths)
+	r.AddOpenAPI(doc, "")
+	assert.Equal(t, []string{"ash", "misty"}, r.Clients)
+	assert.Len(t, r.Endpoints, 4)
+
+	access := make(map[string]map[string]bool)
+	for _, e := range r.Endpoints {
+		access[string(e.Method)+" "+e.Path] = e.Access
+	}
+	assert.Equal(t, map[string]bool{"ash": false, "misty": true}, access["POST /berries"])
+	assert.Equal(t, map[string]bool{"ash": true, "misty": true}, access["GET /pokemon/{id}"])
+	assert.Equal(t, map[string]bool{"ash": false, "misty": false}, access["DELETE /pokemon/{id}"])
+
+	unreachable := r.Unreachable()
+	assert.Len(t, unreachable, 1)
+	assert.Equal(t, "/pokemon/{id}", unreachable[0].Path)
+	assert.Equal(t, map[string][]string{"ash": {"paths ALL ^/items$"}}, r.UnusedRules)
+}
+
+func TestDecisionLogCoverage(t *testing.T) {
+	auths := authorizations(t, `
+clientID: ash
+mode: allow
+paths:
+  - path: ^/pokemon$
+    methods: GET
+  - path: ^/pokemon/[0-9]+$
+    methods: GET
+`)
+	log := strings.Join([]string{
+		`{"level":"INFO","msg":"starting jarl"}`,
+		`{"level":"INFO","msg":"GET /pokemon ALLOWED","http.method":"GET","http.host":"pokedex.local","http.path":"/pokemon?limit=10","request.client.id":"ash"}`,
+		`{"level":"INFO","msg":"GET /pokemon ALLOWED","http.method":"GET","http.host":"pokedex.local","http.path":"/pokemon","request.client.id":"ash"}`,
+		`{"level":"INFO","msg":"DELETE /pokemon/25 DENIED","http.method":"DELETE","http.host":"pokedex.local","http.path":"/pokemon/25","request.client.id":"ash"}`,
+		`not json`,
+	}, "\n")
+
+	r := New(auths)
+	assert.NoError(t, r.ReadDecisionLog(strings.NewReader(log)))
+	assert.True(t, r.Observed)
+	assert.Equal(t, 3, r.Requests)
+	assert.Len(t, r.Endpoints, 3)
+	assert.Equal(t, "/pokemon", r.Endpoints[0].Path)
+	assert.Equal(t, 1, r.Endpoints[0].Hits)
+	assert.True(t, r.Endpoints[0].Access["ash"])
+	// ^/pokemon$ does not match the query string, the server denied this request
+	assert.False(t, r.Endpoints[1].Reachable())
+	assert.Equal(t, "/pokemon?limit=10", r.Endpoints[2].Path)
+	assert.False(t, r.Endpoints[2].Access["ash"])
+	assert.Equal(t, map[string][]string{"ash": {"paths GET ^/pokemon/[0-9]+$"}}, r.UnusedRules)
+
+	// Observed requests are counted against the OpenAPI operations
+	doc, err := openapi.Parse([]byte(spec))
+	assert.NoError(t, err)
+	r = New(auths)
+	r.AddOpenAPI(doc, "")
+	assert.Empty(t, r.UnusedRules)
+	assert.NoError(t, r.ReadDecisionLog(strings.NewReader(log)))
+	assert.Len(t, r.Endpoints, 4)
+	assert.Equal(t, 2, r.Endpoints[1].Hits)
+	assert.Equal(t, 0, r.Endpoints[2].Hits)
+	assert.Equal(t, "DELETE", string(r.Endpoints[3].Method))
+	assert.Equal(t, 1, r.Endpoints[3].Hits)
+	assert.Equal(t, map[string][]string{"ash": {"paths GET ^/pokemon/[0-9]+$"}}, r.UnusedRules)
+}
+
+func TestWrite(t *testing.T) {
+	auths := authorizations(t, "clientID: ash\nmode: allow\npaths:\n  - ^/pokemon$\n")
+	doc, err := openapi.Parse([]byte(spec))
+	assert.NoError(t, err)
+	r := New(auths)
+	r.AddOpenAPI(doc, "")
+
+	var buf bytes.Buffer
+	assert.NoError(t, r.Write(&buf, FormatCSV))
+	assert.Equal(t, "method,host,path,hits,reachable,ash\n"+
+		"POST,,/berries,0,false,deny\n"+
+		"GET,,/pokemon,0,true,allow\n"+
+		"GET,,/pokemon/{id},0,false,deny\n"+
+		"DELETE,,/pokemon/{id},0,false,deny\n", buf.String())
+
+	buf.Reset()
+	assert.NoError(t, r.Write(&buf, FormatMarkdown))
+	assert.Contains(t, buf.String(), "| GET |  | /pokemon | 0 | ✓ |\n")
+	assert.Contains(t, buf.String(), "| POST |  | **/berries** | 0 |  |\n")
+	assert.Contains(t, buf.String(), "- `DELETE /pokemon/{id}`\n")
+
+	buf.Reset()
+	assert.NoError(t, r.Write(&buf, FormatHTML))
+	assert.Contains(t, buf.String(), `<tr class="unreachable"><td>POST</td>`)
+	assert.Contains(t, buf.String(), `<td class="allow">✓</td>`)
+
+	assert.Error(t, r.Write(&buf, "pdf"))
+}
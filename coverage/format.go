@@ -0,0 +1,168 @@
+package coverage
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Format is a report output format
+type Format string
+
+const (
+	FormatCSV      Format = "csv"      // FormatCSV one row per endpoint, one column per client
+	FormatMarkdown Format = "markdown" // FormatMarkdown access matrix table followed by the unreachable endpoints and unused rules
+	FormatHTML     Format = "html"     // FormatHTML standalone page highlighting the unreachable endpoints
+)
+
+// Write writes the report in the provided format
+func (r *Report) Write(w io.Writer, format Format) error {
+	switch format {
+	case FormatCSV:
+		return r.WriteCSV(w)
+	case FormatMarkdown:
+		return r.WriteMarkdown(w)
+	case FormatHTML:
+		return r.WriteHTML(w)
+	default:
+		return fmt.Errorf("unsupported report format '%s', expected csv, markdown or html", format)
+	}
+}
+
+// WriteCSV writes the access matrix, one row per endpoint and one allow/deny column per client
+func (r *Report) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	header := append([]string{"method", "host", "path", "hits", "reachable"}, r.Clients...)
+	if err := out.Write(header); err != nil {
+		return err
+	}
+	for _, e := range r.Endpoints {
+		row := []string{string(e.Method), e.Host, e.Path, strconv.Itoa(e.Hits), strconv.FormatBool(e.Reachable())}
+		for _, c := range r.Clients {
+			row = append(row, access(e.Access[c]))
+		}
+		if err := out.Write(row); err != nil {
+			return err
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// WriteMarkdown writes the access matrix table followed by the unreachable endpoints and the unused rules
+func (r *Report) WriteMarkdown(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString("# Policy coverage\n\n")
+	sb.WriteString("| Method | Host | Path | Hits |")
+	for _, c := range r.Clients {
+		fmt.Fprintf(&sb, " %s |", markdownEscape(c))
+	}
+	sb.WriteString("\n|---|---|---|---:|")
+	sb.WriteString(strings.Repeat(":---:|", len(r.Clients)))
+	sb.WriteString("\n")
+	for _, e := range r.Endpoints {
+		path := markdownEscape(e.Path)
+		if !e.Reachable() {
+			path = "**" + path + "**"
+		}
+		fmt.Fprintf(&sb, "| %s | %s | %s | %d |", e.Method, markdownEscape(e.Host), path, e.Hits)
+		for _, c := range r.Clients {
+			mark := ""
+			if e.Access[c] {
+				mark = "✓"
+			}
+			fmt.Fprintf(&sb, " %s |", mark)
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString("\n## Unreachable endpoints\n\n")
+	unreachable := r.Unreachable()
+	if len(unreachable) == 0 {
+		sb.WriteString("All the endpoints are reachable by at least one client.\n")
+	}
+	for _, e := range unreachable {
+		fmt.Fprintf(&sb, "- `%s %s%s`\n", e.Method, e.Host, e.Path)
+	}
+
+	fmt.Fprintf(&sb, "\n## Unused rules\n\n%s\n\n", r.unusedDescription())
+	for _, c := range r.Clients {
+		for _, rule := range r.UnusedRules[c] {
+			fmt.Fprintf(&sb, "- %s: `%s`\n", markdownEscape(c), rule)
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// WriteHTML writes a standalone page with the access matrix, unreachable endpoints are highlighted
+func (r *Report) WriteHTML(w io.Writer) error {
+	return htmlReport.Execute(w, struct {
+		*Report
+		Description string
+	}{r, r.unusedDescription()})
+}
+
+func (r *Report) unusedDescription() string {
+	if r.Observed {
+		return fmt.Sprintf("Rules which matched none of the %d observed requests.", r.Requests)
+	}
+	return "Rules which match none of the OpenAPI operations."
+}
+
+func access(allowed bool) string {
+	if allowed {
+		return "allow"
+	}
+	return "deny"
+}
+
+var markdownEscaper = strings.NewReplacer("|", `\|`, "*", `\*`, "_", `\_`, "`", "\\`")
+
+func markdownEscape(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+var htmlReport = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Policy coverage</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; }
+td.allow { background: #d4f4d4; text-align: center; }
+tr.unreachable td { background: #f8d0d0; }
+</style>
+</head>
+<body>
+<h1>Policy coverage</h1>
+<table>
+<tr><th>Method</th><th>Host</th><th>Path</th><th>Hits</th>{{ range .Clients }}<th>{{ . }}</th>{{ end }}</tr>
+{{- range $e := .Endpoints }}
+<tr{{ if not $e.Reachable }} class="unreachable"{{ end }}><td>{{ $e.Method }}</td><td>{{ $e.Host }}</td><td>{{ $e.Path }}</td><td>{{ $e.Hits }}</td>
+{{- range $.Clients }}{{ if index $e.Access . }}<td class="allow">✓</td>{{ else }}<td></td>{{ end }}{{ end }}</tr>
+{{- end }}
+</table>
+<h2>Unreachable endpoints</h2>
+<ul>
+{{- range .Unreachable }}
+<li><code>{{ .Method }} {{ .Host }}{{ .Path }}</code></li>
+{{- else }}
+<li>All the endpoints are reachable by at least one client.</li>
+{{- end }}
+</ul>
+<h2>Unused rules</h2>
+<p>{{ .Description }}</p>
+<ul>
+{{- range $c := .Clients }}{{ range index $.UnusedRules $c }}
+<li>{{ $c }}: <code>{{ . }}</code></li>
+{{- end }}{{ end }}
+</ul>
+</body>
+</html>
+`))
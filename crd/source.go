@@ -0,0 +1,236 @@
+// Package crd - Kubernetes JarlClientPolicy custom resources policy source
+package crd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/fredjeck/jarl/authz"
+	"gopkg.in/yaml.v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// Kind is the kind of the client policy custom resources
+	Kind = "JarlClientPolicy"
+	// ListKind is the kind of the client policy custom resources lists
+	ListKind = "JarlClientPolicyList"
+	// DefaultResync is the interval at which the watched resources are fully resynchronized
+	DefaultResync = 10 * time.Minute
+)
+
+// Resource identifies the client policy custom resources
+var Resource = schema.GroupVersionResource{Group: "jarl.fredjeck.github.io", Version: "v1alpha1", Resource: "jarlclientpolicies"}
+
+// PolicySource watches the JarlClientPolicy custom resources and activates them into the target authorizations.
+// The resources spec follows the client configuration yaml format, the clientID defaults to the resource name.
+// The outcome of the conversion is written to the resources status.
+type PolicySource struct {
+	Resync time.Duration // Resync is the interval at which the resources are fully resynchronized, DefaultResync if unset
+
+	client    dynamic.Interface
+	namespace string
+	target    *authz.Authorizations
+	store     cache.Store
+	changes   chan struct{}
+}
+
+// NewPolicySource creates a source watching the resources of the provided namespace, all namespaces if empty
+func NewPolicySource(client dynamic.Interface, namespace string, target *authz.Authorizations) *PolicySource {
+	return &PolicySource{
+		Resync:    DefaultResync,
+		client:    client,
+		namespace: namespace,
+		target:    target,
+		changes:   make(chan struct{}, 1),
+	}
+}
+
+// Run watches the resources until ctx is done, the target authorizations are replaced whenever a resource spec changes.
+// The target authorizations are first activated once the informer cache is synced.
+func (s *PolicySource) Run(ctx context.Context) error {
+	resync := s.Resync
+	if resync <= 0 {
+		resync = DefaultResync
+	}
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(s.client, resync, s.namespace, nil)
+	informer := factory.ForResource(Resource).Informer()
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { s.notify() },
+		UpdateFunc: s.updated,
+		DeleteFunc: func(obj interface{}) { s.notify() },
+	}); err != nil {
+		return err
+	}
+	s.store = informer.GetStore()
+
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return errors.New("unable to sync the JarlClientPolicy resources cache")
+	}
+
+	// The notifications of the initial listing are covered by the first synchronization
+	select {
+	case <-s.changes:
+	default:
+	}
+	s.sync(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.changes:
+			s.sync(ctx)
+		}
+	}
+}
+
+// Source returns the location reported in the authorizations reload status
+func (s *PolicySource) Source() string {
+	namespace := s.namespace
+	if len(namespace) == 0 {
+		namespace = "*"
+	}
+	return fmt.Sprintf("kubernetes://%s/%s", Resource.GroupResource(), namespace)
+}
+
+// notify schedules a synchronization, pending notifications are coalesced
+func (s *PolicySource) notify() {
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
+
+// updated ignores the updates which leave the resource spec unchanged, such as status updates and resyncs
+func (s *PolicySource) updated(oldObj, newObj interface{}) {
+	o, ok := oldObj.(*unstructured.Unstructured)
+	n, nok := newObj.(*unstructured.Unstructured)
+	if ok && nok && reflect.DeepEqual(o.Object["spec"], n.Object["spec"]) {
+		return
+	}
+	s.notify()
+}
+
+// sync converts all the cached resources and activates them into the target authorizations
+func (s *PolicySource) sync(ctx context.Context) {
+	objects := make([]*unstructured.Unstructured, 0)
+	for _, obj := range s.store.List() {
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			objects = append(objects, u)
+		}
+	}
+	// Resources are ordered by creation so that the oldest one keeps a clientID claimed by several resources
+	sort.Slice(objects, func(i, j int) bool {
+		ti, tj := objects[i].GetCreationTimestamp(), objects[j].GetCreationTimestamp()
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+		return key(objects[i]) < key(objects[j])
+	})
+
+	auths := make([]*authz.Authorization, 0, len(objects))
+	loadErrors := make([]authz.LoadError, 0)
+	owners := make(map[string]string)
+	for _, obj := range objects {
+		auth, err := convert(obj)
+		if err == nil {
+			if owner, ok := owners[auth.ClientID]; ok {
+				err = fmt.Errorf("clientID '%s' is already defined by %s", auth.ClientID, owner)
+			}
+		}
+		if err != nil {
+			slog.Error(fmt.Sprintf("%s '%s' cannot be loaded and will be skipped", Kind, key(obj)), slog.Any("error", err))
+			loadErrors = append(loadErrors, authz.LoadError{File: key(obj), Error: err.Error()})
+			s.updateStatus(ctx, obj, newStatus(obj, nil, err))
+			continue
+		}
+		owners[auth.ClientID] = key(obj)
+		auths = append(auths, auth)
+		s.updateStatus(ctx, obj, newStatus(obj, auth, nil))
+	}
+
+	s.target.Replace(authz.NewLoadedAuthorizations(s.Source(), auths, loadErrors))
+	slog.Info(fmt.Sprintf("activated %d %s resources from '%s'", len(auths), Kind, s.Source()))
+}
+
+// convert parses the resource spec as a client configuration
+func convert(obj *unstructured.Unstructured) (*authz.Authorization, error) {
+	spec, ok, err := unstructured.NestedMap(obj.Object, "spec")
+	if err != nil {
+		return nil, err
+	}
+	if !ok || spec == nil {
+		return nil, errors.New("spec is missing")
+	}
+	if _, ok := spec["clientID"]; !ok {
+		spec["clientID"] = obj.GetName()
+	}
+
+	content, err := yaml.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := authz.NewAuthorizationFromYaml(content)
+	if err != nil {
+		return nil, err
+	}
+	auth.Source = authz.NewSource(key(obj), content)
+	return auth, nil
+}
+
+// newStatus returns the resource status reporting the outcome of its conversion
+func newStatus(obj *unstructured.Unstructured, auth *authz.Authorization, err error) map[string]interface{} {
+	status := map[string]interface{}{
+		"observedGeneration": obj.GetGeneration(),
+		"valid":              err == nil,
+	}
+	if err != nil {
+		status["error"] = err.Error()
+		return status
+	}
+	status["clientID"] = auth.ClientID
+	if len(auth.Warnings) > 0 {
+		warnings := make([]interface{}, 0, len(auth.Warnings))
+		for _, w := range auth.Warnings {
+			warnings = append(warnings, w)
+		}
+		status["warnings"] = warnings
+	}
+	return status
+}
+
+// updateStatus writes the provided status to the resource, resources already reporting it are left untouched
+func (s *PolicySource) updateStatus(ctx context.Context, obj *unstructured.Unstructured, status map[string]interface{}) {
+	if current, ok, _ := unstructured.NestedMap(obj.Object, "status"); ok && reflect.DeepEqual(current, status) {
+		return
+	}
+
+	updated := obj.DeepCopy()
+	if err := unstructured.SetNestedMap(updated.Object, status, "status"); err != nil {
+		slog.Warn(fmt.Sprintf("unable to set %s '%s' status", Kind, key(obj)), slog.Any("error", err))
+		return
+	}
+	if _, err := s.client.Resource(Resource).Namespace(obj.GetNamespace()).UpdateStatus(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		slog.Warn(fmt.Sprintf("unable to update %s '%s' status", Kind, key(obj)), slog.Any("error", err))
+	}
+}
+
+// key returns the namespace/name key of the resource
+func key(obj *unstructured.Unstructured) string {
+	if len(obj.GetNamespace()) == 0 {
+		return obj.GetName()
+	}
+	return obj.GetNamespace() + "/" + obj.GetName()
+}
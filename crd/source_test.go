@@ -0,0 +1,115 @@
+package crd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/fredjeck/jarl/authz"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func policy(name string, created time.Time, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": Resource.GroupVersion().String(),
+		"kind":       Kind,
+		"spec":       spec,
+	}}
+	obj.SetNamespace("jarl")
+	obj.SetName(name)
+	obj.SetGeneration(1)
+	obj.SetCreationTimestamp(metav1.NewTime(created))
+	return obj
+}
+
+func TestPolicySource(t *testing.T) {
+	now := time.Now()
+	client := fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{Resource: ListKind},
+		policy("pikachu", now, map[string]interface{}{
+			"mode":  "allow",
+			"paths": []interface{}{"/pokemon/.*?", map[string]interface{}{"path": "/berries", "methods": "FETCH"}},
+		}),
+		policy("invalid", now, map[string]interface{}{"mode": "maybe"}),
+		policy("duplicate", now.Add(time.Second), map[string]interface{}{"clientID": "pikachu", "mode": "deny"}),
+	)
+	resources := client.Resource(Resource).Namespace("jarl")
+
+	target := authz.NewPendingAuthorizations()
+	allowed, err := target.IsAllowed("localhost", "pikachu", "/pokemon/pikachu", authz.HTTPMethodGet)
+	assert.False(t, allowed, "requests are denied until the resources are synced")
+	assert.ErrorIs(t, err, authz.ErrNotLoaded)
+
+	source := NewPolicySource(client, "jarl", target)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- source.Run(ctx) }()
+
+	assert.Eventually(t, target.Loaded, 5*time.Second, 10*time.Millisecond)
+	status := target.Status()
+	assert.Equal(t, "kubernetes://jarlclientpolicies.jarl.fredjeck.github.io/jarl", status.Source)
+	assert.Equal(t, 1, status.Clients)
+	assert.Len(t, status.Errors, 2)
+
+	auth, ok := target.Client("pikachu")
+	assert.True(t, ok)
+	assert.Equal(t, "jarl/pikachu", auth.Source.File)
+	allowed, _ = target.IsAllowed("localhost", "pikachu", "/pokemon/pikachu", authz.HTTPMethodGet)
+	assert.True(t, allowed)
+
+	resourceStatus := func(name string) map[string]interface{} {
+		obj, err := resources.Get(ctx, name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		s, _, _ := unstructured.NestedMap(obj.Object, "status")
+		return s
+	}
+	assert.Eventually(t, func() bool { return resourceStatus("duplicate") != nil }, 5*time.Second, 10*time.Millisecond)
+
+	s := resourceStatus("pikachu")
+	assert.Equal(t, true, s["valid"])
+	assert.Equal(t, "pikachu", s["clientID"])
+	assert.Equal(t, int64(1), s["observedGeneration"])
+	assert.Len(t, s["warnings"], 1)
+
+	s = resourceStatus("invalid")
+	assert.Equal(t, false, s["valid"])
+	assert.Equal(t, authz.ErrInvalidMode.Error(), s["error"])
+
+	s = resourceStatus("duplicate")
+	assert.Equal(t, false, s["valid"])
+	assert.Equal(t, "clientID 'pikachu' is already defined by jarl/pikachu", s["error"])
+
+	// Fixing a resource activates it
+	obj, err := resources.Get(ctx, "invalid", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, unstructured.SetNestedField(obj.Object, "deny", "spec", "mode"))
+	_, err = resources.Update(ctx, obj, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { _, ok := target.Client("invalid"); return ok }, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return resourceStatus("invalid")["valid"] == true }, 5*time.Second, 10*time.Millisecond)
+
+	// Deleting a resource releases its clientID
+	assert.NoError(t, resources.Delete(ctx, "pikachu", metav1.DeleteOptions{}))
+	assert.Eventually(t, func() bool {
+		auth, ok := target.Client("pikachu")
+		return ok && auth.Source.File == "jarl/duplicate"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool { return resourceStatus("duplicate")["valid"] == true }, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestConvert(t *testing.T) {
+	_, err := convert(policy("nospec", time.Now(), nil))
+	assert.Error(t, err)
+
+	obj := policy("typo", time.Now(), map[string]interface{}{"mode": "allow", "hosts": "not a list"})
+	_, err = convert(obj)
+	assert.ErrorIs(t, err, authz.ErrInvalidType)
+}
@@ -0,0 +1,258 @@
+// Package diff - Semantic differences between two sets of client configurations
+package diff
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/fredjeck/jarl/authz"
+	"github.com/fredjeck/jarl/logging"
+)
+
+// Change is a semantic change of a client configuration
+type Change struct {
+	ClientID string
+	Message  string // Message describes the change effect, for example "client foo gains DELETE on ^/berries$"
+}
+
+func (c Change) String() string {
+	return c.Message
+}
+
+// Flip is a request whose decision differs between two sets of client configurations
+type Flip struct {
+	Request *authz.Request
+	Before  authz.Decision
+	After   authz.Decision
+	Count   int // Count is the number of identical requests found in the corpus
+}
+
+func (f Flip) String() string {
+	client := f.Request.ClientID
+	if len(client) == 0 {
+		client = logging.MissingClientID
+	}
+	msg := fmt.Sprintf("%s %s%s for '%s': %s -> %s", f.Request.Method, f.Request.Host, f.Request.Path, client, outcome(f.Before), outcome(f.After))
+	if f.Count > 1 {
+		msg = fmt.Sprintf("%s (%d requests)", msg, f.Count)
+	}
+	return msg
+}
+
+// outcome describes a decision and the rule or reason behind it
+func outcome(d authz.Decision) string {
+	if d.Allowed {
+		if len(d.Rule) > 0 {
+			return fmt.Sprintf("allowed by %s", d.Rule)
+		}
+		return "allowed"
+	}
+	if len(d.Rule) > 0 {
+		return fmt.Sprintf("denied by %s", d.Rule)
+	}
+	return fmt.Sprintf("denied (%s)", d.Reason)
+}
+
+// Compare returns the semantic changes between the before and after client configurations, sorted by clientID.
+// Rules added to an allow client or removed from a deny client are reported as gained accesses, and conversely.
+func Compare(before *authz.Authorizations, after *authz.Authorizations) []Change {
+	clients := make(map[string][2]*authz.Authorization)
+	for _, c := range before.Clients() {
+		clients[c.ClientID] = [2]*authz.Authorization{c, nil}
+	}
+	for _, c := range after.Clients() {
+		pair := clients[c.ClientID]
+		pair[1] = c
+		clients[c.ClientID] = pair
+	}
+	ids := make([]string, 0, len(clients))
+	for id := range clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	changes := make([]Change, 0)
+	for _, id := range ids {
+		changes = append(changes, compareClient(id, clients[id][0], clients[id][1])...)
+	}
+	return changes
+}
+
+// compareClient returns the changes between two configurations of the same client, nil configurations are missing
+func compareClient(id string, before *authz.Authorization, after *authz.Authorization) []Change {
+	changes := make([]Change, 0)
+	add := func(format string, args ...any) {
+		changes = append(changes, Change{ClientID: id, Message: fmt.Sprintf("client %s ", id) + fmt.Sprintf(format, args...)})
+	}
+
+	switch {
+	case after == nil:
+		add("removed")
+		return changes
+	case before == nil:
+		add("added in %s mode", mode(after))
+		if len(after.Hosts) > 0 {
+			add("is restricted to hosts %s", strings.Join(after.Hosts, ", "))
+		}
+		for _, r := range rules(after) {
+			add("%s %s", verb(after), r)
+		}
+		return changes
+	}
+
+	switch {
+	case len(before.Hosts) > 0 && len(after.Hosts) == 0:
+		add("is no longer restricted to hosts")
+	case len(before.Hosts) == 0 && len(after.Hosts) > 0:
+		add("is restricted to hosts %s", strings.Join(after.Hosts, ", "))
+	default:
+		for _, h := range difference(after.Hosts, before.Hosts) {
+			add("gains host %s", h)
+		}
+		for _, h := range difference(before.Hosts, after.Hosts) {
+			add("loses host %s", h)
+		}
+	}
+
+	added := difference(rules(after), rules(before))
+	removed := difference(rules(before), rules(after))
+	if before.Allow != after.Allow {
+		add("switches from %s to %s mode", mode(before), mode(after))
+		for _, r := range added {
+			add("now %s %s", verb(after), r)
+		}
+		for _, r := range removed {
+			add("no longer %s %s", verb(before), r)
+		}
+		return changes
+	}
+
+	gains, losses := added, removed
+	if !after.Allow {
+		gains, losses = removed, added
+	}
+	for _, r := range gains {
+		add("gains %s", r)
+	}
+	for _, r := range losses {
+		add("loses %s", r)
+	}
+	return changes
+}
+
+// mode returns the client mode, allow or deny
+func mode(auth *authz.Authorization) string {
+	if auth.Allow {
+		return "allow"
+	}
+	return "deny"
+}
+
+// verb returns the effect of the client rules, allows or denies
+func verb(auth *authz.Authorization) string {
+	if auth.Allow {
+		return "allows"
+	}
+	return "denies"
+}
+
+// rules describes the client rules, gRPC rules first followed by the path rules sorted by method and the body operation rules
+func rules(auth *authz.Authorization) []string {
+	descriptions := make([]string, 0)
+	for _, r := range auth.GRPC {
+		descriptions = append(descriptions, fmt.Sprintf("gRPC %s", r))
+	}
+
+	methods := make([]string, 0, len(auth.Endpoints))
+	for m := range auth.Endpoints {
+		methods = append(methods, string(m))
+	}
+	sort.Strings(methods)
+	for _, m := range methods {
+		method := m
+		if authz.HTTPMethod(m) == authz.HTTPMethodAll {
+			method = "any method"
+		}
+		for _, p := range auth.Endpoints[authz.HTTPMethod(m)] {
+			descriptions = append(descriptions, fmt.Sprintf("%s on %s", method, p))
+		}
+	}
+
+	for _, i := range []struct {
+		kind       authz.OperationKind
+		inspection *authz.BodyInspection
+	}{{authz.OperationGraphQL, auth.GraphQL}, {authz.OperationJSONRPC, auth.JSONRPC}} {
+		if i.inspection == nil {
+			continue
+		}
+		for _, r := range i.inspection.Rules {
+			descriptions = append(descriptions, fmt.Sprintf("%s operation %s", i.kind, r))
+		}
+	}
+	return descriptions
+}
+
+// difference returns the items of a which are not in b, in order
+func difference(a []string, b []string) []string {
+	items := make([]string, 0)
+	for _, item := range a {
+		if !slices.Contains(b, item) && !slices.Contains(items, item) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ReadRequests reads the request corpus from a jarl JSON decision log, one request per line.
+// Requests logged without identity are replayed without clientID.
+func ReadRequests(r io.Reader) ([]*authz.Request, error) {
+	requests := make([]*authz.Request, 0)
+	err := logging.ReadRequests(r, func(ctx *logging.Context) {
+		req := &authz.Request{
+			Host:     ctx.Host,
+			ClientID: ctx.ClientID,
+			Path:     ctx.Path,
+			Method:   authz.ParseHTTPMethod(ctx.Method),
+			Headers:  ctx.Headers,
+		}
+		if req.ClientID == logging.MissingClientID {
+			req.ClientID = ""
+		}
+		if req.Headers == nil {
+			req.Headers = make(map[string]string)
+		}
+		requests = append(requests, req)
+	})
+	return requests, err
+}
+
+// Flips evaluates the requests against both client configurations and returns the requests whose outcome changed.
+// Identical requests are reported once, in corpus order.
+func Flips(before *authz.Authorizations, after *authz.Authorizations, requests []*authz.Request) []Flip {
+	flips := make([]Flip, 0)
+	seen := make(map[string]int)
+	for _, req := range requests {
+		key := authz.CacheKey(req)
+		if i, ok := seen[key]; ok {
+			if i >= 0 {
+				flips[i].Count++
+			}
+			continue
+		}
+
+		evaluated := *req
+		evaluated.Evaluation = true
+		b := before.Check(&evaluated)
+		a := after.Check(&evaluated)
+		if a.Allowed == b.Allowed {
+			seen[key] = -1
+			continue
+		}
+		seen[key] = len(flips)
+		flips = append(flips, Flip{Request: req, Before: b, After: a, Count: 1})
+	}
+	return flips
+}
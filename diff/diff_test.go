@@ -0,0 +1,123 @@
+package diff
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fredjeck/jarl/authz"
+	"github.com/stretchr/testify/assert"
+)
+
+func authorizations(t *testing.T, configs ...string) *authz.Authorizations {
+	auths := make([]*authz.Authorization, 0)
+	for _, c := range configs {
+		auth, err := authz.NewAuthorizationFromYaml([]byte(c))
+		assert.NoError(t, err)
+		auths = append(auths, auth)
+	}
+	return authz.NewLoadedAuthorizations("test", auths, nil)
+}
+
+func messages(changes []Change) []string {
+	msgs := make([]string, 0, len(changes))
+	for _, c := range changes {
+		msgs = append(msgs, c.String())
+	}
+	return msgs
+}
+
+func TestCompare(t *testing.T) {
+	before := authorizations(t, `
+clientID: foo
+mode: allow
+hosts: [pokedex.local]
+paths:
+  - path: ^/pokemon$
+    methods: GET
+  - ^/items$
+`, `
+clientID: bar
+mode: allow
+`, `
+clientID: misty
+mode: deny
+paths:
+  - path: ^/berries$
+    methods: DELETE
+`, `
+clientID: brock
+mode: allow
+hosts: [pokedex.local]
+paths:
+  - ^/gym$
+`)
+	after := authorizations(t, `
+clientID: foo
+mode: allow
+hosts: [pokedex.local, pokedex.internal]
+paths:
+  - path: ^/pokemon$
+    methods: GET
+  - path: ^/berries$
+    methods: DELETE
+`, `
+clientID: misty
+mode: deny
+paths:
+  - path: ^/berries$
+    methods: DELETE, POST
+`, `
+clientID: brock
+mode: deny
+paths:
+  - ^/gym$
+  - ^/league$
+`, `
+clientID: ash
+mode: allow
+grpc:
+  - pokemon.v1.Pokedex/Get*
+`)
+
+	assert.Equal(t, []string{
+		"client ash added in allow mode",
+		"client ash allows gRPC pokemon.v1.Pokedex/Get*",
+		"client bar removed",
+		"client brock is no longer restricted to hosts",
+		"client brock switches from allow to deny mode",
+		"client brock now denies any method on ^/league$",
+		"client foo gains host pokedex.internal",
+		"client foo gains DELETE on ^/berries$",
+		"client foo loses any method on ^/items$",
+		"client misty loses POST on ^/berries$",
+	}, messages(Compare(before, after)))
+
+	assert.Empty(t, Compare(after, after))
+}
+
+func TestFlips(t *testing.T) {
+	before := authorizations(t, "clientID: foo\nmode: allow\npaths:\n  - path: ^/pokemon$\n    methods: GET\n")
+	after := authorizations(t, "clientID: foo\nmode: allow\npaths:\n  - path: ^/berries$\n    methods: DELETE\n  - path: ^/pokemon$\n    methods: GET\n")
+
+	log := strings.Join([]string{
+		`{"level":"INFO","msg":"starting jarl"}`,
+		`{"http.method":"DELETE","http.host":"pokedex.local","http.path":"/berries","request.client.id":"foo","http.headers":{"x-forwarded-sub":"foo"}}`,
+		`{"http.method":"GET","http.host":"pokedex.local","http.path":"/pokemon","request.client.id":"foo"}`,
+		`{"http.method":"DELETE","http.host":"pokedex.local","http.path":"/berries","request.client.id":"foo"}`,
+		`{"http.method":"DELETE","http.host":"pokedex.local","http.path":"/berries","request.client.id":"missing"}`,
+	}, "\n")
+	requests, err := ReadRequests(strings.NewReader(log))
+	assert.NoError(t, err)
+	assert.Len(t, requests, 4)
+	assert.Equal(t, "foo", requests[0].Headers["x-forwarded-sub"])
+	assert.Empty(t, requests[3].ClientID)
+
+	flips := Flips(before, after, requests)
+	assert.Len(t, flips, 1)
+	assert.Equal(t, 2, flips[0].Count)
+	assert.False(t, flips[0].Before.Allowed)
+	assert.True(t, flips[0].After.Allowed)
+	assert.Equal(t, "DELETE pokedex.local/berries for 'foo': denied (foo is not authorized to access DELETE /berries) -> allowed by paths DELETE ^/berries$ (2 requests)", flips[0].String())
+
+	assert.Empty(t, Flips(after, after, requests))
+}
@@ -0,0 +1,230 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// DecisionSchema identifies the version of the decision records schema.
+	// Field names are stable within a schema version, breaking changes bump the version.
+	DecisionSchema       = "jarl.decision/v1"
+	decisionSchemaPrefix = "jarl.decision/"
+
+	// DefaultDecisionBuffer is the default number of decision records buffered while the sink is busy
+	DefaultDecisionBuffer = 4096
+
+	decisionAllow = "allow"
+	decisionDeny  = "deny"
+
+	lossReportInterval = 10 * time.Second // lossReportInterval is the interval at which dropped and failed decision records are reported in the operational logs
+)
+
+var droppedDecisions = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "jarl_decision_log_dropped_total",
+		Help: "No of decision records dropped because the decision log buffer was full",
+	},
+)
+
+var failedDecisions = promauto.NewCounter(
+	prometheus.CounterOpts{
+		Name: "jarl_decision_log_errors_total",
+		Help: "No of decision records the decision log sink failed to write",
+	},
+)
+
+// DecisionRecord is an entry of the decision log
+type DecisionRecord struct {
+	Schema     string        `json:"schema"`               // Schema is the DecisionSchema version of the record
+	Time       time.Time     `json:"time"`                 // Time is the time at which the decision was taken
+	Decision   string        `json:"decision"`             // Decision is either allow or deny
+	Reason     string        `json:"reason,omitempty"`     // Reason details why the request was denied
+	Code       string        `json:"code,omitempty"`       // Code classifies the deny reason
+	Rule       string        `json:"rule,omitempty"`       // Rule describes the rule which decided the outcome
+	DryRun     bool          `json:"dry_run,omitempty"`    // DryRun is true if the request was allowed by a dry-run policy but would have been denied otherwise
+	ClientID   string        `json:"client_id"`            // ClientID is the client identity carried by the request, missing if the request had none
+	Protocol   string        `json:"protocol"`             // Protocol is the check request protocol
+	TraceID    string        `json:"trace_id,omitempty"`   // TraceID is the trace the check request belongs to
+	Request    RequestRecord `json:"request"`              // Request describes the checked request
+	Attributes interface{}   `json:"attributes,omitempty"` // Attributes is the check request context as sent by Envoy
+
+	AttributesTruncated bool `json:"attributes_truncated,omitempty"` // AttributesTruncated is true if the request context exceeded the maximum size and was not logged
+}
+
+// RequestRecord describes the checked request of a decision record
+type RequestRecord struct {
+	Host    string            `json:"host"`
+	Path    string            `json:"path"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Outcome is the decision taken for a request
+type Outcome struct {
+	Allowed bool
+	Reason  string
+	Code    string
+	Rule    string
+	DryRun  bool
+}
+
+// NewDecisionRecord creates the decision record of a request outcome
+func NewDecisionRecord(outcome Outcome, context *Context) *DecisionRecord {
+	decision := decisionAllow
+	if !outcome.Allowed {
+		decision = decisionDeny
+	}
+	return &DecisionRecord{
+		Schema:   DecisionSchema,
+		Time:     time.Now().UTC(),
+		Decision: decision,
+		Reason:   outcome.Reason,
+		Code:     outcome.Code,
+		Rule:     outcome.Rule,
+		DryRun:   outcome.DryRun,
+		ClientID: context.ClientID,
+		Protocol: context.Protocol,
+		TraceID:  context.TraceID,
+		Request: RequestRecord{
+			Host:    context.Host,
+			Path:    context.Path,
+			Method:  context.Method,
+			Headers: context.Headers,
+		},
+		Attributes: context.RequestContext,
+	}
+}
+
+// Sink writes the decision records to their destination.
+// Sinks are only called from the decision log goroutine and may block, records are buffered meanwhile.
+type Sink interface {
+	Write(record *DecisionRecord) error
+	Close() error
+}
+
+// DecisionLog ships the decision records to a sink, separately from the operational logs.
+// Records are buffered and written asynchronously, Log never blocks: records are dropped when the buffer is full.
+type DecisionLog struct {
+	sink     Sink
+	redactor *Redactor
+	records  chan *DecisionRecord
+	done     chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+}
+
+// NewDecisionLog creates a decision log buffering up to size records and starts writing them to the provided sink.
+// Records are sanitized by the redactor before being written, the DefaultRedactor is used if nil.
+func NewDecisionLog(sink Sink, size int, redactor *Redactor) *DecisionLog {
+	if size <= 0 {
+		size = DefaultDecisionBuffer
+	}
+	l := &DecisionLog{
+		sink:     sink,
+		redactor: redactor,
+		records:  make(chan *DecisionRecord, size),
+		done:     make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Log queues the record, it is dropped and false is returned if the buffer is full or the log closed
+func (l *DecisionLog) Log(record *DecisionRecord) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if !l.closed {
+		select {
+		case l.records <- record:
+			return true
+		default:
+		}
+	}
+	l.dropped.Add(1)
+	droppedDecisions.Inc()
+	return false
+}
+
+// Dropped returns the number of records dropped since the decision log was created
+func (l *DecisionLog) Dropped() uint64 {
+	return l.dropped.Load()
+}
+
+// Failed returns the number of records the sink failed to write since the decision log was created
+func (l *DecisionLog) Failed() uint64 {
+	return l.failed.Load()
+}
+
+// Close stops accepting records, writes the buffered ones and closes the sink.
+// Records still buffered when the context is done are lost.
+func (l *DecisionLog) Close(ctx context.Context) error {
+	l.mu.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.records)
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-l.done:
+		return l.sink.Close()
+	case <-ctx.Done():
+		return fmt.Errorf("%d buffered decision records were not written: %w", len(l.records), ctx.Err())
+	}
+}
+
+// run writes the queued records until the log is closed, records losses are periodically reported
+func (l *DecisionLog) run() {
+	defer close(l.done)
+	ticker := time.NewTicker(lossReportInterval)
+	defer ticker.Stop()
+
+	var dropped, failed uint64
+	report := func() {
+		d, f := l.dropped.Load(), l.failed.Load()
+		if d > dropped || f > failed {
+			slog.Warn("decision records were lost", slog.Uint64("dropped", d-dropped), slog.Uint64("failed", f-failed))
+		}
+		dropped, failed = d, f
+	}
+	defer report()
+
+	for {
+		select {
+		case record, ok := <-l.records:
+			if !ok {
+				return
+			}
+			// Records are sanitized here rather than in Log to keep the check requests path short
+			l.redactor.Record(record)
+			if err := l.sink.Write(record); err != nil {
+				if l.failed.Add(1) == 1 {
+					slog.Error("unable to write decision record", slog.Any(KeyError, err))
+				}
+				failedDecisions.Inc()
+			}
+		case <-ticker.C:
+			report()
+		}
+	}
+}
+
+// decisionLog is the decision log LogRequest writes to
+var decisionLog atomic.Pointer[DecisionLog]
+
+// SetDecisionLog sets the decision log the request decisions are written to, decisions are discarded until it is set
+func SetDecisionLog(l *DecisionLog) {
+	decisionLog.Store(l)
+}
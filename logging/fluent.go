@@ -0,0 +1,179 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	fluentDialTimeout  = 5 * time.Second // fluentDialTimeout is the maximum time given to connect to the Fluent forward input
+	fluentWriteTimeout = 5 * time.Second // fluentWriteTimeout is the maximum time given to send a record
+)
+
+// fluentSink sends the records to a Fluentd / Fluent Bit forward input using the forward protocol message mode.
+// The connection is reestablished on the next record after a failure.
+type fluentSink struct {
+	address string
+	tag     string
+	conn    net.Conn
+	buf     bytes.Buffer
+}
+
+// NewFluentSink creates a sink sending the records with the provided tag to the forward input listening at address
+func NewFluentSink(address string, tag string) Sink {
+	if len(tag) == 0 {
+		tag = DefaultFluentTag
+	}
+	return &fluentSink{address: address, tag: tag}
+}
+
+func (s *fluentSink) Write(record *DecisionRecord) error {
+	s.buf.Reset()
+	if err := encodeFluentMessage(&s.buf, s.tag, record); err != nil {
+		return err
+	}
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout("tcp", s.address, fluentDialTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	err := s.conn.SetWriteDeadline(time.Now().Add(fluentWriteTimeout))
+	if err == nil {
+		_, err = s.conn.Write(s.buf.Bytes())
+	}
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *fluentSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// encodeFluentMessage encodes the record as a forward protocol message: [tag, EventTime, record]
+func encodeFluentMessage(buf *bytes.Buffer, tag string, record *DecisionRecord) error {
+	// The record is encoded through its JSON representation to keep the same field names in all the sinks
+	content, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var fields interface{}
+	if err := decoder.Decode(&fields); err != nil {
+		return err
+	}
+
+	buf.WriteByte(0x93)
+	encodeMsgpack(buf, tag)
+	// EventTime extension: type 0, seconds and nanoseconds as big endian 32 bits integers
+	buf.Write([]byte{0xd7, 0x00})
+	_ = binary.Write(buf, binary.BigEndian, uint32(record.Time.Unix()))
+	_ = binary.Write(buf, binary.BigEndian, uint32(record.Time.Nanosecond()))
+	return encodeMsgpack(buf, fields)
+}
+
+// encodeMsgpack encodes the values decoded from a JSON document in the MessagePack format
+func encodeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			encodeMsgpackInt(buf, i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte(0xcb)
+		_ = binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.Write([]byte{0xd9, byte(n)})
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			_ = binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			_ = binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(v)
+	case []interface{}:
+		encodeMsgpackHeader(buf, len(v), 0x90, 0xdc)
+		for _, item := range v {
+			if err := encodeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		encodeMsgpackHeader(buf, len(v), 0x80, 0xde)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			encodeMsgpack(buf, k)
+			if err := encodeMsgpack(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported msgpack value type %T", v)
+	}
+	return nil
+}
+
+// encodeMsgpackHeader writes an array or map header, fix is the fixarray/fixmap marker and long the 16 bits marker
+func encodeMsgpackHeader(buf *bytes.Buffer, n int, fix byte, long byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(long)
+		_ = binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(long + 1)
+		_ = binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+// encodeMsgpackInt writes an integer using its most compact representation
+func encodeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(i))
+	default:
+		buf.WriteByte(0xd3)
+		_ = binary.Write(buf, binary.BigEndian, i)
+	}
+}
@@ -2,14 +2,18 @@
 package logging
 
 import (
-	"fmt"
+	"bufio"
+	"encoding/json"
+	"io"
 	"log/slog"
 	"os"
+	"strings"
 
 	authv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
 	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 )
 
+// Keys of the decisions logged through slog before the DecisionSchema was introduced, ReadRequests still reads them
 const (
 	KeyError    = "error"             // KeyError represents the error attribute in structured logs
 	KeyMethod   = "http.method"       // KeyMethod is the logging key for the http method
@@ -23,6 +27,12 @@ const (
 	KeyReason   = "reason"            // KeyReason is the logging key for the deny reason
 )
 
+// MissingClientID is logged as the client identifier of the requests without authz header
+const MissingClientID = "missing"
+
+// maxLogLine is the maximum size of a decision log line, larger lines are skipped
+const maxLogLine = 1024 * 1024
+
 // Setup configures the logging environment
 func Setup() {
 	opts := &slog.HandlerOptions{
@@ -42,6 +52,7 @@ type Context struct {
 	Method         string
 	ClientID       string
 	Headers        map[string]string
+	TraceID        string
 	RequestContext interface{}
 }
 
@@ -73,24 +84,59 @@ func AuthV2LoggingContext(request *authv2.CheckRequest) *Context {
 	}
 }
 
-// LogRequest logs an inbout request details
-func LogRequest(allow bool, reason string, context *Context) {
-	outcome := "ALLOWED"
-	if !allow {
-		outcome = "DENIED"
+// LogRequest writes the request outcome to the decision log, the call never blocks
+func LogRequest(outcome Outcome, context *Context) {
+	if l := decisionLog.Load(); l != nil {
+		l.Log(NewDecisionRecord(outcome, context))
 	}
+}
 
-	msg := fmt.Sprintf("%s %s %s for '%s' from '%s'", context.Method, context.Path, outcome, context.ClientID, context.Host)
-
-	slog.Info(msg,
-		slog.Bool(KeyAllow, allow),
-		slog.String(KeyReason, reason),
-		slog.String(KeyHost, context.Host),
-		slog.String(KeyPath, context.Path),
-		slog.String(KeyMethod, context.Method),
-		slog.String(KeyClientID, context.ClientID),
-		slog.Any(KeyHeaders, context.Headers),
-		slog.String(KeyProtocol, context.Protocol),
-		slog.Any(KeyContext, context.RequestContext),
-	)
+// ReadRequests reads a JSON decision log and calls fn with the context of each logged request.
+// Both DecisionSchema records and the decisions formerly logged through slog are read.
+// Lines which are not request decisions are ignored, the request context attributes are not restored.
+func ReadRequests(r io.Reader, fn func(*Context)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLogLine)
+	for scanner.Scan() {
+		var line struct {
+			Schema   string            `json:"schema"`
+			Protocol string            `json:"request.protocol"`
+			Host     string            `json:"http.host"`
+			Path     *string           `json:"http.path"`
+			Method   string            `json:"http.method"`
+			ClientID string            `json:"request.client.id"`
+			Headers  map[string]string `json:"http.headers"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+		if strings.HasPrefix(line.Schema, decisionSchemaPrefix) {
+			var record DecisionRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				continue
+			}
+			fn(&Context{
+				Protocol: record.Protocol,
+				Host:     record.Request.Host,
+				Path:     record.Request.Path,
+				Method:   record.Request.Method,
+				ClientID: record.ClientID,
+				Headers:  record.Request.Headers,
+				TraceID:  record.TraceID,
+			})
+			continue
+		}
+		if line.Path == nil {
+			continue
+		}
+		fn(&Context{
+			Protocol: line.Protocol,
+			Host:     line.Host,
+			Path:     *line.Path,
+			Method:   line.Method,
+			ClientID: line.ClientID,
+			Headers:  line.Headers,
+		})
+	}
+	return scanner.Err()
 }
@@ -0,0 +1,313 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+func testContext() *Context {
+	return &Context{
+		Protocol: "V3",
+		Host:     "localhost",
+		Path:     "/berries",
+		Method:   "DELETE",
+		ClientID: "foo",
+		Headers:  map[string]string{"x-forwarded-sub": "foo"},
+		TraceID:  "4bf92f3577b34da6a3ce929d0e0e4736",
+	}
+}
+
+// blockingSink blocks writes until released
+type blockingSink struct {
+	release chan struct{}
+	written int
+}
+
+func (s *blockingSink) Write(*DecisionRecord) error {
+	<-s.release
+	s.written++
+	return nil
+}
+
+func (s *blockingSink) Close() error {
+	return nil
+}
+
+func TestDecisionLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewDecisionLog(NewWriterSink(&buf), 10, nil)
+	outcome := Outcome{Allowed: false, Reason: "foo is not authorized", Code: "path_denied", Rule: "DELETE on ^/berries$"}
+	assert.True(t, l.Log(NewDecisionRecord(outcome, testContext())))
+	assert.True(t, l.Log(NewDecisionRecord(Outcome{Allowed: true}, testContext())))
+	assert.NoError(t, l.Close(context.Background()))
+	assert.False(t, l.Log(NewDecisionRecord(outcome, testContext())), "records logged once closed are dropped")
+	assert.Equal(t, uint64(1), l.Dropped())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	var record map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, DecisionSchema, record["schema"])
+	assert.Equal(t, "deny", record["decision"])
+	assert.Equal(t, "foo is not authorized", record["reason"])
+	assert.Equal(t, "path_denied", record["code"])
+	assert.Equal(t, "DELETE on ^/berries$", record["rule"])
+	assert.Equal(t, "foo", record["client_id"])
+	assert.Equal(t, "V3", record["protocol"])
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", record["trace_id"])
+	assert.Equal(t, map[string]interface{}{
+		"host":    "localhost",
+		"path":    "/berries",
+		"method":  "DELETE",
+		"headers": map[string]interface{}{"x-forwarded-sub": "foo"},
+	}, record["request"])
+
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+	assert.Equal(t, "allow", record["decision"])
+}
+
+func TestDecisionLogNeverBlocks(t *testing.T) {
+	sink := &blockingSink{release: make(chan struct{})}
+	l := NewDecisionLog(sink, 2, nil)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			l.Log(NewDecisionRecord(Outcome{Allowed: true}, testContext()))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("logging blocked on a busy sink")
+	}
+	// One record is held by the sink, two are buffered
+	assert.GreaterOrEqual(t, l.Dropped(), uint64(97))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, l.Close(ctx), "closing gives up on a busy sink")
+
+	close(sink.release)
+	assert.NoError(t, l.Close(context.Background()))
+	assert.Equal(t, uint64(100), l.Dropped()+uint64(sink.written))
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "decisions.log")
+	record := NewDecisionRecord(Outcome{Allowed: true}, testContext())
+	line, err := jsonLine(record)
+	assert.NoError(t, err)
+
+	// Each file holds two records
+	sink, err := NewFileSink(path, int64(2*len(line)), 2)
+	assert.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		assert.NoError(t, sink.Write(record))
+	}
+	assert.NoError(t, sink.Close())
+
+	count := func(file string) int {
+		content, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		return strings.Count(string(content), "\n")
+	}
+	assert.Equal(t, 1, count(path))
+	assert.Equal(t, 2, count(path+".1"))
+	assert.Equal(t, 2, count(path+".2"))
+	assert.NoFileExists(t, path+".3")
+
+	// Reopened files are appended to
+	sink, err = NewFileSink(path, int64(2*len(line)), 2)
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Write(record))
+	assert.NoError(t, sink.Close())
+	assert.Equal(t, 2, count(path))
+}
+
+func TestFluentSink(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 4096)
+		n, _ := bufio.NewReader(conn).Read(buf)
+		received <- buf[:n]
+	}()
+
+	record := NewDecisionRecord(Outcome{Allowed: true}, testContext())
+	record.Time = time.Unix(1700000000, 5).UTC()
+	sink := NewFluentSink(listener.Addr().String(), "")
+	assert.NoError(t, sink.Write(record))
+	defer sink.Close()
+
+	var msg []byte
+	select {
+	case msg = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	// [tag, EventTime, record]
+	prefix := append([]byte{0x93, 0xa0 | byte(len(DefaultFluentTag))}, DefaultFluentTag...)
+	prefix = append(prefix, 0xd7, 0x00, 0x65, 0x53, 0xf1, 0x00, 0x00, 0x00, 0x00, 0x05)
+	assert.Equal(t, prefix, msg[:len(prefix)])
+	assert.Contains(t, string(msg), "client_id")
+	assert.Contains(t, string(msg), DecisionSchema)
+}
+
+func TestEncodeMsgpack(t *testing.T) {
+	for _, test := range []struct {
+		value    interface{}
+		expected []byte
+	}{
+		{nil, []byte{0xc0}},
+		{true, []byte{0xc3}},
+		{json.Number("5"), []byte{0x05}},
+		{json.Number("-1"), []byte{0xff}},
+		{json.Number("1000"), []byte{0xd3, 0, 0, 0, 0, 0, 0, 0x03, 0xe8}},
+		{json.Number("1.5"), []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"ab", []byte{0xa2, 'a', 'b'}},
+		{strings.Repeat("a", 40), append([]byte{0xd9, 40}, strings.Repeat("a", 40)...)},
+		{[]interface{}{"a", false}, []byte{0x92, 0xa1, 'a', 0xc2}},
+		{map[string]interface{}{"b": nil, "a": true}, []byte{0x82, 0xa1, 'a', 0xc3, 0xa1, 'b', 0xc0}},
+	} {
+		var buf bytes.Buffer
+		assert.NoError(t, encodeMsgpack(&buf, test.value))
+		assert.Equal(t, test.expected, buf.Bytes(), "%v", test.value)
+	}
+}
+
+func TestParseSinks(t *testing.T) {
+	sinks, err := ParseSinks("stdout, fluent")
+	assert.NoError(t, err)
+	assert.Equal(t, []SinkKind{SinkStdout, SinkFluent}, sinks)
+
+	_, err = ParseSinks("kafka")
+	assert.Error(t, err)
+}
+
+func TestReadRequests(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterSink(&buf)
+	assert.NoError(t, sink.Write(NewDecisionRecord(Outcome{Allowed: true}, testContext())))
+	buf.WriteString(`{"level":"INFO","msg":"starting"}` + "\n")
+	buf.WriteString(`{"msg":"GET /pokemon ALLOWED","http.host":"localhost","http.path":"/pokemon","http.method":"GET","request.client.id":"bar","request.protocol":"V2"}` + "\n")
+
+	contexts := make([]*Context, 0)
+	assert.NoError(t, ReadRequests(&buf, func(ctx *Context) { contexts = append(contexts, ctx) }))
+	assert.Len(t, contexts, 2)
+	assert.Equal(t, "foo", contexts[0].ClientID)
+	assert.Equal(t, "/berries", contexts[0].Path)
+	assert.Equal(t, "DELETE", contexts[0].Method)
+	assert.Equal(t, "foo", contexts[0].Headers["x-forwarded-sub"])
+	assert.Equal(t, "bar", contexts[1].ClientID)
+	assert.Equal(t, "/pokemon", contexts[1].Path)
+	assert.Equal(t, "V2", contexts[1].Protocol)
+}
+
+func TestRedactor(t *testing.T) {
+	headers := map[string]string{
+		"x-forwarded-sub":  "foo",
+		"authorization":    "Bearer s3cr3t",
+		"X-Session-Id":     "abc",
+		"x-internal":       "internal",
+		"content-type":     "application/json",
+		"x-github-api-key": "key",
+	}
+
+	r := NewRedactor(RedactionConfiguration{DenyHeaders: []string{"X-Internal"}, HashHeaders: []string{"x-forwarded-sub"}, RedactHeaders: []string{"content-type"}})
+	assert.Equal(t, map[string]string{
+		"x-forwarded-sub":  r.Hash("foo"),
+		"authorization":    Redacted,
+		"X-Session-Id":     Redacted,
+		"content-type":     Redacted,
+		"x-github-api-key": Redacted,
+	}, r.Headers(headers))
+	assert.Equal(t, "Bearer s3cr3t", headers["authorization"], "headers are copied")
+
+	r = NewRedactor(RedactionConfiguration{AllowHeaders: []string{"x-forwarded-sub", "authorization"}})
+	assert.Equal(t, map[string]string{"x-forwarded-sub": "foo", "authorization": Redacted}, r.Headers(headers))
+
+	// Explicitly hashed secret headers are hashed
+	r = NewRedactor(RedactionConfiguration{HashHeaders: []string{"authorization"}})
+	assert.Equal(t, r.Hash("Bearer s3cr3t"), r.Headers(headers)["authorization"])
+
+	var defaults *Redactor
+	assert.Equal(t, Redacted, defaults.Headers(headers)["authorization"])
+	assert.Equal(t, "foo", defaults.ClientID("foo"))
+
+	// Hashes are keyed
+	plain := NewRedactor(RedactionConfiguration{HashClientID: true})
+	keyed := NewRedactor(RedactionConfiguration{HashClientID: true, HashKey: "key"})
+	assert.True(t, strings.HasPrefix(plain.ClientID("foo"), "sha256:"))
+	assert.Len(t, plain.ClientID("foo"), len("sha256:")+32)
+	assert.NotEqual(t, plain.ClientID("foo"), keyed.ClientID("foo"))
+	assert.Equal(t, keyed.ClientID("foo"), keyed.ClientID("foo"))
+	assert.Equal(t, MissingClientID, keyed.ClientID(MissingClientID))
+}
+
+func TestRedactedRecord(t *testing.T) {
+	attrs := &authv3.AttributeContext{
+		Request: &authv3.AttributeContext_Request{
+			Http: &authv3.AttributeContext_HttpRequest{
+				Host:    "localhost",
+				Path:    "/berries",
+				Method:  "POST",
+				Headers: map[string]string{"x-forwarded-sub": "foo", "cookie": "s3cr3t"},
+				Body:    strings.Repeat("b", 512),
+			},
+		},
+	}
+	ctx := testContext()
+	ctx.Headers = attrs.Request.Http.Headers
+	ctx.RequestContext = attrs
+
+	var buf bytes.Buffer
+	l := NewDecisionLog(NewWriterSink(&buf), 10, NewRedactor(RedactionConfiguration{HashClientID: true, HashHeaders: []string{"x-forwarded-sub"}, MaxContextSize: 256}))
+	l.Log(NewDecisionRecord(Outcome{Allowed: false, Reason: "foo is not authorized to access POST /berries/food"}, ctx))
+	assert.NoError(t, l.Close(context.Background()))
+	line := buf.String()
+	assert.NotContains(t, line, "s3cr3t")
+	assert.NotContains(t, line, `"foo"`)
+	assert.NotContains(t, line, "bbbb", "the body exceeding the maximum context size is removed")
+	assert.Contains(t, line, `"path":"/berries"`)
+	assert.Equal(t, "s3cr3t", attrs.Request.Http.Headers["cookie"], "the request context is copied")
+
+	var record DecisionRecord
+	assert.NoError(t, json.Unmarshal([]byte(line), &record))
+	assert.Equal(t, Redacted, record.Request.Headers["cookie"])
+	assert.NotContains(t, record.Reason, "foo ")
+	assert.Equal(t, record.ClientID+" is not authorized to access POST /berries/food", record.Reason, "the identity quoted by the reason is hashed")
+	assert.Equal(t, "no authz configuration defined for h", replaceWord("no authz configuration defined for foo", "foo", "h"))
+	assert.Equal(t, "h is not authorized to access GET /foo/food", replaceWord("foo is not authorized to access GET /foo/food", "foo", "h"))
+	assert.False(t, record.AttributesTruncated)
+
+	// Contexts which do not fit without body are not logged
+	buf.Reset()
+	l = NewDecisionLog(NewWriterSink(&buf), 10, NewRedactor(RedactionConfiguration{MaxContextSize: 16}))
+	l.Log(NewDecisionRecord(Outcome{Allowed: true}, ctx))
+	assert.NoError(t, l.Close(context.Background()))
+	var truncated DecisionRecord
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &truncated))
+	assert.Nil(t, truncated.Attributes)
+	assert.True(t, truncated.AttributesTruncated)
+}
@@ -0,0 +1,275 @@
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	authv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// DefaultMaxContextSize is the default maximum size in bytes of the logged request context
+	DefaultMaxContextSize = 16 * 1024
+
+	// Redacted replaces the value of the secret headers
+	Redacted = "[REDACTED]"
+
+	hashPrefix = "sha256:" // hashPrefix marks the hashed values
+	hashSize   = 16        // hashSize is the number of bytes of the digest which are kept
+)
+
+// secretHeaders are the headers known to carry credentials, they are always redacted unless explicitly hashed
+var secretHeaders = []string{"authorization", "proxy-authorization", "cookie", "set-cookie", "x-api-key", "x-auth-token", "x-csrf-token", "x-xsrf-token", "x-amz-security-token"}
+
+// secretHeaderHints are the words hinting that a header carries credentials
+var secretHeaderHints = []string{"token", "secret", "password", "passwd", "apikey", "api-key", "credential", "session"}
+
+// RedactionConfiguration configures how the requests are sanitized before being logged or echoed back
+type RedactionConfiguration struct {
+	AllowHeaders   []string // AllowHeaders lists the only headers which are kept, all the headers are kept if empty
+	DenyHeaders    []string // DenyHeaders lists the headers which are removed
+	RedactHeaders  []string // RedactHeaders lists the headers whose value is redacted, in addition to the known secret headers
+	HashHeaders    []string // HashHeaders lists the headers whose value is replaced by its hash, identifiers remain correlatable without being disclosed
+	HashClientID   bool     // HashClientID replaces the logged client identifiers by their hash
+	HashKey        string   // HashKey keys the hashes (HMAC-SHA256) so that they cannot be reversed by hashing the known identifiers, plain SHA-256 if empty
+	MaxContextSize int      // MaxContextSize is the maximum size in bytes of the request context, the body is removed first and the whole context if it is still too large, unlimited if 0
+}
+
+// Redactor sanitizes the requests headers, identifiers and context.
+// A nil Redactor applies the DefaultRedactor rules.
+type Redactor struct {
+	allow          map[string]bool
+	deny           map[string]bool
+	redact         map[string]bool
+	hash           map[string]bool
+	hashClientID   bool
+	key            []byte
+	maxContextSize int
+}
+
+// defaultRedactor redacts the known secret headers and limits the request context to DefaultMaxContextSize
+var defaultRedactor = NewRedactor(RedactionConfiguration{MaxContextSize: DefaultMaxContextSize})
+
+// DefaultRedactor returns the redactor applied when none is configured
+func DefaultRedactor() *Redactor {
+	return defaultRedactor
+}
+
+// NewRedactor creates a redactor applying the provided configuration, header names are case insensitive
+func NewRedactor(conf RedactionConfiguration) *Redactor {
+	r := &Redactor{
+		allow:          headerSet(conf.AllowHeaders),
+		deny:           headerSet(conf.DenyHeaders),
+		redact:         headerSet(conf.RedactHeaders),
+		hash:           headerSet(conf.HashHeaders),
+		hashClientID:   conf.HashClientID,
+		maxContextSize: conf.MaxContextSize,
+	}
+	if len(conf.HashKey) > 0 {
+		r.key = []byte(conf.HashKey)
+	}
+	return r
+}
+
+// headerSet lowercases the provided header names
+func headerSet(headers []string) map[string]bool {
+	set := make(map[string]bool, len(headers))
+	for _, h := range headers {
+		set[strings.ToLower(strings.TrimSpace(h))] = true
+	}
+	return set
+}
+
+func (r *Redactor) orDefault() *Redactor {
+	if r == nil {
+		return defaultRedactor
+	}
+	return r
+}
+
+// secret returns true if the header is known to carry credentials
+func secret(header string) bool {
+	for _, h := range secretHeaders {
+		if header == h {
+			return true
+		}
+	}
+	for _, hint := range secretHeaderHints {
+		if strings.Contains(header, hint) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hash returns the hash of the provided value
+func (r *Redactor) Hash(value string) string {
+	r = r.orDefault()
+	var sum []byte
+	if r.key != nil {
+		mac := hmac.New(sha256.New, r.key)
+		mac.Write([]byte(value))
+		sum = mac.Sum(nil)
+	} else {
+		digest := sha256.Sum256([]byte(value))
+		sum = digest[:]
+	}
+	return hashPrefix + hex.EncodeToString(sum[:hashSize])
+}
+
+// ClientID returns the client identifier as it should be logged, the missing identity marker is never hashed
+func (r *Redactor) ClientID(clientID string) string {
+	r = r.orDefault()
+	if !r.hashClientID || len(clientID) == 0 || clientID == MissingClientID {
+		return clientID
+	}
+	return r.Hash(clientID)
+}
+
+// Headers returns a sanitized copy of the headers: headers which are not allowed or denied are removed,
+// explicitly redacted headers are redacted, hashed headers are hashed and the remaining secret headers are redacted
+func (r *Redactor) Headers(headers map[string]string) map[string]string {
+	r = r.orDefault()
+	if headers == nil {
+		return nil
+	}
+	sanitized := make(map[string]string, len(headers))
+	for k, v := range headers {
+		name := strings.ToLower(k)
+		switch {
+		case len(r.allow) > 0 && !r.allow[name], r.deny[name]:
+			continue
+		case r.redact[name]:
+			sanitized[k] = Redacted
+		case r.hash[name]:
+			sanitized[k] = r.Hash(v)
+		case secret(name):
+			sanitized[k] = Redacted
+		default:
+			sanitized[k] = v
+		}
+	}
+	return sanitized
+}
+
+// RequestContext returns a copy of the Envoy check request attributes whose headers are sanitized.
+// Attributes of unknown types are returned as is.
+func (r *Redactor) RequestContext(attrs interface{}) interface{} {
+	switch a := attrs.(type) {
+	case *authv3.AttributeContext:
+		if a == nil {
+			return attrs
+		}
+		clone := proto.Clone(a).(*authv3.AttributeContext)
+		if http := clone.GetRequest().GetHttp(); http != nil {
+			http.Headers = r.Headers(http.Headers)
+		}
+		return clone
+	case *authv2.AttributeContext:
+		if a == nil {
+			return attrs
+		}
+		clone := proto.Clone(a).(*authv2.AttributeContext)
+		if http := clone.GetRequest().GetHttp(); http != nil {
+			http.Headers = r.Headers(http.Headers)
+		}
+		return clone
+	default:
+		return attrs
+	}
+}
+
+// Fit encodes the request context within the maximum context size.
+// The request body is removed when the encoded context is too large, false is returned if it still does not fit.
+func (r *Redactor) Fit(attrs interface{}, encode func(interface{}) (string, error)) (string, bool) {
+	r = r.orDefault()
+	encoded, err := encode(attrs)
+	if err != nil {
+		return "", false
+	}
+	if r.maxContextSize <= 0 || len(encoded) <= r.maxContextSize {
+		return encoded, true
+	}
+	if !removeBody(attrs) {
+		return "", false
+	}
+	encoded, err = encode(attrs)
+	if err != nil || len(encoded) > r.maxContextSize {
+		return "", false
+	}
+	return encoded, true
+}
+
+// removeBody removes the request body from the check request attributes, false is returned if there was none
+func removeBody(attrs interface{}) bool {
+	switch a := attrs.(type) {
+	case *authv3.AttributeContext:
+		http := a.GetRequest().GetHttp()
+		if http == nil || (len(http.Body) == 0 && len(http.RawBody) == 0) {
+			return false
+		}
+		http.Body, http.RawBody = "", nil
+		return true
+	case *authv2.AttributeContext:
+		http := a.GetRequest().GetHttp()
+		if http == nil || len(http.Body) == 0 {
+			return false
+		}
+		http.Body = ""
+		return true
+	default:
+		return false
+	}
+}
+
+// Record sanitizes the decision record identifiers, headers and request context.
+// Hashed client identifiers are also replaced in the deny reason which quotes them.
+func (r *Redactor) Record(record *DecisionRecord) {
+	r = r.orDefault()
+	if hashed := r.ClientID(record.ClientID); hashed != record.ClientID {
+		record.Reason = replaceWord(record.Reason, record.ClientID, hashed)
+		record.ClientID = hashed
+	}
+	record.Request.Headers = r.Headers(record.Request.Headers)
+	if record.Attributes == nil {
+		return
+	}
+	encoded, ok := r.Fit(r.RequestContext(record.Attributes), encodeJSON)
+	if !ok {
+		record.Attributes = nil
+		record.AttributesTruncated = true
+		return
+	}
+	record.Attributes = json.RawMessage(encoded)
+}
+
+// replaceWord replaces the occurrences of word delimited by spaces or the string boundaries
+func replaceWord(s string, word string, replacement string) string {
+	var sb strings.Builder
+	for {
+		i := strings.Index(s, word)
+		if i < 0 {
+			sb.WriteString(s)
+			return sb.String()
+		}
+		end := i + len(word)
+		if (i == 0 || s[i-1] == ' ') && (end == len(s) || s[end] == ' ') {
+			sb.WriteString(s[:i])
+			sb.WriteString(replacement)
+		} else {
+			sb.WriteString(s[:end])
+		}
+		s = s[end:]
+	}
+}
+
+// encodeJSON encodes the request context as it is written in the decision records
+func encodeJSON(v interface{}) (string, error) {
+	content, err := json.Marshal(v)
+	return string(content), err
+}
@@ -0,0 +1,233 @@
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SinkKind is the destination of the decision records
+type SinkKind string
+
+const (
+	SinkNone   SinkKind = "none"   // SinkNone discards the decision records
+	SinkStdout SinkKind = "stdout" // SinkStdout writes the decision records as JSON lines to the standard output
+	SinkFile   SinkKind = "file"   // SinkFile writes the decision records as JSON lines to a size rotated file
+	SinkSyslog SinkKind = "syslog" // SinkSyslog sends the decision records to a syslog daemon
+	SinkFluent SinkKind = "fluent" // SinkFluent sends the decision records to a Fluentd / Fluent Bit forward input
+
+	// DefaultFluentTag is the default tag of the decision records sent to Fluent
+	DefaultFluentTag = "jarl.decision"
+)
+
+// SinkConfiguration configures the decision log sinks
+type SinkConfiguration struct {
+	Sinks          []SinkKind // Sinks lists the destinations each decision record is written to
+	File           string     // File is the path of the file sink
+	FileMaxSize    int64      // FileMaxSize is the size in bytes after which the file is rotated, never rotated if 0
+	FileMaxBackups int        // FileMaxBackups is the number of rotated files which are kept
+	Syslog         string     // Syslog is the syslog daemon address as udp://host:port or tcp://host:port, the local daemon if empty
+	Fluent         string     // Fluent is the host:port of the Fluent forward input
+	FluentTag      string     // FluentTag is the tag of the records sent to Fluent
+}
+
+// ParseSinks validates the comma separated list of sink kinds
+func ParseSinks(sinks string) ([]SinkKind, error) {
+	kinds := make([]SinkKind, 0)
+	for _, s := range strings.Split(sinks, ",") {
+		switch k := SinkKind(strings.TrimSpace(s)); k {
+		case SinkNone, SinkStdout, SinkFile, SinkSyslog, SinkFluent:
+			kinds = append(kinds, k)
+		case "":
+		default:
+			return nil, fmt.Errorf("unsupported decision log sink '%s', expected none, stdout, file, syslog or fluent", s)
+		}
+	}
+	return kinds, nil
+}
+
+// NewSink creates the sink writing the decision records to all the configured destinations
+func NewSink(conf SinkConfiguration) (Sink, error) {
+	sinks := make(multiSink, 0, len(conf.Sinks))
+	for _, kind := range conf.Sinks {
+		var sink Sink
+		var err error
+		switch kind {
+		case SinkNone:
+			continue
+		case SinkStdout:
+			sink = NewWriterSink(os.Stdout)
+		case SinkFile:
+			sink, err = NewFileSink(conf.File, conf.FileMaxSize, conf.FileMaxBackups)
+		case SinkSyslog:
+			sink, err = NewSyslogSink(conf.Syslog)
+		case SinkFluent:
+			sink = NewFluentSink(conf.Fluent, conf.FluentTag)
+		default:
+			err = fmt.Errorf("unsupported decision log sink '%s'", kind)
+		}
+		if err != nil {
+			sinks.Close()
+			return nil, fmt.Errorf("unable to create the %s decision log sink: %w", kind, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
+
+// multiSink writes the records to several sinks
+type multiSink []Sink
+
+func (m multiSink) Write(record *DecisionRecord) error {
+	errs := make([]error, 0)
+	for _, s := range m {
+		if err := s.Write(record); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiSink) Close() error {
+	errs := make([]error, 0)
+	for _, s := range m {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writerSink writes the records as JSON lines
+type writerSink struct {
+	w io.Writer
+}
+
+// NewWriterSink creates a sink writing the records as JSON lines to the provided writer
+func NewWriterSink(w io.Writer) Sink {
+	return &writerSink{w: w}
+}
+
+func (s *writerSink) Write(record *DecisionRecord) error {
+	line, err := jsonLine(record)
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(line)
+	return err
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// jsonLine encodes the record as a newline terminated JSON document
+func jsonLine(record *DecisionRecord) ([]byte, error) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// fileSink writes the records as JSON lines to a file rotated once it reaches its maximum size.
+// Rotated files are suffixed with .1 for the most recent up to .maxBackups for the oldest.
+type fileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewFileSink creates a sink writing the records to the provided file, rotated after maxSize bytes keeping maxBackups files
+func NewFileSink(path string, maxSize int64, maxBackups int) (Sink, error) {
+	if len(path) == 0 {
+		return nil, errors.New("the decision log file path is empty")
+	}
+	s := &fileSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o750); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+// rotate shifts the rotated files, moves the current file to .1 and reopens an empty file
+func (s *fileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	if s.maxBackups <= 0 {
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+		return s.open()
+	}
+	for i := s.maxBackups - 1; i > 0; i-- {
+		if err := os.Rename(s.backup(i), s.backup(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, s.backup(1)); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// backup returns the path of the i-th rotated file
+func (s *fileSink) backup(i int) string {
+	return fmt.Sprintf("%s.%d", s.path, i)
+}
+
+func (s *fileSink) Write(record *DecisionRecord) error {
+	line, err := jsonLine(record)
+	if err != nil {
+		return err
+	}
+	if s.file == nil {
+		// A previous rotation failed, try to resume writing to the file
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+func (s *fileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,47 @@
+//go:build !windows && !plan9
+
+package logging
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+)
+
+// syslogTag is the tag of the syslog messages
+const syslogTag = "jarl"
+
+// syslogSink sends the records as JSON messages to a syslog daemon
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// NewSyslogSink creates a sink sending the records to the syslog daemon listening at the provided udp:// or tcp:// address,
+// the local daemon is used if the address is empty
+func NewSyslogSink(address string) (Sink, error) {
+	network, raddr := "", ""
+	if len(address) > 0 {
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || len(u.Host) == 0 {
+			return nil, fmt.Errorf("invalid syslog address '%s', expected udp://host:port or tcp://host:port", address)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_AUTH, syslogTag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(record *DecisionRecord) error {
+	line, err := jsonLine(record)
+	if err != nil {
+		return err
+	}
+	return s.w.Info(string(line))
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
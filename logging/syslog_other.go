@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package logging
+
+import "errors"
+
+// NewSyslogSink is not supported on this platform
+func NewSyslogSink(address string) (Sink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,277 @@
+package mesh
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/fredjeck/jarl/authz"
+	"github.com/fredjeck/jarl/tracing"
+)
+
+const (
+	// DefaultProvider is the name of the generated Istio extension provider and Envoy cluster
+	DefaultProvider = "jarl-ext-authz-grpc"
+	// DefaultService is the host name the mesh uses to reach a jarl sidecar
+	DefaultService = "jarl-authz-grpc.local"
+	// DefaultTimeout is the timeout of the check requests sent by the mesh
+	DefaultTimeout = 500 * time.Millisecond
+)
+
+// Manifest is a generated configuration snippet
+type Manifest struct {
+	Name    string // Name is the file name of the snippet
+	Content []byte
+}
+
+// Wiring describes how the mesh reaches the jarl gRPC check API.
+// The HTTP check API is not used as it does not evaluate the client configurations.
+type Wiring struct {
+	Provider    string            // Provider is the name of the Istio extension provider and Envoy cluster
+	Service     string            // Service is the host name Istio uses to reach jarl
+	Address     string            // Address is the IP address jarl listens on, a ServiceEntry is generated for Istio if set
+	Port        int               // Port is the jarl gRPC port
+	Socket      string            // Socket is the path of the jarl gRPC unix domain socket, replaces Address and Port for Envoy
+	Namespace   string            // Namespace of the generated Istio resources, the workloads namespace
+	Selector    map[string]string // Selector lists the labels of the workloads protected by jarl, all workloads of the namespace if empty
+	Headers     []string          // Headers lists the request headers forwarded by Envoy, the identity header first and the trace context headers
+	Timeout     time.Duration     // Timeout is the timeout of the check requests
+	FailOpen    bool              // FailOpen allows the requests when jarl cannot be reached
+	Hosts       []string          // Hosts lists the hosts checked by jarl, all hosts if empty
+	MaxBodySize int               // MaxBodySize is the size of the request bodies forwarded to jarl, bodies are not forwarded if 0
+}
+
+// NewWiring creates the wiring of a jarl sidecar listening on the provided gRPC port
+func NewWiring(port int, header string) *Wiring {
+	return &Wiring{
+		Provider: DefaultProvider,
+		Service:  DefaultService,
+		Address:  "127.0.0.1",
+		Port:     port,
+		Headers:  append([]string{header, "content-type"}, traceHeaders()...),
+		Timeout:  DefaultTimeout,
+	}
+}
+
+// traceHeaders returns the trace context headers extracted by jarl, which link the check spans to the caller traces
+func traceHeaders() []string {
+	fields := tracing.Propagator().Fields()
+	sort.Strings(fields)
+	return fields
+}
+
+// Configure scopes the wiring to the hosts of the provided clients and forwards the request bodies if a client inspects them.
+// The returned notes explain why the wiring could not be scoped to the client hosts.
+func (w *Wiring) Configure(clients []*authz.Authorization) []string {
+	notes := make([]string, 0)
+	hosts := make([]string, 0)
+	scoped := len(clients) > 0
+	w.MaxBodySize = 0
+	for _, client := range clients {
+		if len(client.Hosts) == 0 {
+			notes = append(notes, fmt.Sprintf("client '%s' has no hosts, jarl checks the requests of all hosts", client.ClientID))
+			scoped = false
+		}
+		for _, h := range client.Hosts {
+			if !slices.Contains(hosts, h) {
+				hosts = append(hosts, h)
+			}
+		}
+		if client.GraphQL != nil || client.JSONRPC != nil {
+			w.MaxBodySize = max(w.MaxBodySize, client.MaxBodySize, authz.DefaultMaxBodySize)
+		}
+	}
+	if len(clients) == 0 {
+		notes = append(notes, "no client is configured, jarl checks the requests of all hosts")
+	}
+	w.Hosts = nil
+	if scoped {
+		sort.Strings(hosts)
+		w.Hosts = hosts
+	}
+	return notes
+}
+
+// Istio returns the mesh configuration extension provider, the ServiceEntry and the CUSTOM AuthorizationPolicy
+// delegating the checks to jarl
+func (w *Wiring) Istio() ([]Manifest, error) {
+	if len(w.Socket) > 0 {
+		return nil, fmt.Errorf("istio extension providers cannot reach jarl through the unix domain socket '%s'", w.Socket)
+	}
+	manifests := make([]Manifest, 0, 3)
+	for _, t := range []struct{ name, template string }{
+		{"mesh-config.yaml", istioMeshConfig},
+		{"serviceentry.yaml", istioServiceEntry},
+		{"authorizationpolicy.yaml", istioAuthorizationPolicy},
+	} {
+		if t.template == istioServiceEntry && len(w.Address) == 0 {
+			continue
+		}
+		content, err := w.render(t.template)
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, Manifest{Name: t.name, Content: content})
+	}
+	return manifests, nil
+}
+
+// Envoy returns the ext_authz HTTP filter and the cluster delegating the checks to jarl
+func (w *Wiring) Envoy() ([]Manifest, error) {
+	filter, err := w.render(envoyFilter)
+	if err != nil {
+		return nil, err
+	}
+	cluster, err := w.render(envoyCluster)
+	if err != nil {
+		return nil, err
+	}
+	return []Manifest{{Name: "envoy-ext-authz-filter.yaml", Content: filter}, {Name: "envoy-cluster.yaml", Content: cluster}}, nil
+}
+
+func (w *Wiring) render(text string) ([]byte, error) {
+	t, err := template.New("wiring").Funcs(template.FuncMap{
+		"quote":    strconv.Quote,
+		"duration": func(d time.Duration) string { return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s" },
+		"lower":    strings.ToLower,
+		"selector": func() []string {
+			labels := make([]string, 0, len(w.Selector))
+			for k, v := range w.Selector {
+				labels = append(labels, fmt.Sprintf("%s: %s", k, strconv.Quote(v)))
+			}
+			sort.Strings(labels)
+			return labels
+		},
+	}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, w); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+const istioMeshConfig = `# Extension provider to merge into the mesh configuration
+# (the mesh entry of the istio ConfigMap or the spec.meshConfig of the IstioOperator)
+extensionProviders:
+- name: {{ quote .Provider }}
+  envoyExtAuthzGrpc:
+    service: {{ quote .Service }}
+    port: "{{ .Port }}"
+    timeout: {{ duration .Timeout }}
+    failOpen: {{ .FailOpen }}
+{{- if gt .MaxBodySize 0 }}
+    includeRequestBodyInCheck:
+      maxRequestBytes: {{ .MaxBodySize }}
+      allowPartialMessage: false
+{{- end }}
+`
+
+const istioServiceEntry = `# Service entry for the jarl sidecar gRPC check API
+apiVersion: networking.istio.io/v1
+kind: ServiceEntry
+metadata:
+  name: {{ .Provider }}
+{{- if .Namespace }}
+  namespace: {{ .Namespace }}
+{{- end }}
+spec:
+  hosts:
+  - {{ quote .Service }}
+  endpoints:
+  - address: {{ quote .Address }}
+  ports:
+  - name: grpc
+    number: {{ .Port }}
+    protocol: GRPC
+  resolution: STATIC
+`
+
+const istioAuthorizationPolicy = `# Delegates the authorization of the requests to jarl
+apiVersion: security.istio.io/v1
+kind: AuthorizationPolicy
+metadata:
+  name: {{ .Provider }}
+{{- if .Namespace }}
+  namespace: {{ .Namespace }}
+{{- end }}
+spec:
+{{- with selector }}
+  selector:
+    matchLabels:
+{{- range . }}
+      {{ . }}
+{{- end }}
+{{- end }}
+  action: CUSTOM
+  provider:
+    name: {{ quote .Provider }}
+  rules:
+{{- if .Hosts }}
+  - to:
+    - operation:
+        hosts:
+{{- range .Hosts }}
+        - {{ quote . }}
+{{- end }}
+{{- else }}
+  - {}
+{{- end }}
+`
+
+const envoyFilter = `# ext_authz HTTP filter, to insert before the envoy.filters.http.router filter
+name: envoy.filters.http.ext_authz
+typed_config:
+  "@type": type.googleapis.com/envoy.extensions.filters.http.ext_authz.v3.ExtAuthz
+  transport_api_version: V3
+  failure_mode_allow: {{ .FailOpen }}
+  grpc_service:
+    envoy_grpc:
+      cluster_name: {{ quote .Provider }}
+    timeout: {{ duration .Timeout }}
+{{- if .Headers }}
+  allowed_headers:
+    patterns:
+{{- range .Headers }}
+    - exact: {{ quote (lower .) }}
+      ignore_case: true
+{{- end }}
+{{- end }}
+{{- if gt .MaxBodySize 0 }}
+  with_request_body:
+    max_request_bytes: {{ .MaxBodySize }}
+    allow_partial_message: false
+{{- end }}
+`
+
+const envoyCluster = `# Cluster reaching the jarl gRPC check API
+name: {{ quote .Provider }}
+type: STATIC
+connect_timeout: 0.25s
+typed_extension_protocol_options:
+  envoy.extensions.upstreams.http.v3.HttpProtocolOptions:
+    "@type": type.googleapis.com/envoy.extensions.upstreams.http.v3.HttpProtocolOptions
+    explicit_http_config:
+      http2_protocol_options: {}
+load_assignment:
+  cluster_name: {{ quote .Provider }}
+  endpoints:
+  - lb_endpoints:
+    - endpoint:
+        address:
+{{- if .Socket }}
+          pipe:
+            path: {{ quote .Socket }}
+{{- else }}
+          socket_address:
+            address: {{ quote .Address }}
+            port_value: {{ .Port }}
+{{- end }}
+`
@@ -0,0 +1,476 @@
+// Package mesh - Istio and Envoy service mesh integration
+package mesh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/fredjeck/jarl/authz"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	actionAllow = "ALLOW"
+	actionDeny  = "DENY"
+
+	authorizationPolicyKind = "AuthorizationPolicy"
+)
+
+// Issue reports an AuthorizationPolicy construct which could not be translated into a jarl client configuration
+type Issue struct {
+	Policy  string // Policy is the namespace/name of the AuthorizationPolicy
+	Message string
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%s: %s", i.Policy, i.Message)
+}
+
+// IstioImporter translates Istio AuthorizationPolicy resources into jarl client configurations.
+//
+// Each rule principal becomes a client whose paths are the rule operations. Request principals are identified
+// by their subject and `when` conditions on the identity header, source.principal or request.auth.principal
+// narrow the rule principals. Every construct jarl cannot express is reported as an Issue.
+type IstioImporter struct {
+	Header string  // Header is the HTTP header identifying the clients, its `when` conditions are translated to clients
+	Issues []Issue // Issues lists the constructs which could not be translated
+
+	clients map[string]*importedClient
+}
+
+// importedClient accumulates the rules of a single client per action
+type importedClient struct {
+	id       string
+	policies []string
+	rules    map[string]*importedRules
+}
+
+type importedRules struct {
+	paths     []authz.PathConfig
+	seen      map[authz.PathConfig]bool
+	hosts     []string
+	anyHost   bool            // anyHost is true if one of the rules applies to all hosts
+	hostRules map[string]bool // hostRules lists the distinct host sets the rules are restricted to
+}
+
+type authorizationPolicy struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+	Spec struct {
+		Selector   map[string]interface{} `yaml:"selector"`
+		TargetRef  map[string]interface{} `yaml:"targetRef"`
+		TargetRefs []interface{}          `yaml:"targetRefs"`
+		Action     string                 `yaml:"action"`
+		Rules      []istioRule            `yaml:"rules"`
+	} `yaml:"spec"`
+}
+
+type istioRule struct {
+	From []struct {
+		Source istioSource `yaml:"source"`
+	} `yaml:"from"`
+	To []struct {
+		Operation istioOperation `yaml:"operation"`
+	} `yaml:"to"`
+	When []istioCondition `yaml:"when"`
+}
+
+type istioSource struct {
+	Principals           []string `yaml:"principals"`
+	NotPrincipals        []string `yaml:"notPrincipals"`
+	RequestPrincipals    []string `yaml:"requestPrincipals"`
+	NotRequestPrincipals []string `yaml:"notRequestPrincipals"`
+	Namespaces           []string `yaml:"namespaces"`
+	NotNamespaces        []string `yaml:"notNamespaces"`
+	IPBlocks             []string `yaml:"ipBlocks"`
+	NotIPBlocks          []string `yaml:"notIpBlocks"`
+	RemoteIPBlocks       []string `yaml:"remoteIpBlocks"`
+	NotRemoteIPBlocks    []string `yaml:"notRemoteIpBlocks"`
+}
+
+type istioOperation struct {
+	Hosts      []string `yaml:"hosts"`
+	NotHosts   []string `yaml:"notHosts"`
+	Ports      []string `yaml:"ports"`
+	NotPorts   []string `yaml:"notPorts"`
+	Methods    []string `yaml:"methods"`
+	NotMethods []string `yaml:"notMethods"`
+	Paths      []string `yaml:"paths"`
+	NotPaths   []string `yaml:"notPaths"`
+}
+
+type istioCondition struct {
+	Key       string   `yaml:"key"`
+	Values    []string `yaml:"values"`
+	NotValues []string `yaml:"notValues"`
+}
+
+// NewIstioImporter creates an importer translating the conditions on the provided identity header
+func NewIstioImporter(header string) *IstioImporter {
+	return &IstioImporter{
+		Header:  header,
+		Issues:  make([]Issue, 0),
+		clients: make(map[string]*importedClient),
+	}
+}
+
+// Read translates the AuthorizationPolicy resources of the provided multi-documents yaml stream, other resources are ignored
+func (imp *IstioImporter) Read(r io.Reader) error {
+	decoder := yaml.NewDecoder(r)
+	for {
+		var policy authorizationPolicy
+		err := decoder.Decode(&policy)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid AuthorizationPolicy document: %w", err)
+		}
+		if policy.Kind != authorizationPolicyKind {
+			continue
+		}
+		imp.importPolicy(&policy)
+	}
+}
+
+// Clients returns the translated client configurations sorted by clientID.
+// Clients with both ALLOW and DENY rules keep their ALLOW rules as jarl clients have a single mode.
+func (imp *IstioImporter) Clients() []*authz.ClientConfig {
+	ids := make([]string, 0, len(imp.clients))
+	for id := range imp.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	configs := make([]*authz.ClientConfig, 0, len(ids))
+	for _, id := range ids {
+		client := imp.clients[id]
+		action, mode := actionAllow, authz.ModeAllow
+		if _, ok := client.rules[actionAllow]; !ok {
+			action, mode = actionDeny, authz.ModeDeny
+		}
+		rules := client.rules[action]
+		config := &authz.ClientConfig{ClientID: id, Mode: mode, Paths: rules.paths}
+		if !rules.anyHost {
+			config.Hosts = rules.hosts
+		}
+		configs = append(configs, config)
+	}
+	return configs
+}
+
+// Sources returns the namespace/name of the policies the provided client was translated from
+func (imp *IstioImporter) Sources(clientID string) []string {
+	if client, ok := imp.clients[clientID]; ok {
+		return client.policies
+	}
+	return nil
+}
+
+// Report returns the issues detected once all the policies were read, including the conflicts between policies
+func (imp *IstioImporter) Report() []Issue {
+	issues := append(make([]Issue, 0, len(imp.Issues)), imp.Issues...)
+	for _, config := range imp.Clients() {
+		client := imp.clients[config.ClientID]
+		policies := strings.Join(client.policies, ", ")
+		if _, ok := client.rules[actionDeny]; ok && config.Mode == authz.ModeAllow {
+			issues = append(issues, Issue{Policy: policies, Message: fmt.Sprintf("client '%s' has ALLOW and DENY rules, jarl clients have a single mode and the DENY rules were dropped", config.ClientID)})
+		}
+		rules := client.rules[actionAllow]
+		if rules != nil && rules.anyHost && len(rules.hostRules) > 0 {
+			issues = append(issues, Issue{Policy: policies, Message: fmt.Sprintf("client '%s' has rules restricted to some hosts and rules for all hosts, jarl hosts apply to all the client paths and the host restrictions were dropped", config.ClientID)})
+		}
+		if rules != nil && !rules.anyHost && len(rules.hostRules) > 1 {
+			issues = append(issues, Issue{Policy: policies, Message: fmt.Sprintf("client '%s' rules are restricted to different hosts, jarl hosts apply to all the client paths", config.ClientID)})
+		}
+	}
+	return issues
+}
+
+func (imp *IstioImporter) report(policy string, format string, a ...interface{}) {
+	imp.Issues = append(imp.Issues, Issue{Policy: policy, Message: fmt.Sprintf(format, a...)})
+}
+
+// importPolicy translates the rules of a single policy
+func (imp *IstioImporter) importPolicy(policy *authorizationPolicy) {
+	name := policy.Metadata.Name
+	if len(policy.Metadata.Namespace) > 0 {
+		name = policy.Metadata.Namespace + "/" + name
+	}
+
+	action := strings.ToUpper(policy.Spec.Action)
+	if len(action) == 0 {
+		action = actionAllow
+	}
+	if action != actionAllow && action != actionDeny {
+		imp.report(name, "action '%s' is not supported, the policy was skipped", action)
+		return
+	}
+	if len(policy.Spec.Selector) > 0 || len(policy.Spec.TargetRef) > 0 || len(policy.Spec.TargetRefs) > 0 {
+		imp.report(name, "workload selectors are not supported, the policy rules apply to every workload using jarl")
+	}
+	if len(policy.Spec.Rules) == 0 {
+		imp.report(name, "policy has no rules and matches no request, use the jarl default policy instead")
+		return
+	}
+
+	for i, rule := range policy.Spec.Rules {
+		imp.importRule(name, fmt.Sprintf("rule %d", i), action, rule)
+	}
+}
+
+// importRule adds the rule operations to the paths of every client identified by the rule
+func (imp *IstioImporter) importRule(policy string, ruleName string, action string, rule istioRule) {
+	clients, ok := imp.ruleClients(policy, ruleName, rule)
+	if !ok {
+		imp.report(policy, "%s does not identify any client, it was skipped", ruleName)
+		return
+	}
+
+	operations := make([]istioOperation, 0, len(rule.To))
+	for _, to := range rule.To {
+		operations = append(operations, to.Operation)
+	}
+	if len(operations) == 0 {
+		operations = append(operations, istioOperation{})
+	}
+
+	for _, op := range operations {
+		paths, hosts := imp.operationPaths(policy, ruleName, action, op)
+		if len(paths) == 0 {
+			continue
+		}
+		for _, id := range clients {
+			client, ok := imp.clients[id]
+			if !ok {
+				client = &importedClient{id: id, rules: make(map[string]*importedRules)}
+				imp.clients[id] = client
+			}
+			if len(client.policies) == 0 || client.policies[len(client.policies)-1] != policy {
+				client.policies = append(client.policies, policy)
+			}
+			rules, ok := client.rules[action]
+			if !ok {
+				rules = &importedRules{seen: make(map[authz.PathConfig]bool), hostRules: make(map[string]bool)}
+				client.rules[action] = rules
+			}
+			rules.add(paths, hosts)
+		}
+	}
+}
+
+func (r *importedRules) add(paths []authz.PathConfig, hosts []string) {
+	for _, p := range paths {
+		if !r.seen[p] {
+			r.seen[p] = true
+			r.paths = append(r.paths, p)
+		}
+	}
+	if len(hosts) == 0 {
+		r.anyHost = true
+		return
+	}
+	sorted := slices.Clone(hosts)
+	slices.Sort(sorted)
+	r.hostRules[strings.Join(sorted, ",")] = true
+	for _, h := range hosts {
+		if !slices.Contains(r.hosts, h) {
+			r.hosts = append(r.hosts, h)
+		}
+	}
+}
+
+// ruleClients returns the clients identified by the rule sources and conditions, false if the rule identifies no client
+func (imp *IstioImporter) ruleClients(policy string, ruleName string, rule istioRule) ([]string, bool) {
+	var principals []string
+	for _, from := range rule.From {
+		s := from.Source
+		unsupported := map[string][]string{
+			"notPrincipals": s.NotPrincipals, "notRequestPrincipals": s.NotRequestPrincipals,
+			"namespaces": s.Namespaces, "notNamespaces": s.NotNamespaces,
+			"ipBlocks": s.IPBlocks, "notIpBlocks": s.NotIPBlocks,
+			"remoteIpBlocks": s.RemoteIPBlocks, "notRemoteIpBlocks": s.NotRemoteIPBlocks,
+		}
+		for _, field := range sortedKeys(unsupported) {
+			if len(unsupported[field]) > 0 {
+				imp.report(policy, "%s source.%s is not supported and was ignored", ruleName, field)
+			}
+		}
+		principals = append(principals, imp.principals(policy, ruleName, s.Principals, false)...)
+		principals = append(principals, imp.principals(policy, ruleName, s.RequestPrincipals, true)...)
+	}
+
+	var conditions []string
+	identified := false
+	for _, when := range rule.When {
+		if !imp.isIdentityKey(when.Key) {
+			imp.report(policy, "%s condition on '%s' is not supported and was ignored", ruleName, when.Key)
+			continue
+		}
+		if len(when.NotValues) > 0 {
+			imp.report(policy, "%s condition notValues on '%s' is not supported and was ignored", ruleName, when.Key)
+		}
+		values := imp.principals(policy, ruleName, when.Values, strings.HasPrefix(when.Key, "request.auth."))
+		if identified {
+			conditions = intersect(conditions, values)
+		} else {
+			conditions, identified = values, true
+		}
+	}
+
+	switch {
+	case len(principals) > 0 && identified:
+		principals = intersect(principals, conditions)
+	case identified:
+		principals = conditions
+	}
+	principals = unique(principals)
+	return principals, len(principals) > 0
+}
+
+// principals returns the exact principals, request principals are identified by their subject
+func (imp *IstioImporter) principals(policy string, ruleName string, values []string, request bool) []string {
+	ids := make([]string, 0, len(values))
+	for _, v := range values {
+		if strings.Contains(v, "*") {
+			imp.report(policy, "%s principal '%s' uses wildcards which are not supported, it was ignored", ruleName, v)
+			continue
+		}
+		if request {
+			if i := strings.LastIndex(v, "/"); i >= 0 {
+				v = v[i+1:]
+			}
+		}
+		ids = append(ids, v)
+	}
+	return ids
+}
+
+// isIdentityKey returns true if the condition key identifies the client
+func (imp *IstioImporter) isIdentityKey(key string) bool {
+	switch key {
+	case "source.principal", "request.auth.principal":
+		return true
+	}
+	return len(imp.Header) > 0 && strings.EqualFold(key, fmt.Sprintf("request.headers[%s]", imp.Header))
+}
+
+// operationPaths translates the operation into jarl paths and hosts
+func (imp *IstioImporter) operationPaths(policy string, ruleName string, action string, op istioOperation) ([]authz.PathConfig, []string) {
+	unsupported := map[string][]string{"notHosts": op.NotHosts, "ports": op.Ports, "notPorts": op.NotPorts, "notMethods": op.NotMethods, "notPaths": op.NotPaths}
+	for _, field := range sortedKeys(unsupported) {
+		if len(unsupported[field]) > 0 {
+			imp.report(policy, "%s operation.%s is not supported and was ignored", ruleName, field)
+		}
+	}
+
+	methods := make([]string, 0, len(op.Methods))
+	for _, m := range op.Methods {
+		if m == "*" {
+			methods = nil
+			break
+		}
+		if authz.ParseHTTPMethod(m) == authz.HTTPMethodUnknown {
+			imp.report(policy, "%s method '%s' is not supported and was ignored", ruleName, m)
+			continue
+		}
+		methods = append(methods, strings.ToUpper(m))
+	}
+	if len(op.Methods) > 0 && methods != nil && len(methods) == 0 {
+		imp.report(policy, "%s operation has no supported method, it was skipped", ruleName)
+		return nil, nil
+	}
+
+	paths := make([]authz.PathConfig, 0, len(op.Paths))
+	for _, p := range op.Paths {
+		paths = append(paths, authz.PathConfig{Path: pathRegex(p), Methods: strings.Join(methods, ", ")})
+	}
+	if len(paths) == 0 {
+		paths = append(paths, authz.PathConfig{Path: ".*", Methods: strings.Join(methods, ", ")})
+	}
+
+	hosts := make([]string, 0, len(op.Hosts))
+	for _, h := range op.Hosts {
+		if strings.Contains(h, "*") {
+			imp.report(policy, "%s host '%s' uses wildcards which are not supported, it was ignored", ruleName, h)
+			continue
+		}
+		hosts = append(hosts, h)
+	}
+	// jarl hosts restrict the hosts a client may access, they cannot scope deny rules
+	if action == actionDeny && len(hosts) > 0 {
+		imp.report(policy, "%s hosts cannot scope DENY rules, the rule applies to all hosts", ruleName)
+		hosts = nil
+	}
+	return paths, hosts
+}
+
+// pathEnd ends the anchored path regexes, Envoy paths include the query string which Istio path matching ignores
+const pathEnd = `(\?.*)?$`
+
+// pathRegex translates an Istio path (exact, prefix*, *suffix, * or {*} / {**} templates) into an anchored regex
+func pathRegex(path string) string {
+	switch {
+	case path == "*":
+		return ".*"
+	case strings.Contains(path, "{*}") || strings.Contains(path, "{**}"):
+		var rx strings.Builder
+		rx.WriteString("^")
+		for i, part := range strings.Split(path, "{**}") {
+			if i > 0 {
+				rx.WriteString(".*")
+			}
+			for j, segment := range strings.Split(part, "{*}") {
+				if j > 0 {
+					rx.WriteString("[^/]+")
+				}
+				rx.WriteString(regexp.QuoteMeta(segment))
+			}
+		}
+		rx.WriteString(pathEnd)
+		return rx.String()
+	case strings.HasSuffix(path, "*"):
+		return "^" + regexp.QuoteMeta(strings.TrimSuffix(path, "*"))
+	case strings.HasPrefix(path, "*"):
+		return regexp.QuoteMeta(strings.TrimPrefix(path, "*")) + pathEnd
+	default:
+		return "^" + regexp.QuoteMeta(path) + pathEnd
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func unique(values []string) []string {
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if !slices.Contains(result, v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+func intersect(a []string, b []string) []string {
+	result := make([]string, 0)
+	for _, v := range a {
+		if slices.Contains(b, v) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,372 @@
+package mesh
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	extauthz "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ext_authz/v3"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+	"github.com/fredjeck/jarl/authz"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+const istioPolicies = `
+apiVersion: security.istio.io/v1
+kind: AuthorizationPolicy
+metadata:
+  name: pokedex
+  namespace: pokemon
+spec:
+  action: ALLOW
+  rules:
+  - from:
+    - source:
+        principals: ["cluster.local/ns/pokemon/sa/ash"]
+        requestPrincipals: ["https://issuer.example.com/misty"]
+    to:
+    - operation:
+        hosts: ["pokedex.local"]
+        methods: ["GET", "HEAD"]
+        paths: ["/pokemon/*", "/berries", "/items/{*}/price"]
+  - when:
+    - key: request.headers[x-forwarded-sub]
+      values: ["brock"]
+    to:
+    - operation:
+        hosts: ["pokedex.local"]
+        methods: ["POST"]
+        paths: ["*/encounters"]
+  - from:
+    - source:
+        namespaces: ["pokemon"]
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ignored
+---
+apiVersion: security.istio.io/v1
+kind: AuthorizationPolicy
+metadata:
+  name: deny-delete
+  namespace: pokemon
+spec:
+  action: DENY
+  selector:
+    matchLabels:
+      app: pokedex
+  rules:
+  - from:
+    - source:
+        principals: ["team-rocket", "cluster.local/ns/pokemon/sa/ash"]
+    to:
+    - operation:
+        methods: ["DELETE"]
+        notPaths: ["/public/*"]
+    when:
+    - key: source.ip
+      values: ["10.0.0.1"]
+---
+apiVersion: security.istio.io/v1
+kind: AuthorizationPolicy
+metadata:
+  name: ext-authz
+spec:
+  action: CUSTOM
+  provider:
+    name: jarl
+  rules:
+  - {}
+`
+
+func TestIstioImport(t *testing.T) {
+	imp := NewIstioImporter("x-forwarded-sub")
+	assert.NoError(t, imp.Read(strings.NewReader(istioPolicies)))
+
+	clients := imp.Clients()
+	assert.Len(t, clients, 4)
+	byID := make(map[string]*authz.ClientConfig)
+	for _, c := range clients {
+		byID[c.ClientID] = c
+	}
+
+	ash := byID["cluster.local/ns/pokemon/sa/ash"]
+	assert.Equal(t, authz.ModeAllow, ash.Mode)
+	assert.Equal(t, []string{"pokedex.local"}, ash.Hosts)
+	assert.Equal(t, []authz.PathConfig{
+		{Path: `^/pokemon/`, Methods: "GET, HEAD"},
+		{Path: `^/berries(\?.*)?$`, Methods: "GET, HEAD"},
+		{Path: `^/items/[^/]+/price(\?.*)?$`, Methods: "GET, HEAD"},
+	}, ash.Paths)
+	assert.Equal(t, []string{"pokemon/pokedex", "pokemon/deny-delete"}, imp.Sources(ash.ClientID))
+
+	misty := byID["misty"]
+	assert.Equal(t, ash.Paths, misty.Paths)
+
+	brock := byID["brock"]
+	assert.Equal(t, []authz.PathConfig{{Path: `/encounters(\?.*)?$`, Methods: "POST"}}, brock.Paths)
+
+	rocket := byID["team-rocket"]
+	assert.Equal(t, authz.ModeDeny, rocket.Mode)
+	assert.Empty(t, rocket.Hosts)
+	assert.Equal(t, []authz.PathConfig{{Path: ".*", Methods: "DELETE"}}, rocket.Paths)
+
+	report := make([]string, 0)
+	for _, issue := range imp.Report() {
+		report = append(report, issue.String())
+	}
+	assert.Equal(t, []string{
+		"pokemon/pokedex: rule 2 source.namespaces is not supported and was ignored",
+		"pokemon/pokedex: rule 2 does not identify any client, it was skipped",
+		"pokemon/deny-delete: workload selectors are not supported, the policy rules apply to every workload using jarl",
+		"pokemon/deny-delete: rule 0 condition on 'source.ip' is not supported and was ignored",
+		"pokemon/deny-delete: rule 0 operation.notPaths is not supported and was ignored",
+		"ext-authz: action 'CUSTOM' is not supported, the policy was skipped",
+		"pokemon/pokedex, pokemon/deny-delete: client 'cluster.local/ns/pokemon/sa/ash' has ALLOW and DENY rules, jarl clients have a single mode and the DENY rules were dropped",
+	}, report)
+
+	// Imported configurations are valid jarl client configurations
+	content, err := ash.Marshal()
+	assert.NoError(t, err)
+	auth, err := authz.NewAuthorizationFromYaml(content)
+	assert.NoError(t, err)
+	assert.Empty(t, auth.Warnings)
+	allowed := func(path string, method authz.HTTPMethod) bool {
+		return auth.IsRequestAllowed(&authz.Request{Host: "pokedex.local", Path: path, Method: method}) == nil
+	}
+	assert.True(t, allowed("/pokemon/pikachu", authz.HTTPMethodGet))
+	assert.True(t, allowed("/items/potion/price", authz.HTTPMethodHead))
+	assert.False(t, allowed("/items/potion/stock/price", authz.HTTPMethodGet))
+	assert.False(t, allowed("/berries/oran", authz.HTTPMethodGet))
+	assert.False(t, allowed("/berries", authz.HTTPMethodPost))
+}
+
+func TestIstioImportHosts(t *testing.T) {
+	imp := NewIstioImporter("")
+	assert.NoError(t, imp.Read(strings.NewReader(`
+kind: AuthorizationPolicy
+metadata:
+  name: hosts
+spec:
+  rules:
+  - from:
+    - source:
+        principals: ["ash"]
+    to:
+    - operation:
+        hosts: ["a.local", "*.pokemon.local"]
+        paths: ["/a"]
+    - operation:
+        hosts: ["b.local"]
+        methods: ["FETCH"]
+  - from:
+    - source:
+        principals: ["misty"]
+    to:
+    - operation:
+        hosts: ["a.local"]
+    - operation:
+        paths: ["/b"]
+`)))
+
+	clients := imp.Clients()
+	assert.Equal(t, []string{"a.local"}, clients[0].Hosts)
+	assert.Empty(t, clients[1].Hosts)
+
+	report := make([]string, 0)
+	for _, issue := range imp.Report() {
+		report = append(report, issue.String())
+	}
+	assert.Equal(t, []string{
+		"hosts: rule 0 host '*.pokemon.local' uses wildcards which are not supported, it was ignored",
+		"hosts: rule 0 method 'FETCH' is not supported and was ignored",
+		"hosts: rule 0 operation has no supported method, it was skipped",
+		"hosts: client 'misty' has rules restricted to some hosts and rules for all hosts, jarl hosts apply to all the client paths and the host restrictions were dropped",
+	}, report)
+}
+
+func TestPathRegex(t *testing.T) {
+	assert.Equal(t, ".*", pathRegex("*"))
+	assert.Equal(t, `^/a\.b(\?.*)?$`, pathRegex("/a.b"))
+	assert.Equal(t, `^/a/`, pathRegex("/a/*"))
+	assert.Equal(t, `\.json(\?.*)?$`, pathRegex("*.json"))
+	assert.Equal(t, `^/a/[^/]+/b/.*(\?.*)?$`, pathRegex("/a/{*}/b/{**}"))
+}
+
+func TestIstioImportQuery(t *testing.T) {
+	imp := NewIstioImporter("")
+	assert.NoError(t, imp.Read(strings.NewReader(`
+kind: AuthorizationPolicy
+metadata:
+  name: deny-admin
+spec:
+  action: DENY
+  rules:
+  - from:
+    - source:
+        principals: ["ash"]
+    to:
+    - operation:
+        paths: ["/admin", "*.bak"]
+---
+kind: AuthorizationPolicy
+metadata:
+  name: allow-ok
+spec:
+  rules:
+  - from:
+    - source:
+        principals: ["misty"]
+    to:
+    - operation:
+        paths: ["/ok", "/items/{*}"]
+`)))
+
+	allowed := func(client *authz.ClientConfig, path string) bool {
+		content, err := client.Marshal()
+		assert.NoError(t, err)
+		auth, err := authz.NewAuthorizationFromYaml(content)
+		assert.NoError(t, err)
+		return auth.IsRequestAllowed(&authz.Request{Host: "localhost", Path: path, Method: authz.HTTPMethodGet}) == nil
+	}
+
+	// Istio ignores the query string when matching paths, imported rules do as well
+	clients := imp.Clients()
+	assert.Len(t, clients, 2)
+	ash, misty := clients[0], clients[1]
+	assert.False(t, allowed(ash, "/admin"))
+	assert.False(t, allowed(ash, "/admin?x"))
+	assert.False(t, allowed(ash, "/db.bak?download=1"))
+	assert.True(t, allowed(ash, "/administrator"))
+	assert.True(t, allowed(misty, "/ok"))
+	assert.True(t, allowed(misty, "/ok?q=1"))
+	assert.True(t, allowed(misty, "/items/potion?q=1"))
+	assert.False(t, allowed(misty, "/okay"))
+}
+
+func TestWiringConfigure(t *testing.T) {
+	client := func(id string, hosts ...string) *authz.Authorization {
+		auth := authz.NewAuthorization()
+		auth.ClientID = id
+		auth.Hosts = hosts
+		return auth
+	}
+
+	w := NewWiring(9000, "x-forwarded-sub")
+	assert.Empty(t, w.Configure([]*authz.Authorization{client("ash", "b.local", "a.local"), client("misty", "a.local")}))
+	assert.Equal(t, []string{"a.local", "b.local"}, w.Hosts)
+	assert.Zero(t, w.MaxBodySize)
+
+	graphql := client("brock")
+	graphql.GraphQL = &authz.BodyInspection{}
+	graphql.MaxBodySize = 1024 * 1024
+	assert.Equal(t, []string{"client 'brock' has no hosts, jarl checks the requests of all hosts"}, w.Configure([]*authz.Authorization{client("ash", "a.local"), graphql}))
+	assert.Empty(t, w.Hosts)
+	assert.Equal(t, 1024*1024, w.MaxBodySize)
+
+	assert.Len(t, w.Configure(nil), 1)
+	assert.Empty(t, w.Hosts)
+}
+
+func TestIstioWiring(t *testing.T) {
+	w := NewWiring(9000, "x-forwarded-sub")
+	w.Namespace = "pokemon"
+	w.Selector = map[string]string{"app": "pokedex", "version": "v1"}
+	w.Hosts = []string{"pokedex.local"}
+	manifests, err := w.Istio()
+	assert.NoError(t, err)
+	assert.Len(t, manifests, 3)
+
+	var mesh struct {
+		ExtensionProviders []struct {
+			Name              string `yaml:"name"`
+			EnvoyExtAuthzGrpc struct {
+				Service string `yaml:"service"`
+				Port    string `yaml:"port"`
+				Timeout string `yaml:"timeout"`
+			} `yaml:"envoyExtAuthzGrpc"`
+		} `yaml:"extensionProviders"`
+	}
+	assert.NoError(t, yaml.Unmarshal(manifests[0].Content, &mesh))
+	assert.Equal(t, DefaultProvider, mesh.ExtensionProviders[0].Name)
+	assert.Equal(t, DefaultService, mesh.ExtensionProviders[0].EnvoyExtAuthzGrpc.Service)
+	assert.Equal(t, "9000", mesh.ExtensionProviders[0].EnvoyExtAuthzGrpc.Port)
+	assert.Equal(t, "0.5s", mesh.ExtensionProviders[0].EnvoyExtAuthzGrpc.Timeout)
+
+	var entry map[string]interface{}
+	assert.NoError(t, yaml.Unmarshal(manifests[1].Content, &entry))
+	assert.Equal(t, "ServiceEntry", entry["kind"])
+	assert.Equal(t, 9000, entry["spec"].(map[string]interface{})["ports"].([]interface{})[0].(map[string]interface{})["number"])
+
+	var policy authorizationPolicy
+	assert.NoError(t, yaml.Unmarshal(manifests[2].Content, &policy))
+	assert.Equal(t, "CUSTOM", policy.Spec.Action)
+	assert.Equal(t, map[string]interface{}{"app": "pokedex", "version": "v1"}, policy.Spec.Selector["matchLabels"])
+	assert.Equal(t, []string{"pokedex.local"}, policy.Spec.Rules[0].To[0].Operation.Hosts)
+
+	// Unscoped policies apply to all the requests of the workloads
+	w.Hosts, w.Selector, w.Address = nil, nil, ""
+	manifests, err = w.Istio()
+	assert.NoError(t, err)
+	assert.Len(t, manifests, 2)
+	policy = authorizationPolicy{}
+	assert.NoError(t, yaml.Unmarshal(manifests[1].Content, &policy))
+	assert.Len(t, policy.Spec.Rules, 1)
+	assert.Empty(t, policy.Spec.Rules[0].To)
+	assert.Empty(t, policy.Spec.Selector)
+
+	w.Socket = "/var/run/jarl/grpc.sock"
+	_, err = w.Istio()
+	assert.Error(t, err)
+}
+
+// protoFromYaml parses the yaml snippet into the provided envoy configuration message
+func protoFromYaml(t *testing.T, content []byte, m proto.Message) {
+	var v interface{}
+	assert.NoError(t, yaml.Unmarshal(content, &v))
+	js, err := json.Marshal(v)
+	assert.NoError(t, err)
+	assert.NoError(t, protojson.Unmarshal(js, m))
+}
+
+func TestEnvoyWiring(t *testing.T) {
+	w := NewWiring(9000, "X-Forwarded-Sub")
+	w.MaxBodySize = 1024
+	manifests, err := w.Envoy()
+	assert.NoError(t, err)
+
+	var filter hcm.HttpFilter
+	protoFromYaml(t, manifests[0].Content, &filter)
+	var extAuthz extauthz.ExtAuthz
+	assert.NoError(t, filter.GetTypedConfig().UnmarshalTo(&extAuthz))
+	assert.Equal(t, DefaultProvider, extAuthz.GetGrpcService().GetEnvoyGrpc().GetClusterName())
+	assert.Equal(t, DefaultTimeout, extAuthz.GetGrpcService().GetTimeout().AsDuration())
+	assert.Equal(t, "x-forwarded-sub", extAuthz.GetAllowedHeaders().GetPatterns()[0].GetExact())
+	forwarded := make([]string, 0)
+	for _, p := range extAuthz.GetAllowedHeaders().GetPatterns() {
+		forwarded = append(forwarded, p.GetExact())
+	}
+	assert.Subset(t, forwarded, []string{"content-type", "traceparent", "tracestate", "b3", "x-b3-traceid", "x-b3-spanid", "x-b3-sampled"})
+	assert.Equal(t, uint32(1024), extAuthz.GetWithRequestBody().GetMaxRequestBytes())
+	assert.False(t, extAuthz.GetFailureModeAllow())
+
+	var c cluster.Cluster
+	protoFromYaml(t, manifests[1].Content, &c)
+	assert.Equal(t, DefaultProvider, c.GetName())
+	address := c.GetLoadAssignment().GetEndpoints()[0].GetLbEndpoints()[0].GetEndpoint().GetAddress()
+	assert.Equal(t, uint32(9000), address.GetSocketAddress().GetPortValue())
+
+	w.Socket = "/var/run/jarl/grpc.sock"
+	manifests, err = w.Envoy()
+	assert.NoError(t, err)
+	c = cluster.Cluster{}
+	protoFromYaml(t, manifests[1].Content, &c)
+	address = c.GetLoadAssignment().GetEndpoints()[0].GetLbEndpoints()[0].GetEndpoint().GetAddress()
+	assert.Equal(t, w.Socket, address.GetPipe().GetPath())
+}
@@ -0,0 +1,245 @@
+// Package openapi - OpenAPI 3 documents support
+package openapi
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/fredjeck/jarl/authz"
+	"gopkg.in/yaml.v3"
+)
+
+// Document is the subset of an OpenAPI 3 document describing the API surface
+type Document struct {
+	OpenAPI string `yaml:"openapi"`
+	Info    struct {
+		Title   string `yaml:"title"`
+		Version string `yaml:"version"`
+	} `yaml:"info"`
+	Servers []Server            `yaml:"servers"`
+	Paths   map[string]PathItem `yaml:"paths"`
+}
+
+// Server is an API server, its URL path prefixes the API paths
+type Server struct {
+	URL string `yaml:"url"`
+}
+
+// PathItem describes the operations available on a single path
+type PathItem struct {
+	Parameters []Parameter `yaml:"parameters"`
+	Servers    []Server    `yaml:"servers"`
+	Get        *operation  `yaml:"get"`
+	Put        *operation  `yaml:"put"`
+	Post       *operation  `yaml:"post"`
+	Delete     *operation  `yaml:"delete"`
+	Options    *operation  `yaml:"options"`
+	Head       *operation  `yaml:"head"`
+	Patch      *operation  `yaml:"patch"`
+	Trace      *operation  `yaml:"trace"`
+}
+
+type operation struct {
+	OperationID string      `yaml:"operationId"`
+	Tags        []string    `yaml:"tags"`
+	Roles       []string    `yaml:"x-jarl-roles"`
+	Parameters  []Parameter `yaml:"parameters"`
+	Servers     []Server    `yaml:"servers"`
+}
+
+// Parameter is an operation parameter, only path parameters are used
+type Parameter struct {
+	Name   string `yaml:"name"`
+	In     string `yaml:"in"`
+	Schema struct {
+		Type string `yaml:"type"`
+	} `yaml:"schema"`
+}
+
+// Operation is an API operation
+type Operation struct {
+	Method   authz.HTTPMethod
+	Path     string // Path is the operation path template, prefixed with the server base path
+	ID       string
+	Tags     []string
+	Roles    []string        // Roles lists the roles of the x-jarl-roles extension
+	Integers map[string]bool // Integers lists the integer path parameters
+	regex    *regexp.Regexp
+}
+
+// Selection selects operations by tag, operationId or role, an empty selection selects all the operations
+type Selection struct {
+	Tags         []string
+	OperationIDs []string
+	Roles        []string
+}
+
+// Empty returns true if the selection selects all the operations
+func (s Selection) Empty() bool {
+	return len(s.Tags) == 0 && len(s.OperationIDs) == 0 && len(s.Roles) == 0
+}
+
+// Matches returns true if the operation has one of the selected tags, operationIds or roles
+func (s Selection) Matches(op *Operation) bool {
+	if s.Empty() || slices.Contains(s.OperationIDs, op.ID) {
+		return true
+	}
+	for _, t := range op.Tags {
+		if slices.Contains(s.Tags, t) {
+			return true
+		}
+	}
+	for _, r := range op.Roles {
+		if slices.Contains(s.Roles, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Load reads the OpenAPI 3 document stored at the provided path, yaml and json documents are supported
+func Load(file string) (*Document, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(content)
+}
+
+// Parse parses an OpenAPI 3 yaml or json document
+func Parse(content []byte) (*Document, error) {
+	var doc Document
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document: %w", err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, errors.New("only OpenAPI 3 documents are supported")
+	}
+	return &doc, nil
+}
+
+// BasePath returns the path of the first server URL, empty if the document declares no server
+func BasePath(servers []Server) string {
+	if len(servers) == 0 {
+		return ""
+	}
+	u, err := url.Parse(servers[0].URL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
+// Operations returns the document operations sorted by path and method.
+// The paths are prefixed with the operation, path or document server base path.
+func (doc *Document) Operations() []*Operation {
+	paths := make([]string, 0, len(doc.Paths))
+	for p := range doc.Paths {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	operations := make([]*Operation, 0)
+	for _, p := range paths {
+		item := doc.Paths[p]
+		for _, m := range []struct {
+			method authz.HTTPMethod
+			op     *operation
+		}{
+			{authz.HTTPMethodGet, item.Get}, {authz.HTTPMethodHead, item.Head}, {authz.HTTPMethodPost, item.Post},
+			{authz.HTTPMethodPut, item.Put}, {authz.HTTPMethodPatch, item.Patch}, {authz.HTTPMethodDelete, item.Delete},
+			{authz.HTTPMethodOptions, item.Options}, {authz.HTTPMethodTrace, item.Trace},
+		} {
+			if m.op == nil {
+				continue
+			}
+			servers := doc.Servers
+			for _, s := range [][]Server{item.Servers, m.op.Servers} {
+				if len(s) > 0 {
+					servers = s
+				}
+			}
+			op := &Operation{
+				Method:   m.method,
+				Path:     BasePath(servers) + p,
+				ID:       m.op.OperationID,
+				Tags:     m.op.Tags,
+				Roles:    m.op.Roles,
+				Integers: make(map[string]bool),
+			}
+			for _, param := range append(slices.Clone(item.Parameters), m.op.Parameters...) {
+				if param.In == "path" {
+					op.Integers[param.Name] = param.Schema.Type == "integer"
+				}
+			}
+			op.regex = regexp.MustCompile(op.Regex())
+			operations = append(operations, op)
+		}
+	}
+	return operations
+}
+
+var templateParameter = regexp.MustCompile(`\{([^}]+)\}`)
+
+// Regex returns the anchored regex matching the operation path, integer parameters only match digits.
+// The path may be followed by a query string since Envoy paths include it.
+func (op *Operation) Regex() string {
+	var rx strings.Builder
+	rx.WriteString("^")
+	last := 0
+	for _, m := range templateParameter.FindAllStringSubmatchIndex(op.Path, -1) {
+		rx.WriteString(regexp.QuoteMeta(op.Path[last:m[0]]))
+		if op.Integers[op.Path[m[2]:m[3]]] {
+			rx.WriteString("-?[0-9]+")
+		} else {
+			rx.WriteString("[^/]+")
+		}
+		last = m[1]
+	}
+	rx.WriteString(regexp.QuoteMeta(op.Path[last:]))
+	rx.WriteString(`(\?.*)?$`)
+	return rx.String()
+}
+
+// Sample returns a concrete path of the operation, integer parameters are replaced by 1 and the other ones by their name
+func (op *Operation) Sample() string {
+	return templateParameter.ReplaceAllStringFunc(op.Path, func(p string) string {
+		name := strings.Trim(p, "{}")
+		if op.Integers[name] {
+			return "1"
+		}
+		return name
+	})
+}
+
+// Matches returns true if the provided request path matches the operation path template
+func (op *Operation) Matches(path string) bool {
+	return op.regex.MatchString(path)
+}
+
+// Client returns the configuration of a client allowed to call the selected operations.
+// Operations sharing the same path are grouped into a single path with all their methods.
+func (doc *Document) Client(clientID string, hosts []string, selection Selection) *authz.ClientConfig {
+	config := &authz.ClientConfig{ClientID: clientID, Hosts: hosts, Mode: authz.ModeAllow}
+	index := make(map[string]int)
+	for _, op := range doc.Operations() {
+		if !selection.Matches(op) {
+			continue
+		}
+		rx := op.Regex()
+		i, ok := index[rx]
+		if !ok {
+			index[rx] = len(config.Paths)
+			config.Paths = append(config.Paths, authz.PathConfig{Path: rx, Methods: string(op.Method)})
+			continue
+		}
+		config.Paths[i].Methods += ", " + string(op.Method)
+	}
+	return config
+}
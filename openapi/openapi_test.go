@@ -0,0 +1,103 @@
+package openapi
+
+import (
+	"testing"
+
+	"github.com/fredjeck/jarl/authz"
+	"github.com/stretchr/testify/assert"
+)
+
+const pokedex = `
+openapi: 3.0.3
+info:
+  title: Pokedex
+  version: 1.0.0
+servers:
+- url: https://pokedex.local/api/v1/
+paths:
+  /pokemon:
+    get:
+      operationId: listPokemon
+      tags: [read]
+    post:
+      operationId: createPokemon
+      tags: [write]
+      x-jarl-roles: [trainer]
+  /pokemon/{id}:
+    parameters:
+    - name: id
+      in: path
+      schema:
+        type: integer
+    get:
+      operationId: getPokemon
+      tags: [read]
+    delete:
+      operationId: deletePokemon
+      tags: [admin]
+  /files/{name}.{ext}:
+    servers:
+    - url: /static
+    get:
+      operationId: getFile
+      parameters:
+      - name: name
+        in: path
+        schema:
+          type: string
+`
+
+func TestOperations(t *testing.T) {
+	doc, err := Parse([]byte(pokedex))
+	assert.NoError(t, err)
+
+	ops := doc.Operations()
+	assert.Len(t, ops, 5)
+	assert.Equal(t, "/static/files/{name}.{ext}", ops[0].Path)
+	assert.Equal(t, `^/static/files/[^/]+\.[^/]+(\?.*)?$`, ops[0].Regex())
+	assert.Equal(t, "/api/v1/pokemon/{id}", ops[3].Path)
+	assert.Equal(t, authz.HTTPMethodGet, ops[3].Method)
+	assert.Equal(t, `^/api/v1/pokemon/-?[0-9]+(\?.*)?$`, ops[3].Regex())
+	assert.Equal(t, "/api/v1/pokemon/1", ops[3].Sample())
+	assert.Equal(t, "/static/files/name.ext", ops[0].Sample())
+	assert.True(t, ops[3].Matches("/api/v1/pokemon/25"))
+	assert.False(t, ops[3].Matches("/api/v1/pokemon/pikachu"))
+	assert.False(t, ops[3].Matches("/api/v1/pokemon/25/moves"))
+	assert.True(t, ops[3].Matches("/api/v1/pokemon/25?lang=fr"))
+	assert.False(t, ops[3].Matches("/api/v1/pokemon/25moves?lang=fr"))
+
+	_, err = Parse([]byte("swagger: '2.0'"))
+	assert.Error(t, err)
+}
+
+func TestClient(t *testing.T) {
+	doc, err := Parse([]byte(pokedex))
+	assert.NoError(t, err)
+
+	reader := doc.Client("reader", []string{"pokedex.local"}, Selection{Tags: []string{"read"}})
+	assert.Equal(t, &authz.ClientConfig{ClientID: "reader", Hosts: []string{"pokedex.local"}, Mode: authz.ModeAllow, Paths: []authz.PathConfig{
+		{Path: `^/api/v1/pokemon(\?.*)?$`, Methods: "GET"},
+		{Path: `^/api/v1/pokemon/-?[0-9]+(\?.*)?$`, Methods: "GET"},
+	}}, reader)
+
+	trainer := doc.Client("trainer", nil, Selection{Tags: []string{"read"}, Roles: []string{"trainer"}, OperationIDs: []string{"deletePokemon"}})
+	assert.Equal(t, []authz.PathConfig{
+		{Path: `^/api/v1/pokemon(\?.*)?$`, Methods: "GET, POST"},
+		{Path: `^/api/v1/pokemon/-?[0-9]+(\?.*)?$`, Methods: "GET, DELETE"},
+	}, trainer.Paths)
+
+	assert.Len(t, doc.Client("all", nil, Selection{}).Paths, 3)
+
+	// Generated configurations are valid jarl client configurations
+	content, err := trainer.Marshal()
+	assert.NoError(t, err)
+	auth, err := authz.NewAuthorizationFromYaml(content)
+	assert.NoError(t, err)
+	assert.Empty(t, auth.Warnings)
+	assert.NoError(t, auth.IsRequestAllowed(&authz.Request{Host: "pokedex.local", Path: "/api/v1/pokemon/25", Method: authz.HTTPMethodDelete}))
+	assert.Error(t, auth.IsRequestAllowed(&authz.Request{Host: "pokedex.local", Path: "/api/v1/pokemon/25", Method: authz.HTTPMethodPut}))
+
+	// Operations called with query parameters are allowed as well
+	assert.NoError(t, auth.IsRequestAllowed(&authz.Request{Host: "pokedex.local", Path: "/api/v1/pokemon?limit=10", Method: authz.HTTPMethodGet}))
+	assert.Error(t, auth.IsRequestAllowed(&authz.Request{Host: "pokedex.local", Path: "/api/v1/pokemonx?limit=10", Method: authz.HTTPMethodGet}))
+}
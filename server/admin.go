@@ -0,0 +1,222 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fredjeck/jarl/authz"
+	"github.com/fredjeck/jarl/logging"
+)
+
+// Version is the jarl version reported by the admin API, set at build time using
+// -ldflags "-X github.com/fredjeck/jarl/server.Version=x.y.z"
+var Version = "dev"
+
+// AdminServer serves the read-only admin API on a dedicated listener
+type AdminServer struct {
+	httpServer    *http.Server
+	configuration *Configuration
+	port          int
+	state         servingState
+}
+
+// NewAdminServer instantiates a new AdminServer but does not start it
+func NewAdminServer(configuration *Configuration) *AdminServer {
+	srv := &AdminServer{
+		configuration: configuration,
+	}
+	srv.state.Set(Stopped)
+	return srv
+}
+
+// Start starts the AdminServer
+func (srv *AdminServer) Start(wg *sync.WaitGroup) {
+	defer func() {
+		wg.Done()
+		srv.state.Set(Stopped)
+		slog.Info("jarl admin server stopped")
+	}()
+
+	// The admin API discloses the policies, it is only reachable from other hosts when protected by a token
+	if len(srv.configuration.AdminToken) == 0 && !loopbackAddress(srv.configuration.AdminListenOn) {
+		slog.Error(fmt.Sprintf("refusing to start jarl admin server at '%v' without admin token, bind it to a loopback address or configure a token", srv.configuration.AdminListenOn))
+		return
+	}
+
+	listener, err := listen(srv.configuration.AdminListenOn, srv.configuration.SocketMode)
+	if err != nil {
+		slog.Error(fmt.Sprintf("failed to bind jarl admin server to '%v", srv.configuration.AdminListenOn), slog.Any(logging.KeyError, err))
+		return
+	}
+
+	// Store the port for test only.
+	srv.port = listenerPort(listener)
+
+	// The admin listener is secured as the HTTP server it would otherwise be served by
+	if srv.configuration.HTTPTLS != nil {
+		tlsConfig, err := newTLSConfig(srv.configuration.HTTPTLS, "http/1.1")
+		if err != nil {
+			slog.Error("failed to configure jarl admin server tls", slog.Any(logging.KeyError, err))
+			_ = listener.Close()
+			return
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	mux := http.NewServeMux()
+	registerAdminHandlers(mux, srv.configuration)
+	srv.httpServer = &http.Server{Handler: mux}
+
+	slog.Info(fmt.Sprintf("starting jarl admin server at '%s", listener.Addr()))
+	srv.state.Set(Serving)
+	if err := srv.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+		slog.Error(fmt.Sprintf("failed to start jarl admin server at '%v'", srv.configuration.AdminListenOn), slog.Any(logging.KeyError, err))
+	}
+}
+
+// Stop stops listening for inbound connections and closes the underlying http server
+func (srv *AdminServer) Stop() {
+	slog.Info("stopping jarl admin server")
+	if srv.httpServer == nil {
+		return
+	}
+	if err := srv.httpServer.Close(); err != nil {
+		slog.Error("failed to stop jarl admin server", slog.Any(logging.KeyError, err))
+	}
+}
+
+// Shutdown stops accepting new connections and waits for the in-flight requests to complete.
+// Remaining connections are closed once the timeout expires.
+func (srv *AdminServer) Shutdown(timeout time.Duration) {
+	if srv.httpServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.httpServer.Shutdown(ctx); err != nil {
+		srv.Stop()
+	}
+}
+
+// adminEnabled returns true if the admin API is exposed, either on a dedicated listener or protected by a token
+func adminEnabled(conf *Configuration) bool {
+	return len(conf.AdminListenOn) > 0 || len(conf.AdminToken) > 0
+}
+
+// registerAdminHandlers registers the admin API endpoints, requiring the admin token when one is configured
+func registerAdminHandlers(mux *http.ServeMux, conf *Configuration) {
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.Handle(pattern, requireToken(conf.AdminToken, handler))
+	}
+	handle("GET /admin/clients", handleAdminClients(conf))
+	handle("GET /admin/clients/{id}", handleAdminClient(conf))
+	handle("GET /admin/version", handleAdminVersion(conf))
+	handle("GET /admin/reload-status", handleAdminReloadStatus(conf))
+	handle("POST /admin/evaluate", handleAdminEvaluate(conf))
+	handle("GET /admin/rule-usage", handleAdminRuleUsage(conf))
+}
+
+// requireToken rejects the requests which do not carry the provided bearer token, all requests are accepted if token is empty
+func requireToken(token string, next http.Handler) http.Handler {
+	if len(token) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		provided, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			response.Header().Set("WWW-Authenticate", `Bearer realm="jarl"`)
+			writeJSON(response, http.StatusUnauthorized, adminError{Error: "missing or invalid admin token"})
+			return
+		}
+		next.ServeHTTP(response, request)
+	})
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+type adminVersion struct {
+	Version       string `json:"version"`
+	GoVersion     string `json:"goVersion"`
+	Revision      string `json:"revision,omitempty"`
+	PolicyHash    string `json:"policyHash"`
+	PolicyVersion string `json:"policyVersion,omitempty"`
+}
+
+// Lists the compiled policies of all the configured clients
+func handleAdminClients(conf *Configuration) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		writeJSON(response, http.StatusOK, conf.Authorizations.Clients())
+	}
+}
+
+// Returns the compiled policy of a single client
+func handleAdminClient(conf *Configuration) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		id := request.PathValue("id")
+		auth, ok := conf.Authorizations.Client(id)
+		if !ok {
+			writeJSON(response, http.StatusNotFound, adminError{Error: fmt.Sprintf("no authz configuration defined for %s", id)})
+			return
+		}
+		writeJSON(response, http.StatusOK, auth)
+	}
+}
+
+// Returns the jarl build information and the hash of the active policies
+func handleAdminVersion(conf *Configuration) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		status := conf.Authorizations.Status()
+		v := adminVersion{Version: Version, PolicyHash: status.Hash, PolicyVersion: status.Version}
+		if info, ok := debug.ReadBuildInfo(); ok {
+			v.GoVersion = info.GoVersion
+			for _, s := range info.Settings {
+				if s.Key == "vcs.revision" {
+					v.Revision = s.Value
+				}
+			}
+		}
+		writeJSON(response, http.StatusOK, v)
+	}
+}
+
+// Returns the active policies description and the outcome of the last reload
+func handleAdminReloadStatus(conf *Configuration) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		writeJSON(response, http.StatusOK, conf.Authorizations.Status())
+	}
+}
+
+// Returns the number of requests decided by each client rule and the time of their last match.
+// Only the rules which never matched are listed when the unused query parameter is true.
+func handleAdminRuleUsage(conf *Configuration) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		usage := conf.Authorizations.Usage()
+		if unused, _ := strconv.ParseBool(request.URL.Query().Get("unused")); unused {
+			for id, rules := range usage {
+				usage[id] = slices.DeleteFunc(rules, func(r authz.RuleUsage) bool { return r.Matches > 0 })
+			}
+		}
+		writeJSON(response, http.StatusOK, usage)
+	}
+}
+
+func writeJSON(response http.ResponseWriter, status int, v interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	if err := json.NewEncoder(response).Encode(v); err != nil {
+		slog.Error("failed to write jarl admin response", slog.Any(logging.KeyError, err))
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fredjeck/jarl/authz"
+	"github.com/fredjeck/jarl/logging"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	partialBodyHeader = "x-envoy-auth-partial-body" // partialBodyHeader is set by Envoy when the forwarded request body was truncated to max_request_bytes
+	grpcStatusHeader  = "grpc-status"
+	grpcMessageHeader = "grpc-message"
+	contentTypeHeader = "content-type"
+
+	retryAfterHeader         = "retry-after"
+	rateLimitLimitHeader     = "x-ratelimit-limit"
+	rateLimitRemainingHeader = "x-ratelimit-remaining"
+	rateLimitResetHeader     = "x-ratelimit-reset"
+)
+
+// check evaluates the inbound request against the configured authorizations.
+// This is the code path shared by all the check request protocols, the outcome is logged, traced and accounted in metrics.
+func check(protocol string, authzHeader string, authorizations *authz.Authorizations, req *authz.Request, ctx *logging.Context) (decision authz.Decision) {
+	start := time.Now()
+	// An empty identity header is handled as a missing one
+	clientID := req.Headers[authzHeader]
+	identified := len(clientID) > 0
+	if !req.Evaluation {
+		span := startCheckSpan(protocol, authzHeader, req)
+		ctx.TraceID = traceID(span)
+		defer func() { endCheckSpan(span, decision, identified) }()
+	}
+
+	// Requests without identity are evaluated against the anonymous policy if any, and denied otherwise
+	req.ClientID = clientID
+	decision = authorizations.Check(req)
+	if !identified {
+		clientID = logging.MissingClientID
+		if !decision.Allowed {
+			decision.Reason = fmt.Sprintf("missing authz configuration header %s: %s", authzHeader, decision.Reason)
+		}
+	}
+
+	// Evaluations are what-if requests, they are neither logged as decisions nor accounted
+	if req.Evaluation {
+		return decision
+	}
+	ctx.ClientID = clientID
+	logging.LogRequest(outcome(decision), ctx)
+	observeDecision(protocol, decision, identified)
+	checkDuration.WithLabelValues(protocol).Observe(time.Since(start).Seconds())
+	return decision
+}
+
+// outcome returns the decision log outcome of a decision
+func outcome(decision authz.Decision) logging.Outcome {
+	return logging.Outcome{
+		Allowed: decision.Allowed,
+		Reason:  decision.Reason,
+		Code:    string(decision.Code),
+		Rule:    decision.Rule,
+		DryRun:  decision.DryRun,
+	}
+}
+
+// denyMessage returns the message sent back to denied clients. The deny reason may disclose the policies,
+// it is only written to the decision log and clients only receive its code.
+func denyMessage(decision authz.Decision) string {
+	if len(decision.Code) == 0 {
+		return "access denied"
+	}
+	return fmt.Sprintf("access denied: %s", decision.Code)
+}
+
+// bodyTruncated returns true if Envoy only forwarded part of the request body
+func bodyTruncated(headers map[string]string, size int64, body []byte) bool {
+	if partial, err := strconv.ParseBool(headers[partialBodyHeader]); err == nil && partial {
+		return true
+	}
+	return len(body) > 0 && int64(len(body)) < size
+}
+
+// rateLimited returns true if the request was denied because the client exceeded its rate limit
+func rateLimited(decision authz.Decision) bool {
+	return decision.Quota != nil && decision.Quota.Exceeded
+}
+
+// quotaHeaders returns the headers describing the client remaining rate limit quota
+func quotaHeaders(quota *authz.Quota) [][2]string {
+	if quota == nil {
+		return nil
+	}
+	headers := [][2]string{
+		{rateLimitLimitHeader, strconv.Itoa(quota.Limit)},
+		{rateLimitRemainingHeader, strconv.Itoa(quota.Remaining)},
+		{rateLimitResetHeader, strconv.Itoa(seconds(quota.Reset))},
+	}
+	if quota.Exceeded {
+		headers = append(headers, [2]string{retryAfterHeader, strconv.Itoa(seconds(quota.RetryAfter))})
+	}
+	return headers
+}
+
+// seconds rounds the provided duration up to the next second
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// grpcDeniedHeaders returns the headers of a trailers-only gRPC response carrying a PERMISSION_DENIED
+// or RESOURCE_EXHAUSTED status when the client was rate limited
+func grpcDeniedHeaders(decision authz.Decision) [][2]string {
+	code := codes.PermissionDenied
+	if rateLimited(decision) {
+		code = codes.ResourceExhausted
+	}
+	return [][2]string{
+		{contentTypeHeader, authz.GRPCContentType},
+		{grpcStatusHeader, strconv.Itoa(int(code))},
+		{grpcMessageHeader, encodeGRPCMessage(denyMessage(decision))},
+	}
+}
+
+// encodeGRPCMessage percent-encodes the grpc-message header value as required by the gRPC over HTTP2 specification
+func encodeGRPCMessage(msg string) string {
+	var sb strings.Builder
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&sb, "%%%02X", c)
+	}
+	return sb.String()
+}
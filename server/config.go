@@ -1,13 +1,27 @@
 package server
 
-import "github.com/fredjeck/jarl/authz"
+import (
+	"os"
+	"time"
+
+	"github.com/fredjeck/jarl/authz"
+	"github.com/fredjeck/jarl/logging"
+)
 
 // Configuration stores the configuration options for the Jarl server
 type Configuration struct {
-	HTTPListenOn             string                // HTTPListenOn stores the InetAddr on which the HTTP Server is listening for inbound connections
-	GRPCListenOn             string                // GRPCListenOn stores the InetAddr on which the HTTP Server is listening for inbound connections
+	HTTPListenOn             string                // HTTPListenOn stores the InetAddr or unix:///path/to.sock on which the HTTP Server is listening for inbound connections
+	GRPCListenOn             string                // GRPCListenOn stores the InetAddr or unix:///path/to.sock on which the GRPC Server is listening for inbound connections
+	SocketMode               os.FileMode           // SocketMode stores the file permissions of unix domain sockets, DefaultSocketMode if unset
 	ClientsConfigurationPath string                // ClientsConfigurationPath stores the path where the client configurations are stored
 	HTTPAuthZHeader          string                // HTTPAuthZHeader contains the name of the http header element which will be matchted for clientID
 	HTTPHostHeader           string                // HTTPHostHeader contains the  name fo the http header element which will match the originally contacted host
 	Authorizations           *authz.Authorizations // Authorizations stores the configured authorizations
+	GRPCTLS                  *TLSConfiguration     // GRPCTLS enables TLS on the GRPC Server, plaintext if nil
+	HTTPTLS                  *TLSConfiguration     // HTTPTLS enables TLS on the HTTP Server, plaintext if nil
+	DrainPeriod              time.Duration         // DrainPeriod stores how long health checks report not serving before the servers are stopped
+	ShutdownTimeout          time.Duration         // ShutdownTimeout stores how long in-flight requests are given to complete once the drain period is over
+	AdminListenOn            string                // AdminListenOn stores the InetAddr or unix:///path/to.sock of the dedicated admin API listener, served by the HTTP Server if empty
+	AdminToken               string                // AdminToken stores the bearer token required by the admin API, the admin API is disabled if both AdminListenOn and AdminToken are empty
+	Redactor                 *logging.Redactor     // Redactor sanitizes the check request attributes echoed back in the x-ext-authz-check-received header, the logging.DefaultRedactor if nil
 }
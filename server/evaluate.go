@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+// maxEvaluateRequestSize is the maximum size of an evaluation request accepted by the admin API
+const maxEvaluateRequestSize = 1024 * 1024
+
+// evaluateRequest describes the request evaluated by the what-if admin endpoint
+type evaluateRequest struct {
+	Identity      string            `json:"identity"`      // Identity is the client identity, sent in the authz header, anonymous if empty
+	Host          string            `json:"host"`          // Host is the originally contacted host
+	Method        string            `json:"method"`        // Method is the HTTP method, GET if empty
+	Path          string            `json:"path"`          // Path is the requested path
+	Headers       map[string]string `json:"headers"`       // Headers are the inbound request headers
+	Body          string            `json:"body"`          // Body is the request body, used for GraphQL and JSON-RPC inspection
+	SourceAddress string            `json:"sourceAddress"` // SourceAddress is the downstream address as host[:port]
+}
+
+// evaluateResponse describes the decision and the response Envoy would have received for an evaluated request
+type evaluateResponse struct {
+	Allowed         bool              `json:"allowed"`
+	DryRun          bool              `json:"dryRun"`
+	Reason          string            `json:"reason,omitempty"`
+	ClientID        string            `json:"clientID,omitempty"` // ClientID identifies the client policy which was applied
+	Rule            string            `json:"rule,omitempty"`     // Rule describes the rule which decided the outcome
+	Status          int               `json:"status"`             // Status is the HTTP status returned to the downstream client on deny, 200 when allowed
+	Headers         map[string]string `json:"headers"`            // Headers are the headers added to the upstream request or to the denied response
+	ResponseHeaders map[string]string `json:"responseHeaders"`    // ResponseHeaders are the headers added to the upstream response when allowed
+	Body            string            `json:"body,omitempty"`     // Body is the denied response body
+}
+
+// checkRequest translates the evaluation request to the CheckRequest Envoy would have sent
+func (e *evaluateRequest) checkRequest(authzHeader string) (*authv3.CheckRequest, error) {
+	if len(e.Path) == 0 {
+		return nil, errors.New("path cannot be empty")
+	}
+
+	method := strings.ToUpper(strings.TrimSpace(e.Method))
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+
+	headers := make(map[string]string)
+	for k, v := range e.Headers {
+		headers[strings.ToLower(k)] = v
+	}
+	if len(e.Identity) > 0 {
+		headers[authzHeader] = e.Identity
+	}
+
+	attributes := &authv3.AttributeContext{
+		Request: &authv3.AttributeContext_Request{
+			Http: &authv3.AttributeContext_HttpRequest{
+				Host:    e.Host,
+				Method:  method,
+				Path:    e.Path,
+				Headers: headers,
+				Body:    e.Body,
+				Size:    int64(len(e.Body)),
+			},
+		},
+	}
+
+	if len(e.SourceAddress) > 0 {
+		address, err := socketAddress(e.SourceAddress)
+		if err != nil {
+			return nil, err
+		}
+		attributes.Source = &authv3.AttributeContext_Peer{Address: address}
+	}
+	return &authv3.CheckRequest{Attributes: attributes}, nil
+}
+
+// socketAddress parses a host[:port] address
+func socketAddress(address string) (*corev3.Address, error) {
+	host, port := address, uint64(0)
+	if h, p, err := net.SplitHostPort(address); err == nil {
+		host = h
+		if port, err = strconv.ParseUint(p, 10, 16); err != nil {
+			return nil, fmt.Errorf("invalid source address port '%s'", p)
+		}
+	}
+	if net.ParseIP(host) == nil {
+		return nil, fmt.Errorf("invalid source address '%s'", address)
+	}
+	return &corev3.Address{
+		Address: &corev3.Address_SocketAddress{
+			SocketAddress: &corev3.SocketAddress{
+				Address:       host,
+				PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: uint32(port)},
+			},
+		},
+	}, nil
+}
+
+// newEvaluateResponse describes the provided check response
+func newEvaluateResponse(response *authv3.CheckResponse) *evaluateResponse {
+	r := &evaluateResponse{
+		Status:          http.StatusOK,
+		Headers:         make(map[string]string),
+		ResponseHeaders: make(map[string]string),
+	}
+
+	if ok := response.GetOkResponse(); ok != nil {
+		for _, h := range ok.GetHeaders() {
+			r.Headers[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+		}
+		for _, h := range ok.GetResponseHeadersToAdd() {
+			r.ResponseHeaders[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+		}
+	}
+
+	if denied := response.GetDeniedResponse(); denied != nil {
+		r.Status = int(denied.GetStatus().GetCode())
+		r.Body = denied.GetBody()
+		for _, h := range denied.GetHeaders() {
+			r.Headers[h.GetHeader().GetKey()] = h.GetHeader().GetValue()
+		}
+	}
+	return r
+}
+
+// Evaluates a what-if request through the same code path as the gRPC v3 check requests.
+// Evaluations neither consume rate limit quotas, update the metrics nor are logged as decisions.
+func handleAdminEvaluate(conf *Configuration) http.HandlerFunc {
+	server := &GRPCAuthzServerV3{AuthzHeader: conf.HTTPAuthZHeader, Authorizations: conf.Authorizations, Redactor: conf.Redactor}
+	return func(response http.ResponseWriter, request *http.Request) {
+		var e evaluateRequest
+		decoder := json.NewDecoder(http.MaxBytesReader(response, request.Body, maxEvaluateRequestSize))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&e); err != nil {
+			writeJSON(response, http.StatusBadRequest, adminError{Error: fmt.Sprintf("invalid evaluation request: %s", err)})
+			return
+		}
+
+		checkRequest, err := e.checkRequest(conf.HTTPAuthZHeader)
+		if err != nil {
+			writeJSON(response, http.StatusBadRequest, adminError{Error: fmt.Sprintf("invalid evaluation request: %s", err)})
+			return
+		}
+
+		checkResponse, decision := server.evaluate(checkRequest, true)
+		result := newEvaluateResponse(checkResponse)
+		result.Allowed = decision.Allowed
+		result.DryRun = decision.DryRun
+		result.Reason = decision.Reason
+		result.ClientID = decision.ClientID
+		result.Rule = decision.Rule
+		writeJSON(response, http.StatusOK, result)
+	}
+}
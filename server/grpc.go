@@ -3,13 +3,15 @@ package server
 import (
 	"fmt"
 	"log/slog"
-	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	authv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
 	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	"github.com/fredjeck/jarl/logging"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/health/grpc_health_v1"
 )
@@ -17,52 +19,115 @@ import (
 // GRPCAuthzServer implements an Envoy custom GRPC V2 and V3 authorization filter
 type GRPCAuthzServer struct {
 	grpcServer    *grpc.Server
+	healthServer  *health.Server
 	configuration *Configuration
 	port          int
-	state         ServingStatus
+	state         servingState
+	servingStatus atomic.Int32
 	grpcV2        *GRPCAuthzServerV2
 	grpcV3        *GRPCAuthzServerV3
 }
 
 // NewGRPCAuthzServer instantiates a new GRPC AuthZ serer but does not start it
 func NewGRPCAuthzServer(configuration *Configuration) *GRPCAuthzServer {
-	return &GRPCAuthzServer{
+	srv := &GRPCAuthzServer{
 		configuration: configuration,
-		state:         Stopped,
+		healthServer:  health.NewServer(),
 	}
+	srv.state.Set(Stopped)
+	// Services are reported as not serving until the policies are loaded and the servers are up
+	for _, service := range healthServices {
+		srv.healthServer.SetServingStatus(service, grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	}
+	return srv
 }
 
 // Start starts the server starts serving inbound connections
 func (srv *GRPCAuthzServer) Start(wg *sync.WaitGroup) {
 	defer func() {
 		wg.Done()
-		srv.state = Stopped
+		srv.state.Set(Stopped)
 		slog.Info("jarl http grpc server stopped")
 	}()
 
-	listener, err := net.Listen("tcp", srv.configuration.GRPCListenOn)
+	listener, err := listen(srv.configuration.GRPCListenOn, srv.configuration.SocketMode)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to bind jarl GRPC authz server to '%v", srv.configuration.GRPCListenOn), slog.Any(logging.KeyError, err))
 		return
 	}
 	// Store the port for test only.
-	srv.port = listener.Addr().(*net.TCPAddr).Port
+	srv.port = listenerPort(listener)
+
+	opts := make([]grpc.ServerOption, 0)
+	if srv.configuration.GRPCTLS != nil {
+		tlsConfig, err := newTLSConfig(srv.configuration.GRPCTLS, "h2")
+		if err != nil {
+			slog.Error("failed to configure jarl GRPC authz server tls", slog.Any(logging.KeyError, err))
+			_ = listener.Close()
+			return
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
 
-	srv.grpcServer = grpc.NewServer()
-	authv2.RegisterAuthorizationServer(srv.grpcServer, &GRPCAuthzServerV2{AuthzHeader: srv.configuration.HTTPAuthZHeader, Authorizations: srv.configuration.Authorizations})
-	authv3.RegisterAuthorizationServer(srv.grpcServer, &GRPCAuthzServerV3{AuthzHeader: srv.configuration.HTTPAuthZHeader, Authorizations: srv.configuration.Authorizations})
-	grpc_health_v1.RegisterHealthServer(srv.grpcServer, health.NewServer())
+	srv.grpcServer = grpc.NewServer(opts...)
+	authv2.RegisterAuthorizationServer(srv.grpcServer, &GRPCAuthzServerV2{AuthzHeader: srv.configuration.HTTPAuthZHeader, Authorizations: srv.configuration.Authorizations, Redactor: srv.configuration.Redactor})
+	authv3.RegisterAuthorizationServer(srv.grpcServer, &GRPCAuthzServerV3{AuthzHeader: srv.configuration.HTTPAuthZHeader, Authorizations: srv.configuration.Authorizations, Redactor: srv.configuration.Redactor})
+	grpc_health_v1.RegisterHealthServer(srv.grpcServer, srv.healthServer)
 
 	slog.Info(fmt.Sprintf("starting jarl GRPC authz server at '%s", listener.Addr()))
-	srv.state = Serving
+	srv.state.Set(Serving)
 	if err := srv.grpcServer.Serve(listener); err != nil {
 		slog.Error(fmt.Sprintf("failed to start jarl grpc authz server at '%s'", listener.Addr()), slog.Any(logging.KeyError, err))
-		srv.state = Stopped
+		srv.state.Set(Stopped)
 	}
 }
 
 // Stop stops listening for GRPC connections
 func (srv *GRPCAuthzServer) Stop() {
 	slog.Info("stopping jarl grpc authz server")
-	srv.grpcServer.Stop()
+	if srv.grpcServer != nil {
+		srv.grpcServer.Stop()
+	}
+}
+
+// SetServingStatus updates the status reported by the health service for the whole server and the ext_authz services.
+// Updates are ignored once the server is draining.
+func (srv *GRPCAuthzServer) SetServingStatus(serving bool, reason string) {
+	status := grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	if serving {
+		status = grpc_health_v1.HealthCheckResponse_SERVING
+	}
+	if srv.servingStatus.Swap(int32(status)) != int32(status) {
+		slog.Info(fmt.Sprintf("jarl grpc health status is now '%s' (%s)", status, reason))
+	}
+	for _, service := range healthServices {
+		srv.healthServer.SetServingStatus(service, status)
+	}
+}
+
+// Drain sets the health service status to NOT_SERVING, the status cannot be changed afterwards
+func (srv *GRPCAuthzServer) Drain() {
+	srv.healthServer.Shutdown()
+}
+
+// Shutdown stops accepting new connections and waits for the in-flight requests to complete.
+// Remaining connections are closed once the timeout expires.
+func (srv *GRPCAuthzServer) Shutdown(timeout time.Duration) {
+	if srv.grpcServer == nil {
+		return
+	}
+	slog.Info("gracefully stopping jarl grpc authz server")
+
+	done := make(chan struct{})
+	go func() {
+		srv.grpcServer.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		slog.Warn(fmt.Sprintf("jarl grpc authz server did not stop within %s, closing remaining connections", timeout))
+		srv.grpcServer.Stop()
+	}
 }
@@ -2,7 +2,6 @@ package server
 
 import (
 	"context"
-	"fmt"
 
 	corev2 "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	authv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
@@ -17,8 +16,10 @@ import (
 type GRPCAuthzServerV2 struct {
 	AuthzHeader    string
 	Authorizations *authz.Authorizations
+	Redactor       *logging.Redactor // Redactor sanitizes the check request attributes echoed back to Envoy, the logging.DefaultRedactor if nil
 }
 
+// allow grants the request, v2 responses cannot carry the remaining quota headers back to the client
 func (s *GRPCAuthzServerV2) allow(request *authv2.CheckRequest) *authv2.CheckResponse {
 	return &authv2.CheckResponse{
 		HttpResponse: &authv2.CheckResponse_OkResponse{
@@ -33,7 +34,7 @@ func (s *GRPCAuthzServerV2) allow(request *authv2.CheckRequest) *authv2.CheckRes
 					{
 						Header: &corev2.HeaderValue{
 							Key:   receivedHeader,
-							Value: request.GetAttributes().String(),
+							Value: received(s.Redactor, request.GetAttributes()),
 						},
 					},
 				},
@@ -43,26 +44,45 @@ func (s *GRPCAuthzServerV2) allow(request *authv2.CheckRequest) *authv2.CheckRes
 	}
 }
 
-func (s *GRPCAuthzServerV2) deny(request *authv2.CheckRequest, reason string) *authv2.CheckResponse {
+func (s *GRPCAuthzServerV2) deny(request *authv2.CheckRequest, req *authz.Request, decision authz.Decision) *authv2.CheckResponse {
+	httpStatus := &typev2.HttpStatus{Code: typev2.StatusCode_Forbidden}
+	body := denyMessage(decision)
+	headers := []*corev2.HeaderValueOption{
+		{
+			Header: &corev2.HeaderValue{
+				Key:   resultHeader,
+				Value: resultDenied,
+			},
+		},
+		{
+			Header: &corev2.HeaderValue{
+				Key:   receivedHeader,
+				Value: received(s.Redactor, request.GetAttributes()),
+			},
+		},
+	}
+
+	if rateLimited(decision) {
+		httpStatus.Code = typev2.StatusCode_TooManyRequests
+		for _, h := range quotaHeaders(decision.Quota) {
+			headers = append(headers, &corev2.HeaderValueOption{Header: &corev2.HeaderValue{Key: h[0], Value: h[1]}})
+		}
+	}
+
+	// gRPC clients read the status from the headers of the trailers-only response, the HTTP status is kept for Envoy
+	if req.IsGRPC() {
+		body = ""
+		for _, h := range grpcDeniedHeaders(decision) {
+			headers = append(headers, &corev2.HeaderValueOption{Header: &corev2.HeaderValue{Key: h[0], Value: h[1]}})
+		}
+	}
+
 	return &authv2.CheckResponse{
 		HttpResponse: &authv2.CheckResponse_DeniedResponse{
 			DeniedResponse: &authv2.DeniedHttpResponse{
-				Status: &typev2.HttpStatus{Code: typev2.StatusCode_Forbidden},
-				Body:   reason,
-				Headers: []*corev2.HeaderValueOption{
-					{
-						Header: &corev2.HeaderValue{
-							Key:   resultHeader,
-							Value: resultDenied,
-						},
-					},
-					{
-						Header: &corev2.HeaderValue{
-							Key:   receivedHeader,
-							Value: request.GetAttributes().String(),
-						},
-					},
-				},
+				Status:  httpStatus,
+				Body:    body,
+				Headers: headers,
 			},
 		},
 		Status: &status.Status{Code: int32(codes.PermissionDenied)},
@@ -71,34 +91,24 @@ func (s *GRPCAuthzServerV2) deny(request *authv2.CheckRequest, reason string) *a
 
 // Check implements gRPC v2 check request.
 func (s *GRPCAuthzServerV2) Check(_ context.Context, request *authv2.CheckRequest) (*authv2.CheckResponse, error) {
-	attrs := request.GetAttributes()
-	httpAttrs := attrs.GetRequest().GetHttp()
-	method := authz.HTTPMethod(attrs.Request.Http.Method)
-	// Determine whether to allow or deny the request.
-	clientID, headerExists := httpAttrs.GetHeaders()[s.AuthzHeader]
-
-	reason := ""
-	allowed := true
-
-	if headerExists {
-		al, err := s.Authorizations.IsAllowed(httpAttrs.Host, clientID, attrs.Request.Http.Path, method)
-		if err != nil {
-			reason = err.Error()
-		}
-		allowed = al
-	} else {
-		allowed = false
-		deniedCounter.WithLabelValues("missing").Inc()
-		reason = fmt.Sprintf("missing authz configuration header %s", s.AuthzHeader)
+	req := authV2Request(request)
+	decision := check(protocolV2, s.AuthzHeader, s.Authorizations, req, logging.AuthV2LoggingContext(request))
+	if decision.Allowed {
+		return s.allow(request), nil
 	}
+	return s.deny(request, req, decision), nil
+}
 
-	ctx := logging.AuthV2LoggingContext(request)
-	ctx.ClientID = clientID
-	logging.LogRequest(allowed, reason, ctx)
-	if allowed {
-		allowedCounter.Inc()
-		return s.allow(request), nil
+// authV2Request extracts the attributes evaluated by jarl from an AuthV2 CheckRequest
+func authV2Request(request *authv2.CheckRequest) *authz.Request {
+	httpAttrs := request.GetAttributes().GetRequest().GetHttp()
+	body := []byte(httpAttrs.GetBody())
+	return &authz.Request{
+		Host:          httpAttrs.GetHost(),
+		Path:          httpAttrs.GetPath(),
+		Method:        authz.ParseHTTPMethod(httpAttrs.GetMethod()),
+		Headers:       httpAttrs.GetHeaders(),
+		Body:          body,
+		BodyTruncated: bodyTruncated(httpAttrs.GetHeaders(), httpAttrs.GetSize(), body),
 	}
-	deniedCounter.WithLabelValues(clientID).Inc()
-	return s.deny(request, "missing authz header"), nil
 }
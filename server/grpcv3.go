@@ -2,7 +2,6 @@ package server
 
 import (
 	"context"
-	"fmt"
 
 	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
@@ -17,54 +16,79 @@ import (
 type GRPCAuthzServerV3 struct {
 	AuthzHeader    string
 	Authorizations *authz.Authorizations
+	Redactor       *logging.Redactor // Redactor sanitizes the check request attributes echoed back to Envoy, the logging.DefaultRedactor if nil
 }
 
 // Allows the requests by returning a positive outcoume
-func (s *GRPCAuthzServerV3) allow(request *authv3.CheckRequest) *authv3.CheckResponse {
+func (s *GRPCAuthzServerV3) allow(request *authv3.CheckRequest, decision authz.Decision) *authv3.CheckResponse {
+	headers := []*corev3.HeaderValueOption{
+		{
+			Header: &corev3.HeaderValue{
+				Key:   resultHeader,
+				Value: resultAllowed,
+			},
+		},
+		{
+			Header: &corev3.HeaderValue{
+				Key:   receivedHeader,
+				Value: received(s.Redactor, request.GetAttributes()),
+			},
+		},
+	}
+
+	response := &authv3.OkHttpResponse{Headers: headers}
+	for _, h := range quotaHeaders(decision.Quota) {
+		response.ResponseHeadersToAdd = append(response.ResponseHeadersToAdd, &corev3.HeaderValueOption{Header: &corev3.HeaderValue{Key: h[0], Value: h[1]}})
+	}
+
 	return &authv3.CheckResponse{
 		HttpResponse: &authv3.CheckResponse_OkResponse{
-			OkResponse: &authv3.OkHttpResponse{
-				Headers: []*corev3.HeaderValueOption{
-					{
-						Header: &corev3.HeaderValue{
-							Key:   resultHeader,
-							Value: resultAllowed,
-						},
-					},
-					{
-						Header: &corev3.HeaderValue{
-							Key:   receivedHeader,
-							Value: truncate(request.GetAttributes().String()),
-						},
-					},
-				},
-			},
+			OkResponse: response,
 		},
 		Status: &status.Status{Code: int32(codes.OK)},
 	}
 }
 
 // Denies the inbound request
-func (s *GRPCAuthzServerV3) deny(request *authv3.CheckRequest, reason string) *authv3.CheckResponse {
+func (s *GRPCAuthzServerV3) deny(request *authv3.CheckRequest, req *authz.Request, decision authz.Decision) *authv3.CheckResponse {
+	httpStatus := &typev3.HttpStatus{Code: typev3.StatusCode_Forbidden}
+	body := denyMessage(decision)
+	headers := []*corev3.HeaderValueOption{
+		{
+			Header: &corev3.HeaderValue{
+				Key:   resultHeader,
+				Value: resultDenied,
+			},
+		},
+		{
+			Header: &corev3.HeaderValue{
+				Key:   receivedHeader,
+				Value: received(s.Redactor, request.GetAttributes()),
+			},
+		},
+	}
+
+	if rateLimited(decision) {
+		httpStatus.Code = typev3.StatusCode_TooManyRequests
+		for _, h := range quotaHeaders(decision.Quota) {
+			headers = append(headers, &corev3.HeaderValueOption{Header: &corev3.HeaderValue{Key: h[0], Value: h[1]}})
+		}
+	}
+
+	// gRPC clients read the status from the headers of the trailers-only response, the HTTP status is kept for Envoy
+	if req.IsGRPC() {
+		body = ""
+		for _, h := range grpcDeniedHeaders(decision) {
+			headers = append(headers, &corev3.HeaderValueOption{Header: &corev3.HeaderValue{Key: h[0], Value: h[1]}})
+		}
+	}
+
 	return &authv3.CheckResponse{
 		HttpResponse: &authv3.CheckResponse_DeniedResponse{
 			DeniedResponse: &authv3.DeniedHttpResponse{
-				Status: &typev3.HttpStatus{Code: typev3.StatusCode_Forbidden},
-				Body:   reason,
-				Headers: []*corev3.HeaderValueOption{
-					{
-						Header: &corev3.HeaderValue{
-							Key:   resultHeader,
-							Value: resultDenied,
-						},
-					},
-					{
-						Header: &corev3.HeaderValue{
-							Key:   receivedHeader,
-							Value: truncate(request.GetAttributes().String()),
-						},
-					},
-				},
+				Status:  httpStatus,
+				Body:    body,
+				Headers: headers,
 			},
 		},
 		Status: &status.Status{Code: int32(codes.PermissionDenied)},
@@ -73,33 +97,35 @@ func (s *GRPCAuthzServerV3) deny(request *authv3.CheckRequest, reason string) *a
 
 // Check implements gRPC v3 check request.
 func (s *GRPCAuthzServerV3) Check(_ context.Context, request *authv3.CheckRequest) (*authv3.CheckResponse, error) {
-	attrs := request.GetAttributes()
-	httpAttrs := attrs.GetRequest().GetHttp()
-	method := authz.HTTPMethod(attrs.Request.Http.Method)
-	// Determine whether to allow or deny the request.
-	clientID, headerExists := httpAttrs.GetHeaders()[s.AuthzHeader]
-
-	reason := ""
-	allowed := true
+	response, _ := s.evaluate(request, false)
+	return response, nil
+}
 
-	if headerExists {
-		al, err := s.Authorizations.IsAllowed(httpAttrs.Host, clientID, attrs.Request.Http.Path, method)
-		if err != nil {
-			reason = err.Error()
-		}
-		allowed = al
-	} else {
-		allowed = false
-		reason = fmt.Sprintf("missing authz configuration header %s", s.AuthzHeader)
+// evaluate checks the request and returns both the response sent to Envoy and the decision it was built from.
+// Evaluation requests are what-if checks which neither consume rate limit quotas, update the metrics nor are logged as decisions.
+func (s *GRPCAuthzServerV3) evaluate(request *authv3.CheckRequest, evaluation bool) (*authv3.CheckResponse, authz.Decision) {
+	req := authV3Request(request)
+	req.Evaluation = evaluation
+	decision := check(protocolV3, s.AuthzHeader, s.Authorizations, req, logging.AuthV3LoggingContext(request))
+	if decision.Allowed {
+		return s.allow(request, decision), decision
 	}
+	return s.deny(request, req, decision), decision
+}
 
-	ctx := logging.AuthV3LoggingContext(request)
-	ctx.ClientID = clientID
-	logging.LogRequest(allowed, reason, ctx)
-	if allowed {
-		allowedCounter.Inc()
-		return s.allow(request), nil
+// authV3Request extracts the attributes evaluated by jarl from an AuthV3 CheckRequest
+func authV3Request(request *authv3.CheckRequest) *authz.Request {
+	httpAttrs := request.GetAttributes().GetRequest().GetHttp()
+	body := httpAttrs.GetRawBody()
+	if len(body) == 0 {
+		body = []byte(httpAttrs.GetBody())
+	}
+	return &authz.Request{
+		Host:          httpAttrs.GetHost(),
+		Path:          httpAttrs.GetPath(),
+		Method:        authz.ParseHTTPMethod(httpAttrs.GetMethod()),
+		Headers:       httpAttrs.GetHeaders(),
+		Body:          body,
+		BodyTruncated: bodyTruncated(httpAttrs.GetHeaders(), httpAttrs.GetSize(), body),
 	}
-	deniedCounter.WithLabelValues(clientID).Inc()
-	return s.deny(request, "missing authz header"), nil
 }
@@ -1,14 +1,14 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log/slog"
-	"net"
 	"net/http"
-	"strings"
 	"sync"
+	"time"
 
-	"github.com/fredjeck/jarl/authz"
 	"github.com/fredjeck/jarl/logging"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -20,56 +20,99 @@ type HTTPAuthzServer struct {
 	httpServer    *http.Server
 	configuration *Configuration
 	port          int
-	state         ServingStatus
+	state         servingState
 }
 
 // NewHTTPAuthzServer instantiates a new HTTPAuthzServer but does not start it
 func NewHTTPAuthzServer(configuration *Configuration) *HTTPAuthzServer {
-	return &HTTPAuthzServer{
-		state:         Stopped,
+	srv := &HTTPAuthzServer{
 		configuration: configuration,
 	}
+	srv.state.Set(Stopped)
+	return srv
+}
+
+// Probes reports the server health to the HTTP health endpoints
+type Probes struct {
+	Healthy func() (bool, string) // Healthy backs the /healthz endpoint
+	Live    func() (bool, string) // Live backs the /livez endpoint
+	Ready   func() (bool, string) // Ready backs the /readyz endpoint
 }
 
 // Start starts the HTTPAuthzServer
-func (srv *HTTPAuthzServer) Start(wg *sync.WaitGroup, healthFunc func() (bool, string)) {
+func (srv *HTTPAuthzServer) Start(wg *sync.WaitGroup, probes Probes) {
 	defer func() {
 		wg.Done()
-		srv.state = Stopped
+		srv.state.Set(Stopped)
 		slog.Info("jarl http Authz server stopped")
 	}()
 
-	listener, err := net.Listen("tcp", srv.configuration.HTTPListenOn)
+	listener, err := listen(srv.configuration.HTTPListenOn, srv.configuration.SocketMode)
 	if err != nil {
 		slog.Error(fmt.Sprintf("failed to bind jarl HTTP authz server to '%v", srv.configuration.HTTPListenOn), slog.Any(logging.KeyError, err))
+		return
 	}
 
 	// Store the port for test only.
-	srv.port = listener.Addr().(*net.TCPAddr).Port
+	srv.port = listenerPort(listener)
+
+	if srv.configuration.HTTPTLS != nil {
+		tlsConfig, err := newTLSConfig(srv.configuration.HTTPTLS, "http/1.1")
+		if err != nil {
+			slog.Error("failed to configure jarl HTTP authz server tls", slog.Any(logging.KeyError, err))
+			_ = listener.Close()
+			return
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/healthz", handleHealth(healthFunc))
+	mux.HandleFunc("/healthz", handleHealth(probes.Healthy))
+	mux.HandleFunc("/livez", handleHealth(probes.Live))
+	mux.HandleFunc("/readyz", handleHealth(probes.Ready))
 	mux.Handle("/metrics", promhttp.Handler())
+	if len(srv.configuration.AdminListenOn) == 0 && adminEnabled(srv.configuration) {
+		registerAdminHandlers(mux, srv.configuration)
+	}
 	mux.HandleFunc("/*", handleCheck(srv.configuration))
 
 	srv.httpServer = &http.Server{Handler: mux}
 
 	slog.Info(fmt.Sprintf("starting jarl http authz server at '%s", listener.Addr()))
-	srv.state = Serving
+	srv.state.Set(Serving)
 	if err := srv.httpServer.Serve(listener); err != nil {
 		slog.Error(fmt.Sprintf("failed to start jarl http authz server at '%v'", srv.configuration.HTTPListenOn), slog.Any(logging.KeyError, err))
-		srv.state = Stopped
+		srv.state.Set(Stopped)
 	}
 }
 
 // Stop stops listening for inbound connections and closes the underlying http server
 func (srv *HTTPAuthzServer) Stop() {
 	slog.Info("stopping jarl http authz server")
+	if srv.httpServer == nil {
+		return
+	}
 	if err := srv.httpServer.Close(); err != nil {
 		slog.Error("failed to stop jarl http authz server", slog.Any(logging.KeyError, err))
 	}
 }
 
+// Shutdown stops accepting new connections and waits for the in-flight requests to complete.
+// Remaining connections are closed once the timeout expires.
+func (srv *HTTPAuthzServer) Shutdown(timeout time.Duration) {
+	if srv.httpServer == nil {
+		return
+	}
+	slog.Info("gracefully stopping jarl http authz server")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.httpServer.Shutdown(ctx); err != nil {
+		slog.Warn(fmt.Sprintf("jarl http authz server did not stop within %s, closing remaining connections", timeout), slog.Any(logging.KeyError, err))
+		srv.Stop()
+	}
+}
+
 // Kubernetes Healt probe
 func handleHealth(healthFunc func() (bool, string)) func(w http.ResponseWriter, r *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
@@ -89,9 +132,8 @@ func handleCheck(_ *Configuration) func(w http.ResponseWriter, r *http.Request)
 	return func(response http.ResponseWriter, request *http.Request) {
 		// host := request.Header.Get(config.HTTPHostHeader)
 		// clientID := request.Header.Get(config.HTTPAuthZHeader)
-		clientID := "unset"
-		path := request.URL.Path
-		method := authz.ParseHTTPMethod(request.Method)
+		// path := request.URL.Path
+		// method := authz.ParseHTTPMethod(request.Method)
 		// headerExists := clientID != "" && host != ""
 
 		reason := ""
@@ -108,26 +150,11 @@ func handleCheck(_ *Configuration) func(w http.ResponseWriter, r *http.Request)
 		// 	reason = fmt.Sprintf("missing authz or host configuration header %s/%s", config.HTTPAuthZHeader, config.HTTPHostHeader)
 		// }
 
-		headers := make(map[string]string)
-		for k, v := range request.Header {
-			headers[strings.ToLower(k)] = string(v[0])
-		}
-
-		ctx := &logging.Context{
-			// ClientID: clientID,
-			// Host:     host,
-			Path:    path,
-			Method:  string(method),
-			Headers: headers,
-		}
-
-		logging.LogRequest(allowed, reason, ctx)
+		// The HTTP check API is not implemented yet, its placeholder decisions are neither accounted in the metrics nor logged
 		if allowed {
-			allowedCounter.Inc()
 			response.Header().Set(resultHeader, resultAllowed)
 			response.WriteHeader(http.StatusOK)
 		} else {
-			deniedCounter.WithLabelValues(clientID).Inc()
 			response.Header().Set(resultHeader, resultDenied)
 			response.WriteHeader(http.StatusForbidden)
 			response.Write([]byte(fmt.Sprintf("{'status':'denied', 'reason':%s}", reason)))
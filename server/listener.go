@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	unixScheme = "unix://"
+	// DefaultSocketMode is the file mode applied to unix domain sockets when none is configured
+	DefaultSocketMode os.FileMode = 0660
+)
+
+// listen binds the provided address which is either a tcp [host]:port or a unix:///path/to.sock unix domain socket.
+// Unix domain sockets are created with the provided file mode, a stale socket file is removed beforehand.
+func listen(address string, mode os.FileMode) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixScheme) {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, unixScheme)
+	if len(path) == 0 {
+		return nil, fmt.Errorf("missing unix domain socket path in '%s'", address)
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("'%s' exists and is not a unix domain socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if mode == 0 {
+		mode = DefaultSocketMode
+	}
+	listener, err := listenUnix(path, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// loopbackAddress returns true if the provided listen address is only reachable from the host: unix domain sockets
+// and tcp addresses bound to localhost or to a loopback IP
+func loopbackAddress(address string) bool {
+	if strings.HasPrefix(address, unixScheme) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// listenerPort returns the tcp port of the provided listener, 0 for unix domain sockets
+func listenerPort(listener net.Listener) int {
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package server
+
+import (
+	"net"
+	"os"
+)
+
+// listenUnix binds the unix domain socket, the umask is not supported on this platform and the mode is only applied once bound
+func listenUnix(path string, _ os.FileMode) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
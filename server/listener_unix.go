@@ -0,0 +1,24 @@
+//go:build !windows && !plan9
+
+package server
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// umaskMu serializes the umask changes, the umask is process wide
+var umaskMu sync.Mutex
+
+// listenUnix binds the unix domain socket with a umask restricting it to the provided mode,
+// the socket is never reachable with wider permissions even before its mode is applied
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+
+	previous := syscall.Umask(int(^mode & os.ModePerm))
+	defer syscall.Umask(previous)
+	return net.Listen("unix", path)
+}
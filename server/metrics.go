@@ -1,10 +1,23 @@
 package server
 
 import (
+	"github.com/fredjeck/jarl/authz"
+	"github.com/fredjeck/jarl/logging"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+const (
+	protocolV2 = "v2" // protocolV2 Envoy ext_authz gRPC v2 check API
+	protocolV3 = "v3" // protocolV3 Envoy ext_authz gRPC v3 check API
+
+	decisionAllow = "allow"
+	decisionDeny  = "deny"
+
+	unknownClientLabel = "_unknown" // unknownClientLabel replaces the client IDs no policy is configured for to bound the metrics cardinality
+	noReasonLabel      = "none"     // noReasonLabel is the reason of the granted requests
+)
+
 var allowedCounter = promauto.NewCounter(
 	prometheus.CounterOpts{
 		Name: "jarl_allowed_request_count",
@@ -19,3 +32,46 @@ var deniedCounter = promauto.NewCounterVec(
 	},
 	[]string{"client_id"},
 )
+
+var checkDuration = promauto.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "jarl_check_duration_seconds",
+		Help:    "Duration of the check requests evaluation",
+		Buckets: []float64{.00005, .0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1},
+	},
+	[]string{"protocol"},
+)
+
+var decisionsCounter = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "jarl_decisions_total",
+		Help: "No of check decisions by protocol, client policy, decision and reason code",
+	},
+	[]string{"protocol", "client", "decision", "reason"},
+)
+
+// clientLabel returns the client metrics label of a decision.
+// Clients without identity are reported as missing and the clients no policy applied to as _unknown,
+// the label values are therefore bounded by the configured clients.
+func clientLabel(decision authz.Decision, identified bool) string {
+	switch {
+	case len(decision.ClientID) > 0:
+		return decision.ClientID
+	case !identified:
+		return logging.MissingClientID
+	default:
+		return unknownClientLabel
+	}
+}
+
+// observeDecision accounts the decision in the check metrics
+func observeDecision(protocol string, decision authz.Decision, identified bool) {
+	client := clientLabel(decision, identified)
+	if decision.Allowed {
+		allowedCounter.Inc()
+		decisionsCounter.WithLabelValues(protocol, client, decisionAllow, noReasonLabel).Inc()
+		return
+	}
+	deniedCounter.WithLabelValues(client).Inc()
+	decisionsCounter.WithLabelValues(protocol, client, decisionDeny, string(decision.Code)).Inc()
+}
@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fredjeck/jarl/logging"
 )
 
 const (
@@ -15,6 +19,8 @@ const (
 	// NOT IMPLEMENTED YET overrideGRPCValue = "grpc-additional-header-override-value"
 	resultAllowed = "allowed"
 	resultDenied  = "denied"
+
+	truncatedValue = "<truncated>" // truncatedValue replaces the check request attributes which are too large to be echoed back
 )
 
 // ServingStatus indicates the serving status of the Authz servers
@@ -25,50 +31,185 @@ const (
 	Stopped                      // Stopped for some reasons - check logs for details
 )
 
+// servingState stores a ServingStatus which can be safely read while the servers are starting or stopping
+type servingState struct {
+	status atomic.Int32
+}
+
+// Set updates the serving status
+func (s *servingState) Set(status ServingStatus) {
+	s.status.Store(int32(status))
+}
+
+// Get returns the current serving status
+func (s *servingState) Get() ServingStatus {
+	return ServingStatus(s.status.Load())
+}
+
+const (
+	// DefaultDrainPeriod is the duration during which health checks report not serving before the servers are stopped
+	DefaultDrainPeriod = 5 * time.Second
+	// DefaultShutdownTimeout is the duration given to in-flight requests to complete once the drain period is over
+	DefaultShutdownTimeout = 10 * time.Second
+	// healthRefreshInterval is the interval at which the gRPC health service status is synchronized with the servers state
+	healthRefreshInterval = 250 * time.Millisecond
+)
+
+// healthServices lists the services reported by the gRPC health service, the empty name stands for the whole server
+var healthServices = []string{"", "envoy.service.auth.v3.Authorization", "envoy.service.auth.v2.Authorization"}
+
 // JarlAuthzServer implements the ext_authz v2/v3 gRPC and HTTP Envoy check request API.
 type JarlAuthzServer struct {
-	grpcServer *GRPCAuthzServer
-	httpServer *HTTPAuthzServer
+	grpcServer    *GRPCAuthzServer
+	httpServer    *HTTPAuthzServer
+	adminServer   *AdminServer // adminServer serves the admin API on a dedicated listener, nil if disabled
+	configuration *Configuration
+	draining      atomic.Bool
+	done          chan struct{}
+	stopOnce      sync.Once
 }
 
 // Start starts listening for inbound Authz connections on both HTTP and GRPC ports
 func (s *JarlAuthzServer) Start() {
 	var wg sync.WaitGroup
 	wg.Add(2)
-	go s.httpServer.Start(&wg, s.Healthy)
+	go s.httpServer.Start(&wg, Probes{Healthy: s.Healthy, Live: s.Live, Ready: s.Ready})
 	go s.grpcServer.Start(&wg)
+	if s.adminServer != nil {
+		wg.Add(1)
+		go s.adminServer.Start(&wg)
+	}
+	go s.watchHealth()
 	wg.Wait()
+	s.stopWatchingHealth()
+}
+
+// Live returns true if both servers are running, regardless of the loaded policies
+func (s *JarlAuthzServer) Live() (bool, string) {
+	grpcUp := s.grpcServer.state.Get() == Serving
+	httpUp := s.httpServer.state.Get() == Serving
+	if grpcUp && httpUp {
+		return true, "live"
+	}
+	return false, fmt.Sprintf("grpc up: %t http up: %t", grpcUp, httpUp)
 }
 
-// Healthy returns true if both servers are running
+// Healthy returns true if both servers are running and not draining
 func (s *JarlAuthzServer) Healthy() (bool, string) {
-	if s.grpcServer.state == Serving && s.httpServer.state == Serving {
-		return true, "healthy"
+	if s.draining.Load() {
+		return false, "draining"
 	}
 
-	return false, fmt.Sprintf("grpc up: %t http up: %t", s.grpcServer.state == Serving, s.httpServer.state == Serving)
+	if live, desc := s.Live(); !live {
+		return false, desc
+	}
+	return true, "healthy"
+}
+
+// Ready returns true if both servers are running, not draining and a valid set of client authorizations is loaded
+func (s *JarlAuthzServer) Ready() (bool, string) {
+	if healthy, desc := s.Healthy(); !healthy {
+		return false, desc
+	}
+
+	if !s.configuration.Authorizations.Loaded() {
+		return false, "no authz configuration loaded"
+	}
+	return true, "ready"
+}
+
+// watchHealth keeps the gRPC health service status in sync with the servers readiness until the servers are stopped
+func (s *JarlAuthzServer) watchHealth() {
+	ticker := time.NewTicker(healthRefreshInterval)
+	defer ticker.Stop()
+	for {
+		ready, desc := s.Ready()
+		s.grpcServer.SetServingStatus(ready, desc)
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// stopWatchingHealth stops the gRPC health service synchronization
+func (s *JarlAuthzServer) stopWatchingHealth() {
+	s.stopOnce.Do(func() { close(s.done) })
 }
 
 // Stop stops the underlying HTTP and GRPC servers
 func (s *JarlAuthzServer) Stop() {
+	s.stopWatchingHealth()
 	s.grpcServer.Stop()
 	s.httpServer.Stop()
+	if s.adminServer != nil {
+		s.adminServer.Stop()
+	}
+}
+
+// Shutdown gracefully stops the servers. Health checks first report not serving for the drain period so that
+// Envoy stops sending new check requests, in-flight requests are then given until the shutdown timeout to complete.
+func (s *JarlAuthzServer) Shutdown() {
+	drain := s.configuration.DrainPeriod
+	timeout := s.configuration.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+
+	slog.Info(fmt.Sprintf("draining jarl authz server for %s", drain))
+	s.draining.Store(true)
+	s.stopWatchingHealth()
+	s.grpcServer.Drain()
+	time.Sleep(drain)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.grpcServer.Shutdown(timeout)
+	}()
+	go func() {
+		defer wg.Done()
+		s.httpServer.Shutdown(timeout)
+	}()
+	wg.Wait()
+	if s.adminServer != nil {
+		s.adminServer.Shutdown(timeout)
+	}
 }
 
 // NewJarlAuthzServer instantiates a new Authz server based on the provided configuration
 func NewJarlAuthzServer(conf *Configuration) *JarlAuthzServer {
 	slog.Info(fmt.Sprintf("configuring jarl using headers['%s'] as authz content attribute", conf.HTTPAuthZHeader))
-	return &JarlAuthzServer{
-		grpcServer: NewGRPCAuthzServer(conf),
-		httpServer: NewHTTPAuthzServer(conf),
+	s := &JarlAuthzServer{
+		grpcServer:    NewGRPCAuthzServer(conf),
+		httpServer:    NewHTTPAuthzServer(conf),
+		configuration: conf,
+		done:          make(chan struct{}),
+	}
+	if len(conf.AdminListenOn) > 0 {
+		s.adminServer = NewAdminServer(conf)
 	}
+	return s
 }
 
 func truncate(body string) string {
 	// Maximum size of a header accepted by Envoy is 60KiB, so when the request body is bigger than 60KB,
 	// we don't return it in a response header to avoid rejecting it by Envoy and returning 431 to the client
 	if len(body) > 60000 {
-		return "<truncated>"
+		return truncatedValue
 	}
 	return body
 }
+
+// received returns the x-ext-authz-check-received header value, the check request attributes sanitized by the redactor
+func received(redactor *logging.Redactor, attrs interface{}) string {
+	encoded, ok := redactor.Fit(redactor.RequestContext(attrs), func(v interface{}) (string, error) {
+		return fmt.Sprint(v), nil
+	})
+	if !ok {
+		return truncatedValue
+	}
+	return truncate(encoded)
+}
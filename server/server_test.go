@@ -15,21 +15,48 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	authv2 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v2"
 	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
 	"github.com/fredjeck/jarl/authz"
 	"github.com/fredjeck/jarl/logging"
+	"github.com/fredjeck/jarl/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
 const checkHeader = "x-forwarded-sub"
@@ -51,12 +78,40 @@ paths:
   - path: /pokemon/.*?
 `
 
+const clientGraphQL = `
+clientID: clientGraphQL
+mode: allow
+paths:
+  - path: /graphql
+    methods: POST
+graphql:
+  path: /graphql
+  operations:
+    - name: .*
+      type: query
+`
+
+const clientGRPC = `
+clientID: clientGRPC
+mode: allow
+grpc:
+  - pokemon.v1.PokemonService/Get*
+`
+
+const clientLimited = `
+clientID: clientLimited
+mode: deny
+rateLimit:
+  requestsPerMinute: 1
+`
+
 type testCase struct {
 	name     string
 	host     string
 	url      string
 	method   string
 	clientID string
+	body     string
 	want     int
 }
 
@@ -109,6 +164,24 @@ var testCases = []testCase{
 		method:   http.MethodGet,
 		want:     int(codes.OK),
 	},
+	{
+		name:     "Allow GraphQL query",
+		host:     "localhost",
+		url:      "/graphql",
+		clientID: "clientGraphQL",
+		method:   http.MethodPost,
+		body:     `{"query":"query GetPokemon { pokemon { id } }"}`,
+		want:     int(codes.OK),
+	},
+	{
+		name:     "Deny GraphQL mutation",
+		host:     "localhost",
+		url:      "/graphql",
+		clientID: "clientGraphQL",
+		method:   http.MethodPost,
+		body:     `{"query":"mutation DeletePokemon { delete }"}`,
+		want:     int(codes.PermissionDenied),
+	},
 	{
 		name:     "Deny Client",
 		host:     "localhost",
@@ -157,6 +230,8 @@ func TestExtAuthz(t *testing.T) {
 	a.Add(client)
 	client, err = authz.NewAuthorizationFromYaml([]byte(clientB))
 	a.Add(client)
+	client, err = authz.NewAuthorizationFromYaml([]byte(clientGraphQL))
+	a.Add(client)
 
 	server := NewJarlAuthzServer(&Configuration{
 		HTTPListenOn:    "localhost:0",
@@ -169,7 +244,7 @@ func TestExtAuthz(t *testing.T) {
 
 	waitForServer(server)
 
-	conn, err := grpc.NewClient(fmt.Sprintf("localhost:%d", 9000), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.NewClient(fmt.Sprintf("localhost:%d", server.grpcServer.port), grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
@@ -180,6 +255,265 @@ func TestExtAuthz(t *testing.T) {
 	runTestCases(t, grpcV2Client, grpcV3Client)
 }
 
+func TestGRPCDeniedResponse(t *testing.T) {
+	logging.Setup()
+
+	a := authz.NewAuthorizations()
+	client, _ := authz.NewAuthorizationFromYaml([]byte(clientGRPC))
+	a.Add(client)
+
+	server := NewJarlAuthzServer(&Configuration{
+		HTTPListenOn:    "localhost:0",
+		GRPCListenOn:    "localhost:0",
+		HTTPAuthZHeader: checkHeader,
+		Authorizations:  a,
+	})
+	go server.Start()
+	defer server.Stop()
+
+	waitForServer(server)
+
+	conn, err := grpc.NewClient(fmt.Sprintf("localhost:%d", server.grpcServer.port), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer func() { _ = conn.Close() }()
+	grpcV3Client := authv3.NewAuthorizationClient(conn)
+
+	check := func(path string) *authv3.CheckResponse {
+		resp, err := grpcV3Client.Check(context.Background(), &authv3.CheckRequest{
+			Attributes: &authv3.AttributeContext{
+				Request: &authv3.AttributeContext_Request{
+					Http: &authv3.AttributeContext_HttpRequest{
+						Host:    "localhost",
+						Path:    path,
+						Method:  http.MethodPost,
+						Headers: map[string]string{checkHeader: "clientGRPC", "content-type": "application/grpc"},
+					},
+				},
+			},
+		})
+		assert.NoError(t, err)
+		return resp
+	}
+
+	resp := check("/pokemon.v1.PokemonService/GetPokemon")
+	assert.Equal(t, int32(codes.OK), resp.Status.Code)
+
+	resp = check("/pokemon.v1.PokemonService/DeletePokemon")
+	assert.Equal(t, int32(codes.PermissionDenied), resp.Status.Code)
+	denied := resp.GetDeniedResponse()
+	assert.Equal(t, typev3.StatusCode_Forbidden, denied.Status.Code)
+	headers := make(map[string]string)
+	for _, h := range denied.Headers {
+		headers[h.Header.Key] = h.Header.Value
+	}
+	assert.Equal(t, "7", headers["grpc-status"])
+	assert.Equal(t, "application/grpc", headers["content-type"])
+	assert.Equal(t, "access denied: path_denied", headers["grpc-message"])
+	assert.Empty(t, denied.Body)
+}
+
+func TestRateLimitedResponse(t *testing.T) {
+	logging.Setup()
+
+	a := authz.NewAuthorizations()
+	client, _ := authz.NewAuthorizationFromYaml([]byte(clientLimited))
+	a.Add(client)
+
+	server := NewJarlAuthzServer(&Configuration{
+		HTTPListenOn:    "localhost:0",
+		GRPCListenOn:    "localhost:0",
+		HTTPAuthZHeader: checkHeader,
+		Authorizations:  a,
+	})
+	go server.Start()
+	defer server.Stop()
+
+	waitForServer(server)
+
+	conn, err := grpc.NewClient(fmt.Sprintf("localhost:%d", server.grpcServer.port), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer func() { _ = conn.Close() }()
+	grpcV3Client := authv3.NewAuthorizationClient(conn)
+
+	request := &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Host:    "localhost",
+					Path:    "/pokemon",
+					Method:  http.MethodGet,
+					Headers: map[string]string{checkHeader: "clientLimited"},
+				},
+			},
+		},
+	}
+
+	resp, err := grpcV3Client.Check(context.Background(), request)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(codes.OK), resp.Status.Code)
+	headers := make(map[string]string)
+	for _, h := range resp.GetOkResponse().ResponseHeadersToAdd {
+		headers[h.Header.Key] = h.Header.Value
+	}
+	assert.Equal(t, "1", headers["x-ratelimit-limit"])
+	assert.Equal(t, "0", headers["x-ratelimit-remaining"])
+
+	resp, err = grpcV3Client.Check(context.Background(), request)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(codes.PermissionDenied), resp.Status.Code)
+	denied := resp.GetDeniedResponse()
+	assert.Equal(t, typev3.StatusCode_TooManyRequests, denied.Status.Code)
+	headers = make(map[string]string)
+	for _, h := range denied.Headers {
+		headers[h.Header.Key] = h.Header.Value
+	}
+	assert.Equal(t, "60", headers["retry-after"])
+}
+
+func TestDecisionMetrics(t *testing.T) {
+	a := authz.NewAuthorizations()
+	client, _ := authz.NewAuthorizationFromYaml([]byte(clientA))
+	a.Add(client)
+	v3 := &GRPCAuthzServerV3{AuthzHeader: checkHeader, Authorizations: a}
+	v2 := &GRPCAuthzServerV2{AuthzHeader: checkHeader, Authorizations: a}
+
+	counter := func(client string, decision string, reason authz.ReasonCode) float64 {
+		var m dto.Metric
+		assert.NoError(t, decisionsCounter.WithLabelValues(protocolV3, client, decision, string(reason)).(prometheus.Metric).Write(&m))
+		return m.GetCounter().GetValue()
+	}
+	samples := func(protocol string) uint64 {
+		var m dto.Metric
+		assert.NoError(t, checkDuration.WithLabelValues(protocol).(prometheus.Metric).Write(&m))
+		return m.GetHistogram().GetSampleCount()
+	}
+	check := func(host string, path string, headers map[string]string) {
+		_, err := v3.Check(context.Background(), &authv3.CheckRequest{
+			Attributes: &authv3.AttributeContext{
+				Request: &authv3.AttributeContext_Request{
+					Http: &authv3.AttributeContext_HttpRequest{Host: host, Path: path, Method: http.MethodGet, Headers: headers},
+				},
+			},
+		})
+		assert.NoError(t, err)
+	}
+
+	tests := []struct {
+		host    string
+		path    string
+		headers map[string]string
+		client  string
+		outcome string
+		reason  authz.ReasonCode
+	}{
+		{"localhost", "/pokemon/pikachu", map[string]string{checkHeader: "clientA"}, "clientA", decisionAllow, noReasonLabel},
+		{"localhost", "/berries", map[string]string{checkHeader: "clientA"}, "clientA", decisionDeny, authz.ReasonPathDenied},
+		{"elsewhere", "/pokemon/pikachu", map[string]string{checkHeader: "clientA"}, "clientA", decisionDeny, authz.ReasonHostMismatch},
+		{"localhost", "/pokemon/pikachu", map[string]string{}, logging.MissingClientID, decisionDeny, authz.ReasonMissingIdentity},
+		{"localhost", "/pokemon/pikachu", map[string]string{checkHeader: ""}, logging.MissingClientID, decisionDeny, authz.ReasonMissingIdentity},
+		{"localhost", "/pokemon/pikachu", map[string]string{checkHeader: "random-1234"}, unknownClientLabel, decisionDeny, authz.ReasonUnknownClient},
+	}
+	before := samples(protocolV3)
+	for _, tc := range tests {
+		value := counter(tc.client, tc.outcome, tc.reason)
+		check(tc.host, tc.path, tc.headers)
+		assert.Equal(t, value+1, counter(tc.client, tc.outcome, tc.reason), "%s %s", tc.client, tc.reason)
+	}
+	assert.Equal(t, before+uint64(len(tests)), samples(protocolV3))
+
+	// Unknown client IDs never become label values
+	var m dto.Metric
+	assert.NoError(t, decisionsCounter.WithLabelValues(protocolV3, "random-1234", decisionDeny, string(authz.ReasonUnknownClient)).(prometheus.Metric).Write(&m))
+	assert.Zero(t, m.GetCounter().GetValue())
+
+	before = samples(protocolV2)
+	_, err := v2.Check(context.Background(), &authv2.CheckRequest{
+		Attributes: &authv2.AttributeContext{
+			Request: &authv2.AttributeContext_Request{
+				Http: &authv2.AttributeContext_HttpRequest{Host: "localhost", Path: "/pokemon/pikachu", Method: http.MethodGet, Headers: map[string]string{checkHeader: "clientA"}},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, before+1, samples(protocolV2))
+}
+
+func TestCheckSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	defer func() { _ = provider.Shutdown(context.Background()) }()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(tracing.Propagator())
+
+	a := authz.NewAuthorizations()
+	client, _ := authz.NewAuthorizationFromYaml([]byte(clientA))
+	a.Add(client)
+	v3 := &GRPCAuthzServerV3{AuthzHeader: checkHeader, Authorizations: a}
+	check := func(path string, headers map[string]string) {
+		_, err := v3.Check(context.Background(), &authv3.CheckRequest{
+			Attributes: &authv3.AttributeContext{
+				Request: &authv3.AttributeContext_Request{
+					Http: &authv3.AttributeContext_HttpRequest{Host: "localhost", Path: path, Method: http.MethodGet, Headers: headers},
+				},
+			},
+		})
+		assert.NoError(t, err)
+	}
+	attributes := func(span tracetest.SpanStub) map[string]string {
+		attrs := make(map[string]string)
+		for _, kv := range span.Attributes {
+			attrs[string(kv.Key)] = kv.Value.AsString()
+		}
+		return attrs
+	}
+
+	check("/pokemon/pikachu", map[string]string{checkHeader: "clientA", "traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"})
+	check("/berries", map[string]string{checkHeader: "clientA", "b3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1"})
+	check("/pokemon/pikachu", map[string]string{})
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 3)
+
+	assert.Equal(t, "jarl.Check", spans[0].Name)
+	assert.Equal(t, trace.SpanKindServer, spans[0].SpanKind)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent.SpanID().String())
+	attrs := attributes(spans[0])
+	assert.Equal(t, "v3", attrs["jarl.protocol"])
+	assert.Equal(t, "clientA", attrs["jarl.client.id"])
+	assert.Equal(t, "allow", attrs["jarl.decision"])
+	assert.Equal(t, "paths GET /pokemon/.*?", attrs["jarl.rule"])
+	assert.Equal(t, "header", attrs["jarl.identity.source"])
+	assert.Equal(t, checkHeader, attrs["jarl.identity.header"])
+	assert.Equal(t, "/pokemon/pikachu", attrs["url.path"])
+
+	assert.Equal(t, "80f198ee56343ba864fe8b2a57d3eff7", spans[1].SpanContext.TraceID().String())
+	attrs = attributes(spans[1])
+	assert.Equal(t, "deny", attrs["jarl.decision"])
+	assert.Equal(t, "path_denied", attrs["jarl.reason"])
+
+	assert.False(t, spans[2].Parent.IsValid())
+	attrs = attributes(spans[2])
+	assert.Equal(t, "missing", attrs["jarl.identity.source"])
+	assert.Equal(t, "missing_identity", attrs["jarl.reason"])
+
+	// What-if evaluations are not traced
+	exporter.Reset()
+	_, decision := v3.evaluate(&authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{Host: "localhost", Path: "/pokemon/pikachu", Method: http.MethodGet, Headers: map[string]string{checkHeader: "clientA"}},
+			},
+		},
+	}, true)
+	assert.True(t, decision.Allowed)
+	assert.Empty(t, exporter.GetSpans())
+}
+
 func runTestCases(t *testing.T, grpcV2Client authv2.AuthorizationClient, grpcV3Client authv3.AuthorizationClient) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -198,6 +532,7 @@ func runGrpcV3Request(t *testing.T, tc testCase, grpcV3Client authv3.Authorizati
 					Path:    tc.url,
 					Method:  tc.method,
 					Headers: map[string]string{checkHeader: tc.clientID},
+					Body:    tc.body,
 				},
 			},
 		},
@@ -222,6 +557,7 @@ func runGrpcV2Request(t *testing.T, tc testCase, grpcV2Client authv2.Authorizati
 					Path:    tc.url,
 					Method:  tc.method,
 					Headers: map[string]string{checkHeader: tc.clientID},
+					Body:    tc.body,
 				},
 			},
 		},
@@ -237,6 +573,510 @@ func runGrpcV2Request(t *testing.T, tc testCase, grpcV2Client authv2.Authorizati
 	return
 }
 
+func TestUnixDomainSockets(t *testing.T) {
+	logging.Setup()
+
+	dir := t.TempDir()
+	grpcSocket := filepath.Join(dir, "grpc.sock")
+	httpSocket := filepath.Join(dir, "http.sock")
+
+	// Stale sockets left by a previous run are replaced
+	stale, err := net.Listen("unix", grpcSocket)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	a := authz.NewAuthorizations()
+	client, _ := authz.NewAuthorizationFromYaml([]byte(clientA))
+	a.Add(client)
+
+	server := NewJarlAuthzServer(&Configuration{
+		HTTPListenOn:    "unix://" + httpSocket,
+		GRPCListenOn:    "unix://" + grpcSocket,
+		SocketMode:      0600,
+		HTTPAuthZHeader: checkHeader,
+		Authorizations:  a,
+	})
+	go server.Start()
+	defer server.Stop()
+
+	waitForServer(server)
+
+	for _, socket := range []string{grpcSocket, httpSocket} {
+		info, err := os.Stat(socket)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	conn, err := grpc.NewClient("unix://"+grpcSocket, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer func() { _ = conn.Close() }()
+	runGrpcV3Request(t, testCases[0], authv3.NewAuthorizationClient(conn))
+
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", httpSocket)
+		},
+	}}
+	resp, err := httpClient.Get("http://jarl/healthz")
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	// Sockets are created with the restricted mode rather than restricted once listening
+	listener, err := listenUnix(filepath.Join(dir, "admin.sock"), 0600)
+	assert.NoError(t, err)
+	info, err := os.Stat(filepath.Join(dir, "admin.sock"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	_ = listener.Close()
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	logging.Setup()
+
+	authorizations := authz.NewAuthorizations()
+	authorizations.Replace(authz.NewAuthorizations())
+
+	server := NewJarlAuthzServer(&Configuration{
+		HTTPListenOn:    "localhost:0",
+		GRPCListenOn:    "localhost:0",
+		HTTPAuthZHeader: checkHeader,
+		Authorizations:  authorizations,
+		DrainPeriod:     300 * time.Millisecond,
+		ShutdownTimeout: time.Second,
+	})
+	go server.Start()
+
+	waitForServer(server)
+
+	conn, err := grpc.NewClient(fmt.Sprintf("localhost:%d", server.grpcServer.port), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer func() { _ = conn.Close() }()
+	healthClient := grpc_health_v1.NewHealthClient(conn)
+
+	assert.Eventually(t, func() bool {
+		health, err := healthClient.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+		return err == nil && health.Status == grpc_health_v1.HealthCheckResponse_SERVING
+	}, 2*time.Second, 50*time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		server.Shutdown()
+		close(stopped)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Both health checks report not serving while the servers keep accepting requests during the drain period
+	health, err := healthClient.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, health.Status)
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/healthz", server.httpServer.port))
+	assert.NoError(t, err)
+	assert.NotEqual(t, 200, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server not stopped after drain period")
+	}
+
+	_, err = http.Get(fmt.Sprintf("http://localhost:%d/healthz", server.httpServer.port))
+	assert.Error(t, err)
+}
+
+func TestReadiness(t *testing.T) {
+	logging.Setup()
+
+	authorizations := authz.NewAuthorizations()
+	server := NewJarlAuthzServer(&Configuration{
+		HTTPListenOn:    "localhost:0",
+		GRPCListenOn:    "localhost:0",
+		HTTPAuthZHeader: checkHeader,
+		Authorizations:  authorizations,
+	})
+	go server.Start()
+	defer server.Stop()
+
+	waitForServer(server)
+
+	conn, err := grpc.NewClient(fmt.Sprintf("localhost:%d", server.grpcServer.port), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer func() { _ = conn.Close() }()
+	healthClient := grpc_health_v1.NewHealthClient(conn)
+
+	probe := func(path string) int {
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d%s", server.httpServer.port, path))
+		if err != nil {
+			return 0
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	serviceStatus := func(service string) grpc_health_v1.HealthCheckResponse_ServingStatus {
+		health, err := healthClient.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: service})
+		if err != nil {
+			return grpc_health_v1.HealthCheckResponse_UNKNOWN
+		}
+		return health.Status
+	}
+
+	// Servers are up but no policy has been loaded yet
+	assert.Equal(t, 200, probe("/livez"))
+	assert.Equal(t, 200, probe("/healthz"))
+	assert.NotEqual(t, 200, probe("/readyz"))
+	for _, service := range healthServices {
+		assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, serviceStatus(service))
+	}
+
+	authorizations.Replace(authz.NewAuthorizations())
+
+	assert.Equal(t, 200, probe("/readyz"))
+	for _, service := range healthServices {
+		assert.Eventually(t, func() bool {
+			return serviceStatus(service) == grpc_health_v1.HealthCheckResponse_SERVING
+		}, 2*time.Second, 50*time.Millisecond, service)
+	}
+
+	_, err = healthClient.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: "unknown"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestAdminAPI(t *testing.T) {
+	logging.Setup()
+
+	authorizations := authz.NewAuthorizations()
+	client, _ := authz.NewAuthorizationFromYaml([]byte(clientA))
+	authorizations.Add(client)
+
+	server := NewJarlAuthzServer(&Configuration{
+		HTTPListenOn:    "localhost:0",
+		GRPCListenOn:    "localhost:0",
+		HTTPAuthZHeader: checkHeader,
+		Authorizations:  authorizations,
+		AdminToken:      "secret",
+	})
+	go server.Start()
+	defer server.Stop()
+
+	waitForServer(server)
+
+	get := func(path string, token string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d%s", server.httpServer.port, path), nil)
+		assert.NoError(t, err)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(t, err)
+		return resp, body
+	}
+
+	resp, _ := get("/admin/clients", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp, _ = get("/admin/clients", "wrong")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, body := get("/admin/clients", "secret")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var clients []map[string]interface{}
+	assert.NoError(t, json.Unmarshal(body, &clients))
+	assert.Len(t, clients, 1)
+	assert.Equal(t, "clientA", clients[0]["clientID"])
+
+	resp, body = get("/admin/clients/clientA", "secret")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `"hosts":["localhost"]`)
+
+	resp, _ = get("/admin/clients/unknown", "secret")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, body = get("/admin/version", "secret")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `"version":"dev"`)
+
+	resp, body = get("/admin/reload-status", "secret")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `"clients":1`)
+
+	authorizations.Check(&authz.Request{Host: "localhost", ClientID: "clientA", Path: "/pokemon/pikachu", Method: authz.HTTPMethodGet})
+	resp, body = get("/admin/rule-usage", "secret")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var usage authz.UsageSnapshot
+	assert.NoError(t, json.Unmarshal(body, &usage))
+	assert.Len(t, usage["clientA"], 2)
+	assert.Equal(t, "paths GET /pokemon/.*?", usage["clientA"][0].Rule)
+	assert.Equal(t, uint64(1), usage["clientA"][0].Matches)
+	assert.NotNil(t, usage["clientA"][0].LastMatch)
+
+	resp, body = get("/admin/rule-usage?unused=true", "secret")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NoError(t, json.Unmarshal(body, &usage))
+	assert.Equal(t, []authz.RuleUsage{{Rule: "paths PUT /pokemon/.*?"}}, usage["clientA"])
+}
+
+func TestAdminListener(t *testing.T) {
+	logging.Setup()
+
+	server := NewJarlAuthzServer(&Configuration{
+		HTTPListenOn:    "localhost:0",
+		GRPCListenOn:    "localhost:0",
+		AdminListenOn:   "localhost:0",
+		HTTPAuthZHeader: checkHeader,
+		Authorizations:  authz.NewAuthorizations(),
+	})
+	go server.Start()
+	defer server.Stop()
+
+	waitForServer(server)
+	assert.Eventually(t, func() bool { return server.adminServer.state.Get() == Serving }, 2*time.Second, 50*time.Millisecond)
+
+	// The admin API is only served by the dedicated listener
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/admin/version", server.adminServer.port))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	resp, err = http.Get(fmt.Sprintf("http://localhost:%d/admin/version", server.httpServer.port))
+	assert.NoError(t, err)
+	assert.NotEqual(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	// Admin listeners reachable from other hosts require a token
+	var wg sync.WaitGroup
+	wg.Add(1)
+	exposed := NewAdminServer(&Configuration{AdminListenOn: "0.0.0.0:0", Authorizations: authz.NewAuthorizations()})
+	exposed.Start(&wg)
+	assert.Zero(t, exposed.port)
+	assert.Nil(t, exposed.httpServer)
+
+	assert.True(t, loopbackAddress("localhost:8001"))
+	assert.True(t, loopbackAddress("127.0.0.1:8001"))
+	assert.True(t, loopbackAddress("[::1]:8001"))
+	assert.True(t, loopbackAddress("unix:///var/run/jarl/admin.sock"))
+	assert.False(t, loopbackAddress(":8001"))
+	assert.False(t, loopbackAddress("0.0.0.0:8001"))
+	assert.False(t, loopbackAddress("10.0.0.1:8001"))
+}
+
+func TestAdminEvaluate(t *testing.T) {
+	logging.Setup()
+	var decisions bytes.Buffer
+	decisionLog := logging.NewDecisionLog(logging.NewWriterSink(&decisions), 10, nil)
+	logging.SetDecisionLog(decisionLog)
+	defer logging.SetDecisionLog(nil)
+
+	authorizations := authz.NewAuthorizations()
+	client, _ := authz.NewAuthorizationFromYaml([]byte(clientA))
+	authorizations.Add(client)
+	client, _ = authz.NewAuthorizationFromYaml([]byte(clientLimited))
+	authorizations.Add(client)
+
+	server := NewJarlAuthzServer(&Configuration{
+		HTTPListenOn:    "localhost:0",
+		GRPCListenOn:    "localhost:0",
+		AdminListenOn:   "localhost:0",
+		HTTPAuthZHeader: checkHeader,
+		Authorizations:  authorizations,
+	})
+	go server.Start()
+	defer server.Stop()
+
+	waitForServer(server)
+	assert.Eventually(t, func() bool { return server.adminServer.state.Get() == Serving }, 2*time.Second, 50*time.Millisecond)
+
+	evaluate := func(body string) (int, evaluateResponse) {
+		resp, err := http.Post(fmt.Sprintf("http://localhost:%d/admin/evaluate", server.adminServer.port), "application/json", strings.NewReader(body))
+		assert.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		var result evaluateResponse
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	code, result := evaluate(`{"identity":"clientA","host":"localhost","method":"GET","path":"/pokemon/pikachu","sourceAddress":"10.0.0.1:4242"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, result.Allowed)
+	assert.Equal(t, "clientA", result.ClientID)
+	assert.Equal(t, "paths GET /pokemon/.*?", result.Rule)
+	assert.Equal(t, http.StatusOK, result.Status)
+	assert.Equal(t, resultAllowed, result.Headers[resultHeader])
+
+	code, result = evaluate(`{"identity":"clientA","host":"localhost","method":"POST","path":"/berries"}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, result.Allowed)
+	assert.Equal(t, http.StatusForbidden, result.Status)
+	assert.Equal(t, "clientA is not authorized to access POST /berries", result.Reason)
+	assert.Equal(t, resultDenied, result.Headers[resultHeader])
+
+	// Evaluations do not consume the client rate limit quota
+	for i := 0; i < 3; i++ {
+		_, result = evaluate(`{"identity":"clientLimited","host":"localhost","path":"/pokemon"}`)
+		assert.True(t, result.Allowed)
+	}
+
+	code, _ = evaluate(`{"identity":"clientA"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = evaluate(`{"identity":"clientA","path":"/pokemon","sourceAddress":"nowhere"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = evaluate(`{"client":"clientA","path":"/pokemon"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// Evaluations are not logged as decisions
+	assert.NoError(t, decisionLog.Close(context.Background()))
+	assert.Empty(t, decisions.String())
+}
+
+// testPKI generates certificates signed by a test CA
+type testPKI struct {
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+	dir   string
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "jarl test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	pki := &testPKI{ca: ca, caKey: key, dir: t.TempDir()}
+	pki.write(t, "ca.pem", "CERTIFICATE", der)
+	return pki
+}
+
+func (p *testPKI) path(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+func (p *testPKI) write(t *testing.T, name string, blockType string, der []byte) {
+	assert.NoError(t, os.WriteFile(p.path(name), pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
+
+// issue generates a certificate/key pair named name.pem/name-key.pem
+func (p *testPKI) issue(t *testing.T, name string, serial int64, usage x509.ExtKeyUsage) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	p.write(t, name+".pem", "CERTIFICATE", der)
+	p.write(t, name+"-key.pem", "EC PRIVATE KEY", keyDer)
+}
+
+func (p *testPKI) clientTLS(t *testing.T, withCert bool) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(p.ca)
+	conf := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+	if withCert {
+		cert, err := tls.LoadX509KeyPair(p.path("client.pem"), p.path("client-key.pem"))
+		assert.NoError(t, err)
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf
+}
+
+func TestTLS(t *testing.T) {
+	logging.Setup()
+
+	pki := newTestPKI(t)
+	pki.issue(t, "server", 2, x509.ExtKeyUsageServerAuth)
+	pki.issue(t, "client", 3, x509.ExtKeyUsageClientAuth)
+	tlsConf := &TLSConfiguration{CertFile: pki.path("server.pem"), KeyFile: pki.path("server-key.pem"), ClientCAFile: pki.path("ca.pem")}
+
+	server := NewJarlAuthzServer(&Configuration{
+		HTTPListenOn:    "localhost:0",
+		GRPCListenOn:    "localhost:0",
+		AdminListenOn:   "localhost:0",
+		HTTPAuthZHeader: checkHeader,
+		Authorizations:  authz.NewAuthorizations(),
+		GRPCTLS:         tlsConf,
+		HTTPTLS:         tlsConf,
+	})
+	go server.Start()
+	defer server.Stop()
+
+	waitForServer(server)
+
+	checkV3 := func(conf *tls.Config) error {
+		conn, err := grpc.NewClient(fmt.Sprintf("localhost:%d", server.grpcServer.port), grpc.WithTransportCredentials(credentials.NewTLS(conf)))
+		if err != nil {
+			return err
+		}
+		defer func() { _ = conn.Close() }()
+		_, err = authv3.NewAuthorizationClient(conn).Check(context.Background(), &authv3.CheckRequest{
+			Attributes: &authv3.AttributeContext{
+				Request: &authv3.AttributeContext_Request{
+					Http: &authv3.AttributeContext_HttpRequest{Host: "localhost", Path: "/pokemon", Method: http.MethodGet},
+				},
+			},
+		})
+		return err
+	}
+
+	assert.NoError(t, checkV3(pki.clientTLS(t, true)))
+	assert.Error(t, checkV3(pki.clientTLS(t, false)))
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: pki.clientTLS(t, true)}}
+	resp, err := httpClient.Get(fmt.Sprintf("https://localhost:%d/healthz", server.httpServer.port))
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	// The dedicated admin listener is secured as the HTTP server
+	assert.Eventually(t, func() bool { return server.adminServer.state.Get() == Serving }, 2*time.Second, 50*time.Millisecond)
+	resp, err = httpClient.Get(fmt.Sprintf("https://localhost:%d/admin/version", server.adminServer.port))
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	_ = resp.Body.Close()
+	resp, err = http.Get(fmt.Sprintf("http://localhost:%d/admin/version", server.adminServer.port))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "plaintext requests are rejected")
+	_ = resp.Body.Close()
+
+	// Rotated certificates are served to new connections
+	pki.issue(t, "server", 4, x509.ExtKeyUsageServerAuth)
+	future := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(pki.path("server.pem"), future, future))
+	conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%d", server.httpServer.port), pki.clientTLS(t, true))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64())
+	_ = conn.Close()
+}
+
 // waitForServer waits until the server is healty and serving requests
 func waitForServer(server *JarlAuthzServer) {
 	backoff := 100 * time.Millisecond
@@ -250,3 +1090,70 @@ func waitForServer(server *JarlAuthzServer) {
 	}
 	log.Fatalf("Server not started after 10 attempts")
 }
+
+func TestReceivedHeaderRedaction(t *testing.T) {
+	a := authz.NewAuthorizations()
+	client, _ := authz.NewAuthorizationFromYaml([]byte(clientA))
+	a.Add(client)
+	redactor := logging.NewRedactor(logging.RedactionConfiguration{
+		DenyHeaders:    []string{"x-internal"},
+		HashHeaders:    []string{checkHeader},
+		MaxContextSize: 1024,
+	})
+	v3 := &GRPCAuthzServerV3{AuthzHeader: checkHeader, Authorizations: a, Redactor: redactor}
+	v2 := &GRPCAuthzServerV2{AuthzHeader: checkHeader, Authorizations: a}
+
+	headers := map[string]string{checkHeader: "clientA", "authorization": "Bearer s3cr3t", "cookie": "session=s3cr3t", "x-internal": "internal"}
+	receivedV3 := func(path string, body string) string {
+		resp, err := v3.Check(context.Background(), &authv3.CheckRequest{
+			Attributes: &authv3.AttributeContext{
+				Request: &authv3.AttributeContext_Request{
+					Http: &authv3.AttributeContext_HttpRequest{Host: "localhost", Path: path, Method: http.MethodGet, Headers: headers, Body: body},
+				},
+			},
+		})
+		assert.NoError(t, err)
+		h := resp.GetOkResponse().GetHeaders()
+		if denied := resp.GetDeniedResponse(); denied != nil {
+			h = denied.GetHeaders()
+		}
+		for _, header := range h {
+			if header.GetHeader().GetKey() == receivedHeader {
+				return header.GetHeader().GetValue()
+			}
+		}
+		return ""
+	}
+
+	for _, path := range []string{"/pokemon/pikachu", "/berries"} {
+		value := receivedV3(path, "")
+		assert.NotContains(t, value, "s3cr3t")
+		assert.NotContains(t, value, "internal")
+		assert.NotContains(t, value, "clientA")
+		assert.Contains(t, value, logging.Redacted)
+		assert.Contains(t, value, redactor.Hash("clientA"))
+	}
+	// The checked request is left untouched
+	assert.Equal(t, "Bearer s3cr3t", headers["authorization"])
+
+	// Bodies exceeding the maximum context size are removed
+	value := receivedV3("/pokemon/pikachu", strings.Repeat("b", 2048))
+	assert.NotContains(t, value, "bbbb")
+	assert.Contains(t, value, "/pokemon/pikachu")
+
+	// The default redactor applies when none is configured
+	resp, err := v2.Check(context.Background(), &authv2.CheckRequest{
+		Attributes: &authv2.AttributeContext{
+			Request: &authv2.AttributeContext_Request{
+				Http: &authv2.AttributeContext_HttpRequest{Host: "localhost", Path: "/pokemon/pikachu", Method: http.MethodGet, Headers: headers},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	for _, header := range resp.GetOkResponse().GetHeaders() {
+		if header.GetHeader().GetKey() == receivedHeader {
+			assert.NotContains(t, header.GetHeader().GetValue(), "s3cr3t")
+			assert.Contains(t, header.GetHeader().GetValue(), "clientA")
+		}
+	}
+}
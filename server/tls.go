@@ -0,0 +1,134 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fredjeck/jarl/logging"
+)
+
+// TLSConfiguration stores the certificates used to secure a listener
+type TLSConfiguration struct {
+	CertFile     string // CertFile is the path to the PEM encoded server certificate chain
+	KeyFile      string // KeyFile is the path to the PEM encoded server private key
+	ClientCAFile string // ClientCAFile is the path to a PEM bundle of CAs used to verify client certificates, mTLS is disabled if empty
+}
+
+// certificateReloader serves the certificates of a TLSConfiguration and reloads them whenever the files are modified
+type certificateReloader struct {
+	conf       *TLSConfiguration
+	nextProtos []string
+	mu         sync.RWMutex
+	cert       *tls.Certificate
+	clientCAs  *x509.CertPool
+	modTimes   []time.Time
+}
+
+// newTLSConfig creates a server tls.Config whose certificates are reloaded when the underlying files change
+func newTLSConfig(conf *TLSConfiguration, nextProtos ...string) (*tls.Config, error) {
+	if len(conf.CertFile) == 0 || len(conf.KeyFile) == 0 {
+		return nil, errors.New("tls requires both a certificate and a key file")
+	}
+
+	r := &certificateReloader{conf: conf, nextProtos: nextProtos}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		NextProtos:         nextProtos,
+		GetConfigForClient: r.configForClient,
+	}, nil
+}
+
+// files lists the files watched for changes
+func (r *certificateReloader) files() []string {
+	files := []string{r.conf.CertFile, r.conf.KeyFile}
+	if len(r.conf.ClientCAFile) > 0 {
+		files = append(files, r.conf.ClientCAFile)
+	}
+	return files
+}
+
+// changed returns true if any of the watched files was modified since the last load
+func (r *certificateReloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return false // Keep serving the current certificates while files are being rotated
+		}
+		if !info.ModTime().Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// load reads the certificate, key and client CAs files
+func (r *certificateReloader) load() error {
+	modTimes := make([]time.Time, 0, 3)
+	for _, f := range r.files() {
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.conf.CertFile, r.conf.KeyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load tls certificate '%s' : %w", r.conf.CertFile, err)
+	}
+
+	var clientCAs *x509.CertPool
+	if len(r.conf.ClientCAFile) > 0 {
+		pem, err := os.ReadFile(r.conf.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no valid certificate found in client CA bundle '%s'", r.conf.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return nil
+}
+
+// configForClient returns the tls configuration for an inbound connection, reloading the certificates if needed
+func (r *certificateReloader) configForClient(_ *tls.ClientHelloInfo) (*tls.Config, error) {
+	if r.changed() {
+		if err := r.load(); err != nil {
+			slog.Error(fmt.Sprintf("unable to reload tls certificate '%s', keeping the current one", r.conf.CertFile), slog.Any(logging.KeyError, err))
+		} else {
+			slog.Info(fmt.Sprintf("reloaded tls certificate '%s'", r.conf.CertFile))
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	conf := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   r.nextProtos,
+		Certificates: []tls.Certificate{*r.cert},
+	}
+	if r.clientCAs != nil {
+		conf.ClientCAs = r.clientCAs
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+
+	"github.com/fredjeck/jarl/authz"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/fredjeck/jarl/server"
+	spanName   = "jarl.Check"
+
+	attrProtocol       = attribute.Key("jarl.protocol")
+	attrClientID       = attribute.Key("jarl.client.id")
+	attrDecision       = attribute.Key("jarl.decision")
+	attrRule           = attribute.Key("jarl.rule")
+	attrReason         = attribute.Key("jarl.reason")
+	attrIdentitySource = attribute.Key("jarl.identity.source")
+	attrIdentityHeader = attribute.Key("jarl.identity.header")
+	attrHTTPMethod     = attribute.Key("http.request.method")
+	attrHTTPHost       = attribute.Key("server.address")
+	attrHTTPPath       = attribute.Key("url.path")
+
+	identityHeader  = "header"  // identityHeader the client identity was read from the authz header
+	identityMissing = "missing" // identityMissing the request carried no client identity
+)
+
+// startCheckSpan starts the span of a check request, child of the trace context propagated by the checked request headers
+func startCheckSpan(protocol string, authzHeader string, req *authz.Request) trace.Span {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.MapCarrier(req.Headers))
+	_, span := otel.Tracer(tracerName).Start(ctx, spanName,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attrProtocol.String(protocol),
+			attrIdentityHeader.String(authzHeader),
+			attrHTTPMethod.String(string(req.Method)),
+			attrHTTPHost.String(req.Host),
+			attrHTTPPath.String(req.Path),
+		),
+	)
+	return span
+}
+
+// endCheckSpan records the decision attributes and ends the span
+func endCheckSpan(span trace.Span, decision authz.Decision, identified bool) {
+	source := identityMissing
+	if identified {
+		source = identityHeader
+	}
+	outcome := decisionAllow
+	if !decision.Allowed {
+		outcome = decisionDeny
+	}
+	span.SetAttributes(
+		attrIdentitySource.String(source),
+		attrClientID.String(decision.ClientID),
+		attrDecision.String(outcome),
+		attrRule.String(decision.Rule),
+	)
+	if !decision.Allowed {
+		span.SetAttributes(attrReason.String(string(decision.Code)))
+	}
+	span.End()
+}
+
+// traceID returns the identifier of the trace the span belongs to, empty if the request is not traced
+func traceID(span trace.Span) string {
+	if sc := span.SpanContext(); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+// Package tracing - OpenTelemetry traces export
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+)
+
+// Exporter is the protocol used to export the traces
+type Exporter string
+
+const (
+	ExporterNone     Exporter = ""          // ExporterNone disables tracing
+	ExporterOTLPGRPC Exporter = "otlp-grpc" // ExporterOTLPGRPC exports the traces to an OTLP collector over gRPC
+	ExporterOTLPHTTP Exporter = "otlp-http" // ExporterOTLPHTTP exports the traces to an OTLP collector over HTTP
+
+	// ServiceName is the service name of the exported spans
+	ServiceName = "jarl"
+)
+
+// Configuration configures the traces export
+type Configuration struct {
+	Exporter    Exporter
+	Endpoint    string  // Endpoint is the collector host:port, the OTEL_EXPORTER_OTLP_ENDPOINT environment variable or the OTLP default if empty
+	Insecure    bool    // Insecure disables the TLS connection to the collector
+	SampleRatio float64 // SampleRatio is the ratio of the traces started by jarl which are sampled, traces started upstream follow their parent decision
+	Version     string  // Version is reported as the service version
+}
+
+// ParseExporter validates the provided exporter name
+func ParseExporter(exporter string) (Exporter, error) {
+	switch e := Exporter(exporter); e {
+	case ExporterNone, ExporterOTLPGRPC, ExporterOTLPHTTP:
+		return e, nil
+	default:
+		return ExporterNone, fmt.Errorf("unsupported tracing exporter '%s', expected otlp-grpc or otlp-http", exporter)
+	}
+}
+
+// Propagator extracts the W3C trace context and the B3 single and multiple headers
+func Propagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+		b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader|b3.B3SingleHeader)),
+	)
+}
+
+// Setup installs the global propagator and, unless tracing is disabled, the tracer provider exporting the spans.
+// The returned function flushes the pending spans and stops the export.
+func Setup(ctx context.Context, conf Configuration) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(Propagator())
+	if conf.Exporter == ExporterNone {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := newExporter(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceName(ServiceName),
+		semconv.ServiceVersion(conf.Version),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// newExporter creates the OTLP exporter matching the configuration
+func newExporter(ctx context.Context, conf Configuration) (*otlptrace.Exporter, error) {
+	switch conf.Exporter {
+	case ExporterOTLPGRPC:
+		opts := make([]otlptracegrpc.Option, 0)
+		if len(conf.Endpoint) > 0 {
+			opts = append(opts, otlptracegrpc.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case ExporterOTLPHTTP:
+		opts := make([]otlptracehttp.Option, 0)
+		if len(conf.Endpoint) > 0 {
+			opts = append(opts, otlptracehttp.WithEndpoint(conf.Endpoint))
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported tracing exporter '%s', expected otlp-grpc or otlp-http", conf.Exporter)
+	}
+}
@@ -0,0 +1,60 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestParseExporter(t *testing.T) {
+	for _, e := range []string{"", "otlp-grpc", "otlp-http"} {
+		exporter, err := ParseExporter(e)
+		assert.NoError(t, err)
+		assert.Equal(t, Exporter(e), exporter)
+	}
+	_, err := ParseExporter("zipkin")
+	assert.Error(t, err)
+}
+
+func TestPropagator(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+	}{
+		{"traceparent", map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}},
+		{"b3 single", map[string]string{"b3": "4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1"}},
+		{"b3 multiple", map[string]string{"x-b3-traceid": "4bf92f3577b34da6a3ce929d0e0e4736", "x-b3-spanid": "00f067aa0ba902b7", "x-b3-sampled": "1"}},
+	}
+	for _, tc := range tests {
+		sc := trace.SpanContextFromContext(Propagator().Extract(context.Background(), propagation.MapCarrier(tc.headers)))
+		assert.True(t, sc.IsValid(), tc.name)
+		assert.True(t, sc.IsRemote(), tc.name)
+		assert.True(t, sc.IsSampled(), tc.name)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID().String(), tc.name)
+		assert.Equal(t, "00f067aa0ba902b7", sc.SpanID().String(), tc.name)
+	}
+
+	sc := trace.SpanContextFromContext(Propagator().Extract(context.Background(), propagation.MapCarrier{}))
+	assert.False(t, sc.IsValid())
+}
+
+func TestSetup(t *testing.T) {
+	shutdown, err := Setup(context.Background(), Configuration{})
+	assert.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+
+	for _, e := range []Exporter{ExporterOTLPGRPC, ExporterOTLPHTTP} {
+		shutdown, err = Setup(context.Background(), Configuration{Exporter: e, Endpoint: "localhost:0", Insecure: true, SampleRatio: 0.5})
+		assert.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		_ = shutdown(ctx)
+		cancel()
+	}
+
+	_, err = Setup(context.Background(), Configuration{Exporter: "zipkin"})
+	assert.Error(t, err)
+}